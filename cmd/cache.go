@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// searchCache holds the first window of records for recent searches so that paging
+// within that window does not require another WorldCat request
+type searchCache struct {
+	window     int
+	ttl        time.Duration
+	maxEntries int
+	mutex      sync.Mutex
+	entries    map[string]*searchCacheEntry
+	hits       int64
+	misses     int64
+	evictions  int64
+}
+
+type searchCacheEntry struct {
+	count       int
+	records     []wcRecord
+	suggestions []string
+	expires     time.Time
+}
+
+// newSearchCache creates a search cache that holds up to maxEntries searches. A window size
+// of 0 disables caching.
+func newSearchCache(window int, ttl time.Duration, maxEntries int) *searchCache {
+	return &searchCache{window: window, ttl: ttl, maxEntries: maxEntries, entries: make(map[string]*searchCacheEntry)}
+}
+
+// covers returns true if the requested page falls within the cached window
+func (sc *searchCache) covers(start int, rows int) bool {
+	return sc.window > 0 && start+rows <= sc.window
+}
+
+// get returns the requested page of a cached search, or nil if it is not cached
+func (sc *searchCache) get(key string, start int, rows int) *wcSearchResponse {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	entry, found := sc.entries[key]
+	if !found {
+		sc.misses++
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(sc.entries, key)
+		sc.misses++
+		return nil
+	}
+	sc.hits++
+	log.Printf("INFO: search cache hit for %s", key)
+	return entry.page(start, rows)
+}
+
+// put caches the window of records for a search and returns the requested page. When the
+// cache is full the entry that expires first is evicted.
+func (sc *searchCache) put(key string, wcResp *wcSearchResponse, start int, rows int) *wcSearchResponse {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	now := time.Now()
+	for k, e := range sc.entries {
+		if now.After(e.expires) {
+			delete(sc.entries, k)
+		}
+	}
+	if _, found := sc.entries[key]; found == false {
+		for len(sc.entries) >= sc.maxEntries && len(sc.entries) > 0 {
+			sc.evictFirstExpiring()
+		}
+	}
+	entry := &searchCacheEntry{count: wcResp.Count, records: wcResp.Records, suggestions: wcResp.Suggestions,
+		expires: now.Add(sc.ttl)}
+	sc.entries[key] = entry
+	return entry.page(start, rows)
+}
+
+// evictFirstExpiring removes the entry that expires first. The mutex must be held.
+func (sc *searchCache) evictFirstExpiring() {
+	evictKey := ""
+	var evictExpires time.Time
+	for k, e := range sc.entries {
+		if evictKey == "" || e.expires.Before(evictExpires) {
+			evictKey, evictExpires = k, e.expires
+		}
+	}
+	log.Printf("INFO: search cache is full; evict %s", evictKey)
+	delete(sc.entries, evictKey)
+	sc.evictions++
+}
+
+// flush removes all cached searches and returns the number removed
+func (sc *searchCache) flush() int {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	count := len(sc.entries)
+	sc.entries = make(map[string]*searchCacheEntry)
+	return count
+}
+
+// stats returns the cache settings, the number of unexpired entries and the hit counts
+func (sc *searchCache) stats() gin.H {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	now := time.Now()
+	live := 0
+	for _, e := range sc.entries {
+		if now.Before(e.expires) {
+			live++
+		}
+	}
+	hitRatio := 0.0
+	if sc.hits+sc.misses > 0 {
+		hitRatio = float64(sc.hits) / float64(sc.hits+sc.misses)
+	}
+	return gin.H{"enabled": sc.window > 0, "window": sc.window, "ttl_seconds": int64(sc.ttl / time.Second),
+		"max_entries": sc.maxEntries, "entries": live, "evictions": sc.evictions, "hits": sc.hits, "misses": sc.misses,
+		"hit_ratio": hitRatio}
+}
+
+// flushIdentities removes all cached localized identities and returns the number removed
+func (svc *ServiceContext) flushIdentities() int {
+	count := 0
+	svc.Identities.Range(func(key, _ interface{}) bool {
+		svc.Identities.Delete(key)
+		count++
+		return true
+	})
+	return count
+}
+
+// countIdentities returns the number of cached localized identities
+func (svc *ServiceContext) countIdentities() int {
+	count := 0
+	svc.Identities.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// flushCacheHandler empties every cache and returns the number of entries removed from each.
+// The service caches searches and localized identities; resources are not cached.
+func (svc *ServiceContext) flushCacheHandler(c *gin.Context) {
+	searches := svc.SearchCache.flush()
+	identities := svc.flushIdentities()
+	log.Printf("INFO: caches flushed; %d searches and %d identities evicted", searches, identities)
+	c.JSON(http.StatusOK, gin.H{"evicted": gin.H{"search": searches, "identity": identities}})
+}
+
+// cacheStatsHandler returns the size of every cache and the search cache hit ratio
+func (svc *ServiceContext) cacheStatsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"search": svc.SearchCache.stats(),
+		"identity": gin.H{"entries": svc.countIdentities()}})
+}
+
+// page returns a search response containing a slice of the cached records
+func (e *searchCacheEntry) page(start int, rows int) *wcSearchResponse {
+	resp := &wcSearchResponse{Count: e.count, Records: make([]wcRecord, 0), Suggestions: e.suggestions}
+	if start >= len(e.records) {
+		return resp
+	}
+	end := start + rows
+	if end > len(e.records) {
+		end = len(e.records)
+	}
+	resp.Records = append(resp.Records, e.records[start:end]...)
+	return resp
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestSearchCacheConcurrentAccess(t *testing.T) {
+	cache := newSearchCache(10, time.Minute, 100)
+	records := make([]wcRecord, 0, 10)
+	for i := 0; i < 10; i++ {
+		records = append(records, wcRecord{ID: fmt.Sprintf("%d", 1000+i)})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			key := fmt.Sprintf("query %d", worker%4)
+			for j := 0; j < 50; j++ {
+				if page := cache.get(key, 2, 3); page != nil && len(page.Records) != 3 {
+					t.Errorf("expected a page of 3 records, got %d", len(page.Records))
+				}
+				page := cache.put(key, &wcSearchResponse{Count: 100, Records: records}, 2, 3)
+				if len(page.Records) != 3 || page.Records[0].ID != "1002" {
+					t.Errorf("unexpected page %+v", page.Records)
+				}
+				if worker%5 == 0 && j%10 == 0 {
+					cache.flush()
+				}
+				cache.stats()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := cache.stats()
+	if stats["hits"].(int64)+stats["misses"].(int64) != 20*50 {
+		t.Errorf("expected %d lookups, got %v hits and %v misses", 20*50, stats["hits"], stats["misses"])
+	}
+	if entries := stats["entries"].(int); entries > 4 {
+		t.Errorf("expected at most 4 entries, got %d", entries)
+	}
+}
+
+func TestSearchCachePaging(t *testing.T) {
+	mock := newMockWorldCat(t)
+	ids := make([]string, 0, 20)
+	for i := 0; i < 20; i++ {
+		ids = append(ids, fmt.Sprintf("%d", 1000+i))
+	}
+	requested := make([]string, 0)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		start := r.URL.Query().Get("startRecord")
+		requested = append(requested, fmt.Sprintf("%s+%s", start, r.URL.Query().Get("maximumRecords")))
+		if start == "1" {
+			fmt.Fprint(w, sruResponse(100, ids...))
+			return
+		}
+		fmt.Fprint(w, sruResponse(100, "1020", "1021", "1022", "1023", "1024", "1025", "1026", "1027", "1028", "1029"))
+	}
+	cfg := testConfig(mock)
+	cfg.CacheWindow = 20
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newTestRouter(svc)
+
+	search := func(start int) searchResult {
+		resp := postJSON(router, "/api/search", map[string]interface{}{"query": "keyword: {cats}",
+			"pagination": map[string]int{"start": start, "rows": 10}})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+		return parseSearchResult(t, resp)
+	}
+
+	// both pages fall within the window, so the second is served from the cache
+	for _, start := range []int{0, 10} {
+		result := search(start)
+		if len(result.Groups) != 10 || result.Groups[0].Value != ids[start] || result.Pagination.Total != 100 {
+			t.Errorf("unexpected page at %d: %+v", start, result)
+		}
+	}
+	if len(requested) != 1 || requested[0] != "1+20" {
+		t.Fatalf("expected one upstream request for the window, got %q", requested)
+	}
+
+	// the next page is outside the window and is requested directly
+	result := search(20)
+	if len(result.Groups) != 10 || result.Groups[0].Value != "1020" {
+		t.Errorf("unexpected page at 20: %+v", result)
+	}
+	if len(requested) != 2 || requested[1] != "21+10" {
+		t.Errorf("expected a second upstream request for the page, got %q", requested)
+	}
+}
+
+func TestSearchCacheMaxEntries(t *testing.T) {
+	cache := newSearchCache(10, time.Minute, 2)
+	resp := &wcSearchResponse{Count: 1, Records: []wcRecord{{ID: "1001"}}}
+	cache.put("first", resp, 0, 10)
+	cache.put("second", resp, 0, 10)
+	// the first entry expires first, so it is evicted when a third search is cached
+	cache.entries["second"].expires = cache.entries["first"].expires.Add(time.Second)
+	cache.put("third", resp, 0, 10)
+	if cache.get("first", 0, 10) != nil {
+		t.Errorf("expected the first search to be evicted")
+	}
+	if cache.get("second", 0, 10) == nil || cache.get("third", 0, 10) == nil {
+		t.Errorf("expected the second and third searches to be cached")
+	}
+
+	// replacing a cached search does not evict another
+	cache.put("third", resp, 0, 10)
+	if len(cache.entries) != 2 || cache.get("second", 0, 10) == nil {
+		t.Errorf("expected two entries including the second search, got %d", len(cache.entries))
+	}
+	if stats := cache.stats(); stats["evictions"] != int64(1) || stats["max_entries"] != 2 {
+		t.Errorf("expected 1 eviction and max 2 entries, got %v", stats)
+	}
+}
+
+func TestCacheFlushAndStats(t *testing.T) {
+	mock := newMockWorldCat(t)
+	cfg := testConfig(mock)
+	cfg.CacheWindow = 20
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newServiceRouter(svc, false)
+	apiKey := map[string]string{"X-Api-Key": "apikey"}
+	auth := bearer(mintToken(t, svc, v4jwt.User, time.Hour))
+
+	// a repeated search is a hit; the others are misses
+	for _, query := range []string{"keyword: {cats}", "keyword: {cats}", "keyword: {dogs}"} {
+		resp := doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": query}, auth)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+	for _, lang := range []string{"en-US", "es"} {
+		doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": lang})
+	}
+
+	var stats struct {
+		Search struct {
+			Entries  int     `json:"entries"`
+			Hits     int     `json:"hits"`
+			Misses   int     `json:"misses"`
+			HitRatio float64 `json:"hit_ratio"`
+		} `json:"search"`
+		Identity struct {
+			Entries int `json:"entries"`
+		} `json:"identity"`
+	}
+	getStats := func() {
+		resp := doRequest(router, http.MethodGet, "/api/cache/stats", nil, apiKey)
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+		}
+		json.Unmarshal(resp.Body.Bytes(), &stats)
+	}
+	getStats()
+	if stats.Search.Entries != 2 || stats.Search.Hits != 1 || stats.Search.Misses != 2 ||
+		math.Abs(stats.Search.HitRatio-1.0/3.0) > 0.001 || stats.Identity.Entries != 2 {
+		t.Errorf("expected 2 searches with 1 hit of 3 and 2 identities, got %+v", stats)
+	}
+
+	if resp := doRequest(router, http.MethodPost, "/api/cache/flush", nil, nil); resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without an API key, got %d", resp.Code)
+	}
+	resp := doRequest(router, http.MethodPost, "/api/cache/flush", nil, apiKey)
+	var flushed struct {
+		Evicted map[string]int `json:"evicted"`
+	}
+	json.Unmarshal(resp.Body.Bytes(), &flushed)
+	if resp.Code != http.StatusOK || flushed.Evicted["search"] != 2 || flushed.Evicted["identity"] != 2 {
+		t.Errorf("expected 2 searches and 2 identities evicted, got %d: %s", resp.Code, resp.Body.String())
+	}
+	getStats()
+	if stats.Search.Entries != 0 || stats.Identity.Entries != 0 {
+		t.Errorf("expected empty caches after the flush, got %+v", stats)
+	}
+
+	// a flushed search is requested from WorldCat again
+	searches := mock.searches.Load()
+	doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}, auth)
+	if mock.searches.Load() != searches+1 {
+		t.Errorf("expected the flushed search to be requested again")
+	}
+}
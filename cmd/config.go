@@ -1,59 +1,328 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 )
 
 // ServiceConfig defines all of the JRML pool configuration parameters
 type ServiceConfig struct {
-	Port            int
-	WCKey           string
-	WCAPI           string
-	JWTKey          string
-	OCLCKey         string
-	OCLCSecret      string
-	OCLCAuthURL     string
-	OCLCMetadataAPI string
+	Port                int
+	WCKey               string
+	WCAPI               string
+	JWTKey              string
+	APIKey              string
+	OCLCKey             string
+	OCLCSecret          string
+	OCLCAuthURL         string
+	OCLCMetadataAPI     string
+	OCLCHoldingsAPI     string
+	OCLCPrewarm         bool
+	OCLCRefresh         bool
+	BatchMax            int
+	ILLURL              string
+	DefaultRows         int
+	MaxOffset           int
+	MaxBodySize         int64
+	RateLimit           int
+	RateBurst           int
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     int
+	GroupResults        bool
+	BroadKeyword        bool
+	AuthorVariants      bool
+	CoverImageURL       string
+	MinTermLength       int
+	RecordSchema        string
+	ProvidersFile       string
+	CacheWindow         int
+	CacheTTL            int
+	CacheMaxEntries     int
+	SearchMaxAge        int
+	ResourceMaxAge      int
+	DefaultSort         string
+	DefaultSortOrder    string
+	StrictSort          bool
+	UserAgent           string
+	AssetsDir           string
+	DefaultLogoURL      string
+	Pprof               bool
+	PartnerSymbols      string
+	IdentifierRelation  string
+	MinConfidence       string
+	LowConfidenceRows   int
 }
 
 // LoadConfiguration will load the service configuration from env/cmdline
 // and return a pointer to it. Any failures are fatal.
 func LoadConfiguration() *ServiceConfig {
 	log.Printf("Loading configuration...")
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	log.Printf("[CONFIG] port          = [%d]", cfg.Port)
+	log.Printf("[CONFIG] wcapi         = [%s]", cfg.WCAPI)
+	log.Printf("[CONFIG] apikey        = [%t]", cfg.APIKey != "")
+	log.Printf("[CONFIG] oclckey       = [%s]", cfg.OCLCKey)
+	log.Printf("[CONFIG] oclcauth      = [%s]", cfg.OCLCAuthURL)
+	log.Printf("[CONFIG] oclcmetadata  = [%s]", cfg.OCLCMetadataAPI)
+	log.Printf("[CONFIG] oclcholdings  = [%s]", cfg.OCLCHoldingsAPI)
+	log.Printf("[CONFIG] oclcprewarm   = [%t]", cfg.OCLCPrewarm)
+	log.Printf("[CONFIG] oclcrefresh   = [%t]", cfg.OCLCRefresh)
+	log.Printf("[CONFIG] defaultrows   = [%d]", cfg.DefaultRows)
+	log.Printf("[CONFIG] maxoffset     = [%d]", cfg.MaxOffset)
+	log.Printf("[CONFIG] illurl        = [%s]", cfg.ILLURL)
+	log.Printf("[CONFIG] batchmax      = [%d]", cfg.BatchMax)
+	log.Printf("[CONFIG] maxbody       = [%d]", cfg.MaxBodySize)
+	log.Printf("[CONFIG] ratelimit     = [%d]", cfg.RateLimit)
+	log.Printf("[CONFIG] rateburst     = [%d]", cfg.RateBurst)
+	log.Printf("[CONFIG] maxidle       = [%d]", cfg.MaxIdleConns)
+	log.Printf("[CONFIG] maxidleperhost = [%d]", cfg.MaxIdleConnsPerHost)
+	log.Printf("[CONFIG] idletimeout   = [%d]", cfg.IdleConnTimeout)
+	log.Printf("[CONFIG] groupresults  = [%t]", cfg.GroupResults)
+	log.Printf("[CONFIG] broadkeyword  = [%t]", cfg.BroadKeyword)
+	log.Printf("[CONFIG] authorvariants = [%t]", cfg.AuthorVariants)
+	log.Printf("[CONFIG] coverurl      = [%s]", cfg.CoverImageURL)
+	log.Printf("[CONFIG] useragent     = [%s]", cfg.UserAgent)
+	log.Printf("[CONFIG] schema        = [%s]", cfg.RecordSchema)
+	log.Printf("[CONFIG] mintermlen    = [%d]", cfg.MinTermLength)
+	log.Printf("[CONFIG] identifierrelation = [%s]", cfg.IdentifierRelation)
+	log.Printf("[CONFIG] minconfidence = [%s]", cfg.MinConfidence)
+	log.Printf("[CONFIG] lowconfidencerows = [%d]", cfg.LowConfidenceRows)
+	log.Printf("[CONFIG] assets        = [%s]", cfg.AssetsDir)
+	log.Printf("[CONFIG] defaultlogo   = [%s]", cfg.DefaultLogoURL)
+	log.Printf("[CONFIG] pprof         = [%t]", cfg.Pprof)
+	log.Printf("[CONFIG] partners      = [%s]", cfg.PartnerSymbols)
+	log.Printf("[CONFIG] providers     = [%s]", cfg.ProvidersFile)
+	log.Printf("[CONFIG] cachewindow   = [%d]", cfg.CacheWindow)
+	log.Printf("[CONFIG] cachettl      = [%d]", cfg.CacheTTL)
+	log.Printf("[CONFIG] cachemax      = [%d]", cfg.CacheMaxEntries)
+	log.Printf("[CONFIG] searchmaxage  = [%d]", cfg.SearchMaxAge)
+	log.Printf("[CONFIG] resourcemaxage = [%d]", cfg.ResourceMaxAge)
+	log.Printf("[CONFIG] sort          = [%s %s]", cfg.DefaultSort, cfg.DefaultSortOrder)
+	log.Printf("[CONFIG] strictsort    = [%t]", cfg.StrictSort)
+
+	return cfg
+}
+
+// parseConfig defines all of the configuration flags in the flag set and parses the args.
+// Each param can be set from the environment; a command line flag takes precedence.
+func parseConfig(fs *flag.FlagSet, args []string) (*ServiceConfig, error) {
 	var cfg ServiceConfig
-	flag.IntVar(&cfg.Port, "port", 8080, "JRML pool service port (default 8080)")
-	flag.StringVar(&cfg.WCAPI, "wcapi", "", "WorldCat API base URL")
-	flag.StringVar(&cfg.WCKey, "wckey", "", "WordCat WSKey")
-	flag.StringVar(&cfg.JWTKey, "jwtkey", "", "JWT signature key")
-	flag.StringVar(&cfg.OCLCKey, "oclckey", "", "OCLC API key")
-	flag.StringVar(&cfg.OCLCSecret, "oclcsecret", "", "OCLC API secret")
-	flag.StringVar(&cfg.OCLCAuthURL, "oclcauth", "https://oauth.oclc.org/token?grant_type=client_credentials&scope=WorldCatMetadataAPI", "OCLC Auth endpoint")
-	flag.StringVar(&cfg.OCLCMetadataAPI, "oclcmetadata", "https://metadata.api.oclc.org/worldcat/search/brief-bibs", "OCLC metadata API")
+	fs.IntVar(&cfg.Port, "port", envInt("SERVICE_PORT", 8080), "JRML pool service port (default 8080)")
+	fs.StringVar(&cfg.WCAPI, "wcapi", envString("WC_API", ""), "WorldCat API base URL")
+	fs.StringVar(&cfg.WCKey, "wckey", envString("WC_API_KEY", ""), "WordCat WSKey")
+	fs.StringVar(&cfg.JWTKey, "jwtkey", envString("JWT_KEY", ""), "JWT signature key")
+	fs.StringVar(&cfg.APIKey, "apikey", envString("API_KEY", ""), "Static API key for server-to-server callers; empty to disable")
+	fs.StringVar(&cfg.OCLCKey, "oclckey", envString("OCLC_KEY", ""), "OCLC API key")
+	fs.StringVar(&cfg.OCLCSecret, "oclcsecret", envString("OCLC_SECRET", ""), "OCLC API secret")
+	fs.StringVar(&cfg.OCLCAuthURL, "oclcauth",
+		envString("OCLC_AUTH_URL", "https://oauth.oclc.org/token?grant_type=client_credentials&scope=WorldCatMetadataAPI"), "OCLC Auth endpoint")
+	fs.StringVar(&cfg.OCLCMetadataAPI, "oclcmetadata",
+		envString("OCLC_METADATA_API", "https://metadata.api.oclc.org/worldcat/search/brief-bibs"), "OCLC metadata API")
+	fs.StringVar(&cfg.OCLCHoldingsAPI, "oclcholdings",
+		envString("OCLC_HOLDINGS_API", "https://metadata.api.oclc.org/worldcat/search/bibs-holdings"), "OCLC holdings API")
+	fs.BoolVar(&cfg.OCLCRefresh, "oclcrefresh", envBool("OCLC_REFRESH", false), "Renew the OCLC auth token in the background before it expires")
+	fs.BoolVar(&cfg.OCLCPrewarm, "oclcprewarm", envBool("OCLC_PREWARM", true), "Request an OCLC auth token at startup (default true)")
+	fs.IntVar(&cfg.DefaultRows, "defaultrows", envInt("DEFAULT_ROWS", 20), "Number of search results returned when a request does not specify rows (default 20)")
+	fs.IntVar(&cfg.MaxOffset, "maxoffset", envInt("MAX_OFFSET", 10000), "Max number of search results that can be paged through (default 10000)")
+	fs.StringVar(&cfg.ILLURL, "illurl", envString("ILL_URL", ""), "ILL request service URL; empty to disable ILL requests")
+	fs.IntVar(&cfg.BatchMax, "batchmax", envInt("BATCH_MAX", 25), "Max number of items in a batch resource request (default 25)")
+	fs.Int64Var(&cfg.MaxBodySize, "maxbody", int64(envInt("MAX_BODY_SIZE", 65536)), "Max size in bytes of a request body (default 65536)")
+	fs.IntVar(&cfg.RateLimit, "ratelimit", envInt("RATE_LIMIT", 10), "Max WorldCat API requests per second; 0 for unlimited (default 10)")
+	fs.IntVar(&cfg.RateBurst, "rateburst", envInt("RATE_BURST", 20), "Max burst of WorldCat API requests (default 20)")
+	fs.IntVar(&cfg.MaxIdleConns, "maxidle", envInt("MAX_IDLE_CONNS", 100), "Max idle outbound connections (default 100)")
+	fs.IntVar(&cfg.MaxIdleConnsPerHost, "maxidleperhost", envInt("MAX_IDLE_CONNS_PER_HOST", 100), "Max idle outbound connections per host (default 100)")
+	fs.IntVar(&cfg.IdleConnTimeout, "idletimeout", envInt("IDLE_CONN_TIMEOUT", 90), "Seconds to keep an idle outbound connection open; 0 for no limit (default 90)")
+	fs.BoolVar(&cfg.GroupResults, "groupresults", envBool("GROUP_RESULTS", false), "Group search results that are the same work")
+	fs.BoolVar(&cfg.BroadKeyword, "broadkeyword", envBool("BROAD_KEYWORD", false), "Search title and author indexes as well as keyword for keyword terms")
+	fs.BoolVar(&cfg.AuthorVariants, "authorvariants", envBool("AUTHOR_VARIANTS", false), "Search natural and inverted forms of author names")
+	fs.StringVar(&cfg.AssetsDir, "assets", envString("ASSETS_DIR", "./assets"), "Directory of static assets served from /assets (default ./assets)")
+	fs.StringVar(&cfg.DefaultLogoURL, "defaultlogo", envString("DEFAULT_LOGO_URL", ""), "Logo URL used in place of missing logo assets; empty for no fallback")
+	fs.BoolVar(&cfg.Pprof, "pprof", envBool("PPROF", false), "Serve authenticated pprof profiling data at /debug/pprof")
+	fs.StringVar(&cfg.PartnerSymbols, "partners", envString("PARTNER_SYMBOLS", ""), "Comma separated OCLC symbols of partner libraries to check for holdings; empty to disable")
+	fs.StringVar(&cfg.ProvidersFile, "providers", envString("PROVIDERS_FILE", "./config/providers.toml"), "Online access providers config file")
+	fs.IntVar(&cfg.CacheWindow, "cachewindow", envInt("CACHE_WINDOW", 0), "Number of search results to cache for paging; 0 to disable (default 0)")
+	fs.IntVar(&cfg.CacheTTL, "cachettl", envInt("CACHE_TTL", 120), "Seconds to keep cached search results (default 120)")
+	fs.IntVar(&cfg.CacheMaxEntries, "cachemax", envInt("CACHE_MAX_ENTRIES", 1000), "Max number of searches in the search cache (default 1000)")
+	fs.IntVar(&cfg.SearchMaxAge, "searchmaxage", envInt("SEARCH_MAX_AGE", 60), "Seconds clients may cache search responses; 0 to disable (default 60)")
+	fs.IntVar(&cfg.ResourceMaxAge, "resourcemaxage", envInt("RESOURCE_MAX_AGE", 3600), "Seconds clients may cache resource responses; 0 to disable (default 3600)")
+	fs.StringVar(&cfg.DefaultSort, "sort", envString("DEFAULT_SORT", "SortRelevance"), "Sort used when a search does not specify one (default SortRelevance)")
+	fs.StringVar(&cfg.DefaultSortOrder, "sortorder", envString("DEFAULT_SORT_ORDER", "desc"), "Order of the default sort; asc or desc (default desc)")
+	fs.BoolVar(&cfg.StrictSort, "strictsort", envBool("STRICT_SORT", false), "Reject searches with an unsupported sort rather than using the default sort")
+	fs.StringVar(&cfg.UserAgent, "useragent", envString("USER_AGENT", fmt.Sprintf("virgo4-pool-worldcat-ws/%s", version)),
+		"User-Agent for requests to WorldCat and OCLC (default virgo4-pool-worldcat-ws/VERSION)")
+	fs.StringVar(&cfg.RecordSchema, "schema", envString("RECORD_SCHEMA", "dc"), "WorldCat record schema; dc or marcxml (default dc)")
+	fs.StringVar(&cfg.IdentifierRelation, "identifierrelation", envString("IDENTIFIER_RELATION", "="),
+		"SRU relation for standard number identifier searches; = or all (default =)")
+	fs.StringVar(&cfg.MinConfidence, "minconfidence", envString("MIN_CONFIDENCE", ""),
+		"Limit search results with a confidence below this; low, medium, high or exact. Empty to disable")
+	fs.IntVar(&cfg.LowConfidenceRows, "lowconfidencerows", envInt("LOW_CONFIDENCE_ROWS", 0),
+		"Max results returned when the confidence is below minconfidence; 0 for none (default 0)")
+	fs.IntVar(&cfg.MinTermLength, "mintermlen", envInt("MIN_TERM_LENGTH", 3), "Min number of characters in a search term (default 3)")
+	fs.StringVar(&cfg.CoverImageURL, "coverurl",
+		envString("COVER_IMAGE_URL", "https://covers.openlibrary.org/b/isbn/{isbn}-M.jpg"), "Cover image URL template; {isbn} is replaced. Empty to disable")
 
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
 
+// validateConfig checks that all required configuration is present and valid
+func validateConfig(cfg *ServiceConfig) error {
 	if cfg.WCAPI == "" {
-		log.Fatal("Parameter -wcapi is required")
+		return errors.New("Parameter -wcapi is required")
 	}
 	if cfg.WCKey == "" {
-		log.Fatal("Parameter -wckey is required")
+		return errors.New("Parameter -wckey is required")
 	}
 	if cfg.JWTKey == "" {
-		log.Fatal("jwtkey param is required")
+		return errors.New("jwtkey param is required")
+	}
+	// OCLC is optional; without it format enrichment and holdings are disabled
+	if (cfg.OCLCKey == "") != (cfg.OCLCSecret == "") {
+		return errors.New("oclckey and oclcsecret params must be set together")
+	}
+	if cfg.OCLCKey != "" && (cfg.OCLCAuthURL == "" || cfg.OCLCMetadataAPI == "") {
+		return errors.New("oclcauth and oclcmetadata params are required with oclckey")
+	}
+	if cfg.OCLCAuthURL != "" && isValidURL(cfg.OCLCAuthURL) == false {
+		return fmt.Errorf("oclcauth param is not a valid URL: %s", cfg.OCLCAuthURL)
+	}
+	if cfg.OCLCMetadataAPI != "" && isValidURL(cfg.OCLCMetadataAPI) == false {
+		return fmt.Errorf("oclcmetadata param is not a valid URL: %s", cfg.OCLCMetadataAPI)
+	}
+	if cfg.OCLCHoldingsAPI != "" && isValidURL(cfg.OCLCHoldingsAPI) == false {
+		return fmt.Errorf("oclcholdings param is not a valid URL: %s", cfg.OCLCHoldingsAPI)
+	}
+	if cfg.DefaultRows < 1 || cfg.DefaultRows > maxSearchRows {
+		return fmt.Errorf("defaultrows param must be between 1 and %d", maxSearchRows)
+	}
+	if cfg.MaxOffset < cfg.DefaultRows {
+		return errors.New("maxoffset param must be at least defaultrows")
+	}
+	if cfg.ILLURL != "" && isValidURL(cfg.ILLURL) == false {
+		return fmt.Errorf("illurl param is not a valid URL: %s", cfg.ILLURL)
+	}
+	if cfg.BatchMax < 1 {
+		return errors.New("batchmax param must be at least 1")
+	}
+	if cfg.MaxBodySize < 1 {
+		return errors.New("maxbody param must be at least 1")
+	}
+	if cfg.CoverImageURL != "" && strings.Contains(cfg.CoverImageURL, "{isbn}") == false {
+		return fmt.Errorf("coverurl param must contain {isbn}: %s", cfg.CoverImageURL)
+	}
+	if cfg.IdentifierRelation != "=" && cfg.IdentifierRelation != "all" {
+		return fmt.Errorf("identifierrelation param must be = or all: %s", cfg.IdentifierRelation)
+	}
+	if cfg.MinConfidence != "" && confidenceRank(cfg.MinConfidence) < 0 {
+		return fmt.Errorf("minconfidence param must be one of %s: %s", strings.Join(confidenceLevels, ", "), cfg.MinConfidence)
+	}
+	if cfg.LowConfidenceRows < 0 {
+		return errors.New("lowconfidencerows param cannot be negative")
+	}
+	if strings.TrimSpace(cfg.UserAgent) == "" {
+		return errors.New("useragent param cannot be empty")
 	}
-	if cfg.OCLCKey == "" {
-		log.Fatal("oclckey param is required")
+	if cfg.AssetsDir == "" {
+		return errors.New("assets param is required")
 	}
-	if cfg.OCLCSecret == "" {
-		log.Fatal("oclcsecret param is required")
+	if cfg.ProvidersFile == "" {
+		return errors.New("providers param is required")
 	}
+	if cfg.CacheWindow < 0 || cfg.CacheWindow > maxSearchRows {
+		return fmt.Errorf("cachewindow param must be between 0 and %d", maxSearchRows)
+	}
+	if cfg.CacheTTL < 1 {
+		return errors.New("cachettl param must be at least 1")
+	}
+	if cfg.CacheMaxEntries < 1 {
+		return errors.New("cachemax param must be at least 1")
+	}
+	if cfg.SearchMaxAge < 0 || cfg.ResourceMaxAge < 0 {
+		return errors.New("searchmaxage and resourcemaxage params cannot be negative")
+	}
+	if isSortOption(cfg.DefaultSort) == false {
+		return fmt.Errorf("sort param is not a supported sort: %s", cfg.DefaultSort)
+	}
+	if cfg.DefaultSortOrder != "asc" && cfg.DefaultSortOrder != "desc" {
+		return fmt.Errorf("sortorder param must be asc or desc: %s", cfg.DefaultSortOrder)
+	}
+	if cfg.RecordSchema != "dc" && cfg.RecordSchema != "marcxml" {
+		return fmt.Errorf("schema param must be dc or marcxml: %s", cfg.RecordSchema)
+	}
+	if cfg.MinTermLength < 0 {
+		return errors.New("mintermlen param cannot be negative")
+	}
+	if cfg.RateLimit < 0 {
+		return errors.New("ratelimit param cannot be negative")
+	}
+	if cfg.MaxIdleConns < 0 || cfg.MaxIdleConnsPerHost < 0 || cfg.IdleConnTimeout < 0 {
+		return errors.New("maxidle, maxidleperhost and idletimeout params cannot be negative")
+	}
+	if cfg.RateBurst < 1 {
+		return errors.New("rateburst param must be at least 1")
+	}
+	return nil
+}
 
-	log.Printf("[CONFIG] port          = [%d]", cfg.Port)
-	log.Printf("[CONFIG] wcapi         = [%s]", cfg.WCAPI)
-	log.Printf("[CONFIG] oclckey       = [%s]", cfg.OCLCKey)
-	log.Printf("[CONFIG] oclcauth      = [%s]", cfg.OCLCAuthURL)
-	log.Printf("[CONFIG] oclcmetadata  = [%s]", cfg.OCLCMetadataAPI)
+// isValidURL returns true if the string is an absolute http or https URL
+func isValidURL(val string) bool {
+	parsed, err := url.ParseRequestURI(val)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// envString returns the value of the named environment variable, or the default if it is not set
+func envString(name string, defaultVal string) string {
+	val, found := os.LookupEnv(name)
+	if !found {
+		return defaultVal
+	}
+	return val
+}
 
-	return &cfg
+// envBool returns the boolean value of the named environment variable, or the default if it is not set.
+// An environment value that is not a boolean is fatal.
+func envBool(name string, defaultVal bool) bool {
+	val, found := os.LookupEnv(name)
+	if !found {
+		return defaultVal
+	}
+	boolVal, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be true or false: %s", name, val)
+	}
+	return boolVal
+}
+
+// envInt returns the integer value of the named environment variable, or the default if it is not set.
+// An environment value that is not an integer is fatal.
+func envInt(name string, defaultVal int) int {
+	val, found := os.LookupEnv(name)
+	if !found {
+		return defaultVal
+	}
+	intVal, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Environment variable %s must be an integer: %s", name, val)
+	}
+	return intVal
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+// validConfig returns a configuration that passes validation
+func validConfig() *ServiceConfig {
+	return &ServiceConfig{WCAPI: "https://worldcat.org/webservices", WCKey: "wckey", JWTKey: "jwtkey",
+		DefaultRows: 20, MaxOffset: 1000, BatchMax: 25, MaxBodySize: 10000, IdentifierRelation: "=",
+		UserAgent: "virgo4-pool-worldcat-ws", AssetsDir: "./assets", ProvidersFile: "./config/providers.toml",
+		CacheWindow: 100, CacheTTL: 300, CacheMaxEntries: 100, DefaultSort: "SortRelevance", DefaultSortOrder: "desc",
+		RecordSchema: "dc", MinTermLength: 3, RateBurst: 1}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *ServiceConfig)
+		err    string
+	}{
+		{name: "valid", modify: func(cfg *ServiceConfig) {}},
+		{name: "valid with oclc", modify: func(cfg *ServiceConfig) {
+			cfg.OCLCKey, cfg.OCLCSecret = "key", "secret"
+			cfg.OCLCAuthURL, cfg.OCLCMetadataAPI = "https://oauth.oclc.org/token", "https://metadata.api.oclc.org/worldcat"
+		}},
+		{name: "missing wcapi", modify: func(cfg *ServiceConfig) { cfg.WCAPI = "" }, err: "Parameter -wcapi is required"},
+		{name: "missing wckey", modify: func(cfg *ServiceConfig) { cfg.WCKey = "" }, err: "Parameter -wckey is required"},
+		{name: "missing jwtkey", modify: func(cfg *ServiceConfig) { cfg.JWTKey = "" }, err: "jwtkey param is required"},
+		{name: "oclc key without secret", modify: func(cfg *ServiceConfig) { cfg.OCLCKey = "key" },
+			err: "oclckey and oclcsecret params must be set together"},
+		{name: "oclc secret without key", modify: func(cfg *ServiceConfig) { cfg.OCLCSecret = "secret" },
+			err: "oclckey and oclcsecret params must be set together"},
+		{name: "oclc without auth url", modify: func(cfg *ServiceConfig) {
+			cfg.OCLCKey, cfg.OCLCSecret, cfg.OCLCMetadataAPI = "key", "secret", "https://metadata.api.oclc.org/worldcat"
+		}, err: "oclcauth and oclcmetadata params are required with oclckey"},
+		{name: "oclc without metadata url", modify: func(cfg *ServiceConfig) {
+			cfg.OCLCKey, cfg.OCLCSecret, cfg.OCLCAuthURL = "key", "secret", "https://oauth.oclc.org/token"
+		}, err: "oclcauth and oclcmetadata params are required with oclckey"},
+		{name: "invalid oclcauth", modify: func(cfg *ServiceConfig) { cfg.OCLCAuthURL = "oauth.oclc.org" },
+			err: "oclcauth param is not a valid URL: oauth.oclc.org"},
+		{name: "invalid oclcmetadata", modify: func(cfg *ServiceConfig) { cfg.OCLCMetadataAPI = "ftp://oclc.org" },
+			err: "oclcmetadata param is not a valid URL: ftp://oclc.org"},
+		{name: "invalid oclcholdings", modify: func(cfg *ServiceConfig) { cfg.OCLCHoldingsAPI = "holdings" },
+			err: "oclcholdings param is not a valid URL: holdings"},
+		{name: "zero defaultrows", modify: func(cfg *ServiceConfig) { cfg.DefaultRows = 0 },
+			err: "defaultrows param must be between 1 and 100"},
+		{name: "too many defaultrows", modify: func(cfg *ServiceConfig) { cfg.DefaultRows = 101 },
+			err: "defaultrows param must be between 1 and 100"},
+		{name: "maxoffset below defaultrows", modify: func(cfg *ServiceConfig) { cfg.MaxOffset = 10 },
+			err: "maxoffset param must be at least defaultrows"},
+		{name: "invalid illurl", modify: func(cfg *ServiceConfig) { cfg.ILLURL = "/ill" },
+			err: "illurl param is not a valid URL: /ill"},
+		{name: "zero batchmax", modify: func(cfg *ServiceConfig) { cfg.BatchMax = 0 }, err: "batchmax param must be at least 1"},
+		{name: "zero maxbody", modify: func(cfg *ServiceConfig) { cfg.MaxBodySize = 0 }, err: "maxbody param must be at least 1"},
+		{name: "coverurl without isbn", modify: func(cfg *ServiceConfig) { cfg.CoverImageURL = "https://covers.org/cover.jpg" },
+			err: "coverurl param must contain {isbn}: https://covers.org/cover.jpg"},
+		{name: "invalid identifierrelation", modify: func(cfg *ServiceConfig) { cfg.IdentifierRelation = "exact" },
+			err: "identifierrelation param must be = or all: exact"},
+		{name: "invalid minconfidence", modify: func(cfg *ServiceConfig) { cfg.MinConfidence = "certain" },
+			err: "minconfidence param must be one of low, medium, high, exact: certain"},
+		{name: "negative lowconfidencerows", modify: func(cfg *ServiceConfig) { cfg.LowConfidenceRows = -1 },
+			err: "lowconfidencerows param cannot be negative"},
+		{name: "blank useragent", modify: func(cfg *ServiceConfig) { cfg.UserAgent = " " }, err: "useragent param cannot be empty"},
+		{name: "missing assets", modify: func(cfg *ServiceConfig) { cfg.AssetsDir = "" }, err: "assets param is required"},
+		{name: "missing providers", modify: func(cfg *ServiceConfig) { cfg.ProvidersFile = "" }, err: "providers param is required"},
+		{name: "cachewindow too large", modify: func(cfg *ServiceConfig) { cfg.CacheWindow = 101 },
+			err: "cachewindow param must be between 0 and 100"},
+		{name: "zero cachettl", modify: func(cfg *ServiceConfig) { cfg.CacheTTL = 0 }, err: "cachettl param must be at least 1"},
+		{name: "zero cachemax", modify: func(cfg *ServiceConfig) { cfg.CacheMaxEntries = 0 }, err: "cachemax param must be at least 1"},
+		{name: "negative maxage", modify: func(cfg *ServiceConfig) { cfg.SearchMaxAge = -1 },
+			err: "searchmaxage and resourcemaxage params cannot be negative"},
+		{name: "invalid sort", modify: func(cfg *ServiceConfig) { cfg.DefaultSort = "SortPopularity" },
+			err: "sort param is not a supported sort: SortPopularity"},
+		{name: "invalid sortorder", modify: func(cfg *ServiceConfig) { cfg.DefaultSortOrder = "up" },
+			err: "sortorder param must be asc or desc: up"},
+		{name: "invalid schema", modify: func(cfg *ServiceConfig) { cfg.RecordSchema = "mods" },
+			err: "schema param must be dc or marcxml: mods"},
+		{name: "negative mintermlen", modify: func(cfg *ServiceConfig) { cfg.MinTermLength = -1 },
+			err: "mintermlen param cannot be negative"},
+		{name: "negative ratelimit", modify: func(cfg *ServiceConfig) { cfg.RateLimit = -1 },
+			err: "ratelimit param cannot be negative"},
+		{name: "negative idletimeout", modify: func(cfg *ServiceConfig) { cfg.IdleConnTimeout = -1 },
+			err: "maxidle, maxidleperhost and idletimeout params cannot be negative"},
+		{name: "zero rateburst", modify: func(cfg *ServiceConfig) { cfg.RateBurst = 0 }, err: "rateburst param must be at least 1"},
+		{name: "first problem reported", modify: func(cfg *ServiceConfig) { cfg.WCKey, cfg.RateBurst = "", 0 },
+			err: "Parameter -wckey is required"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.modify(cfg)
+			err := validateConfig(cfg)
+			if tc.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	t.Setenv("WC_API", "https://env.worldcat.org/webservices")
+	t.Setenv("WC_API_KEY", "envkey")
+	t.Setenv("DEFAULT_ROWS", "50")
+	t.Setenv("GROUP_RESULTS", "true")
+
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-wckey", "flagkey"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if cfg.WCAPI != "https://env.worldcat.org/webservices" {
+		t.Errorf("expected wcapi from the environment, got %q", cfg.WCAPI)
+	}
+	if cfg.WCKey != "flagkey" {
+		t.Errorf("expected the wckey flag to override the environment, got %q", cfg.WCKey)
+	}
+	if cfg.DefaultRows != 50 || !cfg.GroupResults {
+		t.Errorf("expected defaultrows 50 and groupresults from the environment, got %d %t", cfg.DefaultRows, cfg.GroupResults)
+	}
+	if cfg.Port != 8080 || cfg.MinTermLength != 3 || cfg.RecordSchema != "dc" {
+		t.Errorf("expected defaults, got port %d mintermlen %d schema %q", cfg.Port, cfg.MinTermLength, cfg.RecordSchema)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := parseConfig(fs, []string{"-defaultrows", "many"}); err == nil {
+		t.Errorf("expected an error for an invalid flag value")
+	}
+}
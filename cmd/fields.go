@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// queryField is a V4 query field supported by this pool and the SRU index it is searched with
+type queryField struct {
+	Name        string `json:"name"`
+	Index       string `json:"sru_index,omitempty"`
+	Relation    string `json:"relation,omitempty"`
+	Exact       bool   `json:"exact"`
+	Description string `json:"description"`
+	// mapped fields are converted by replacing the field name with the index and relation.
+	// Others have their own conversion.
+	mapped bool
+	// custom fields are not part of the V4 query grammar
+	custom bool
+}
+
+// queryFields are all of the V4 query fields supported by this pool
+var queryFields = []queryField{
+	{Name: "keyword", Index: "srw.kw", Relation: "all", mapped: true,
+		Description: "All of the words anywhere in the record"},
+	{Name: "title", Index: "srw.ti", Relation: "all", mapped: true,
+		Description: "All of the words in the title"},
+	{Name: "author", Index: "srw.au", Relation: "all", mapped: true,
+		Description: "All of the words in the author name"},
+	{Name: "subject", Index: "srw.su", Relation: "all", mapped: true,
+		Description: "All of the words in a subject heading"},
+	{Name: "series", Index: "srw.se", Relation: "all", mapped: true, custom: true,
+		Description: "All of the words in the series title"},
+	{Name: "publisher_location", Index: "srw.pl", Relation: "all", mapped: true, custom: true,
+		Description: "All of the words in the place of publication"},
+	{Name: "identifier", Index: "srw.bn, srw.no, srw.sn", Relation: "=, all", Exact: true,
+		Description: "An ISBN or other number, a prefixed OCLC number, or any other standard number searched with the configured relation"},
+	{Name: "doi", Index: "srw.sn", Relation: "=", Exact: true, custom: true,
+		Description: "A DOI, bare or as a doi.org URL. WorldCat has no DOI index so it is searched as a standard number"},
+	{Name: "subject_exact", Index: "srw.su", Relation: "=", Exact: true, custom: true,
+		Description: "A whole subject heading"},
+	{Name: "language", Index: "srw.la", Relation: "=", Exact: true, custom: true,
+		Description: "A language name, ISO 639 code or MARC language code"},
+	{Name: "callnumber", Index: "srw.lc, srw.dd", Relation: "=", Exact: true, custom: true,
+		Description: "An LC or Dewey call number"},
+	{Name: "date", Index: "srw.yr", Relation: "=, <, >, >=, <=", Exact: true,
+		Description: "A year, AFTER year, BEFORE year or year TO year"},
+	{Name: "online", Exact: true, custom: true,
+		Description: "true to only return items with online access. The same as fulltext"},
+	{Name: "fulltext", Exact: true,
+		Description: "true to only return items with online access. The same as online"},
+}
+
+// validationQuery returns a copy of a V4 query that can be checked by the V4 query parser.
+// Custom field and date clauses are changed to keyword clauses so only the query structure
+// is checked; their values are checked when they are converted. The parser only accepts
+// exact dates, which would reject approximate years like c1987.
+func validationQuery(v4Query string) string {
+	return fieldClauseRegex.ReplaceAllStringFunc(v4Query, func(clause string) string {
+		match := fieldClauseRegex.FindStringSubmatch(clause)
+		if isCustomField(match[1]) || match[1] == "date" {
+			return fmt.Sprintf("keyword: {%s}", match[2])
+		}
+		return clause
+	})
+}
+
+// isCustomField returns true if the V4 query field is supported by this pool but is not
+// part of the V4 query grammar
+func isCustomField(name string) bool {
+	for _, field := range queryFields {
+		if field.Name == name {
+			return field.custom
+		}
+	}
+	return false
+}
+
+// isExactField returns true if the V4 query field matches whole values, like an identifier,
+// rather than words
+func isExactField(name string) bool {
+	for _, field := range queryFields {
+		if field.Name == name {
+			return field.Exact
+		}
+	}
+	return false
+}
+
+// convertMappedFields replaces the names of all mapped fields in the query with their
+// SRU index and relation
+func convertMappedFields(query string) string {
+	for _, field := range queryFields {
+		if field.mapped {
+			query = strings.ReplaceAll(query, field.Name+":", fmt.Sprintf("%s %s", field.Index, field.Relation))
+		}
+	}
+	return query
+}
+
+// fieldsHandler returns the query fields supported by this pool
+func (svc *ServiceContext) fieldsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"fields": queryFields})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// holding is a single library that holds a WorldCat resource
+type holding struct {
+	Institution string `json:"institution"`
+	Symbol      string `json:"symbol"`
+	Location    string `json:"location,omitempty"`
+}
+
+// oclcHoldingsResponse is the part of the OCLC bibs-holdings response used by this pool
+type oclcHoldingsResponse struct {
+	NumberOfRecords int `json:"numberOfRecords"`
+	BriefRecords    []struct {
+		InstitutionHolding struct {
+			BriefHoldings []struct {
+				OCLCSymbol      string `json:"oclcSymbol"`
+				InstitutionName string `json:"institutionName"`
+				State           string `json:"state"`
+				Country         string `json:"country"`
+			} `json:"briefHoldings"`
+		} `json:"institutionHolding"`
+	} `json:"briefRecords"`
+}
+
+// getHoldings returns the libraries that hold a WorldCat resource. An item with no
+// holdings returns an empty list.
+func (svc *ServiceContext) getHoldings(c *gin.Context) {
+	id, valid := getOCLCNumber(c)
+	if valid == false {
+		return
+	}
+	log.Printf("Resource %s holdings requested", id)
+	if svc.OCLC.configured() == false || svc.OCLC.HoldingsAPI == "" {
+		respondError(c, http.StatusNotImplemented, "holdings are not available")
+		return
+	}
+
+	if err := svc.refreshOCLCAuth(); err != nil {
+		log.Printf("ERROR: unable to refresh OCLC auth for %s holdings: %s", id, err.Error())
+		respondError(c, http.StatusServiceUnavailable, "holdings are not available")
+		return
+	}
+
+	qURL := fmt.Sprintf("%s?oclcNumber=%s", svc.OCLC.HoldingsAPI, id)
+	rawResp, respErr := svc.apiGet(qURL, svc.OCLC.getToken())
+	if respErr != nil {
+		if respErr.StatusCode == http.StatusUnauthorized {
+			svc.OCLC.invalidate()
+		}
+		respondRequestError(c, respErr)
+		return
+	}
+
+	holdings, err := parseHoldings(rawResp)
+	if err != nil {
+		log.Printf("ERROR: unable to parse holdings for %s: %s", id, err.Error())
+		respondError(c, http.StatusBadGateway, unexpectedContentMsg)
+		return
+	}
+	log.Printf("INFO: %s is held by %d libraries", id, len(holdings))
+	c.JSON(http.StatusOK, holdings)
+}
+
+// parseHoldings converts an OCLC bibs-holdings response into a list of holdings
+func parseHoldings(rawResp []byte) ([]holding, error) {
+	var holdingsResp oclcHoldingsResponse
+	if err := json.Unmarshal(rawResp, &holdingsResp); err != nil {
+		return nil, err
+	}
+	holdings := make([]holding, 0)
+	for _, rec := range holdingsResp.BriefRecords {
+		for _, h := range rec.InstitutionHolding.BriefHoldings {
+			// state is of the form US-VA; show just the state when the country is included
+			location := strings.TrimPrefix(h.State, h.Country+"-")
+			if h.Country != "" {
+				location = strings.Trim(fmt.Sprintf("%s, %s", location, h.Country), ", ")
+			}
+			holdings = append(holdings, holding{Institution: h.InstitutionName, Symbol: h.OCLCSymbol, Location: location})
+		}
+	}
+	return holdings, nil
+}
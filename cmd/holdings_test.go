@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetHoldings(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected []holding
+	}{
+		{name: "holdings", response: `{"numberOfRecords":1,"briefRecords":[{"institutionHolding":{"briefHoldings":[
+			{"oclcSymbol":"VPI","institutionName":"Virginia Tech","state":"US-VA","country":"US"},
+			{"oclcSymbol":"XYZ","institutionName":"Example Library","country":"CA"}]}}]}`,
+			expected: []holding{{Institution: "Virginia Tech", Symbol: "VPI", Location: "VA, US"},
+				{Institution: "Example Library", Symbol: "XYZ", Location: "CA"}}},
+		{name: "no holdings", response: `{"numberOfRecords":0}`, expected: []holding{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			var oclcNumber, auth string
+			mock.onHoldings = func(w http.ResponseWriter, r *http.Request) {
+				oclcNumber, auth = r.URL.Query().Get("oclcNumber"), r.Header.Get("Authorization")
+				fmt.Fprint(w, tc.response)
+			}
+			svc := newTestService(t, oclcTestConfig(mock), 5*time.Second)
+
+			resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/api/resource/ocm1001/holdings", nil, map[string]string{"X-Api-Key": "apikey"})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			var holdings []holding
+			if err := json.Unmarshal(resp.Body.Bytes(), &holdings); err != nil {
+				t.Fatalf("unable to parse holdings %s: %s", resp.Body.String(), err.Error())
+			}
+			if reflect.DeepEqual(holdings, tc.expected) == false {
+				t.Errorf("expected holdings %+v, got %+v", tc.expected, holdings)
+			}
+			if oclcNumber != "1001" || auth != "Bearer tok" {
+				t.Errorf("expected a request for 1001 with the OCLC token, got %s with %q", oclcNumber, auth)
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/api/resource/1001/holdings", nil, map[string]string{"X-Api-Key": "apikey"})
+	if resp.Code != http.StatusNotImplemented {
+		t.Errorf("expected status 501 without OCLC, got %d", resp.Code)
+	}
+}
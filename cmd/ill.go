@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// illRequest is the payload forwarded to the ILL service
+type illRequest struct {
+	OCLCNumber  string `json:"oclc_number"`
+	UserID      string `json:"user_id"`
+	HomeLibrary string `json:"home_library,omitempty"`
+}
+
+// illResponse is the response from the ILL service for a created request
+type illResponse struct {
+	RequestID string `json:"request_id"`
+}
+
+// requestILL submits an interlibrary loan request for a WorldCat resource on behalf of the
+// authenticated user. Only UVA users with an account can make ILL requests.
+func (svc *ServiceContext) requestILL(c *gin.Context) {
+	if svc.ILLURL == "" {
+		respondError(c, http.StatusNotImplemented, "ILL requests are not available")
+		return
+	}
+	id, valid := getOCLCNumber(c)
+	if valid == false {
+		return
+	}
+	log.Printf("ILL request for %s", id)
+
+	claims := getClaims(c)
+	if claims == nil || claims.UserID == "" || claims.IsUVA == false {
+		log.Printf("WARNING: ILL request for %s by a user without an eligible account", id)
+		respondError(c, http.StatusForbidden, "an eligible UVA account is required for ILL requests")
+		return
+	}
+
+	payload, _ := json.Marshal(illRequest{OCLCNumber: id, UserID: claims.UserID, HomeLibrary: claims.HomeLibrary})
+	req, _ := http.NewRequest("POST", svc.ILLURL, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", svc.UserAgent)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.GetString("jwt")))
+
+	startTime := time.Now()
+	resp, err := svc.HTTPClient.Do(req)
+	if err != nil {
+		log.Printf("ERROR: ILL request for %s failed: %s", id, err.Error())
+		respondError(c, http.StatusBadGateway, "unable to reach the ILL service")
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	log.Printf("INFO: ILL service responded %d for %s. Elapsed Time: %d (ms)", resp.StatusCode, id,
+		int64(time.Since(startTime)/time.Millisecond))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		// the upstream body is logged but not returned; it may contain internal details
+		log.Printf("ERROR: ILL request for %s was rejected with status %d: %s", id, resp.StatusCode, body)
+		respondError(c, http.StatusBadGateway, "the ILL service was unable to create the request")
+		return
+	}
+
+	var illResp illResponse
+	if err := json.Unmarshal(body, &illResp); err != nil || illResp.RequestID == "" {
+		log.Printf("ERROR: invalid ILL service response for %s: %s", id, body)
+		respondError(c, http.StatusBadGateway, unexpectedContentMsg)
+		return
+	}
+	log.Printf("INFO: ILL request %s created for %s", illResp.RequestID, id)
+	c.JSON(http.StatusCreated, illResp)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestRequestILL(t *testing.T) {
+	var forwarded illRequest
+	var auth string
+	ill := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &forwarded)
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"request_id":"ILL-42"}`)
+	}))
+	defer ill.Close()
+
+	mock := newMockWorldCat(t)
+	cfg := testConfig(mock)
+	cfg.ILLURL = ill.URL
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	token, err := v4jwt.Mint(v4jwt.V4Claims{UserID: "tuser", IsUVA: true, HomeLibrary: "ALDERMAN", Role: v4jwt.User},
+		time.Hour, svc.JWTKey)
+	if err != nil {
+		t.Fatalf("unable to mint token: %s", err.Error())
+	}
+	resp := doRequest(router, http.MethodPost, "/api/resource/ocm1001/ill", nil, bearer(token))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var created illResponse
+	json.Unmarshal(resp.Body.Bytes(), &created)
+	if created.RequestID != "ILL-42" {
+		t.Errorf("expected request id ILL-42, got %s", resp.Body.String())
+	}
+	expected := illRequest{OCLCNumber: "1001", UserID: "tuser", HomeLibrary: "ALDERMAN"}
+	if forwarded != expected || auth != "Bearer "+token {
+		t.Errorf("expected %+v to be forwarded with the user token, got %+v with %q", expected, forwarded, auth)
+	}
+
+	// a user without a UVA account is not eligible and nothing is forwarded
+	forwarded = illRequest{}
+	resp = doRequest(router, http.MethodPost, "/api/resource/1001/ill", nil, bearer(mintToken(t, svc, v4jwt.User, time.Hour)))
+	if resp.Code != http.StatusForbidden || forwarded.OCLCNumber != "" {
+		t.Errorf("expected status 403 without forwarding, got %d", resp.Code)
+	}
+
+	resp = doRequest(router, http.MethodPost, "/api/resource/bad-id/ill", nil, bearer(token))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid id, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "strings"
+
+// languageNames maps common ISO 639-2 (MARC) language codes to display names
+var languageNames = map[string]string{
+	"ara": "Arabic",
+	"chi": "Chinese",
+	"cze": "Czech",
+	"dan": "Danish",
+	"dut": "Dutch",
+	"eng": "English",
+	"fin": "Finnish",
+	"fre": "French",
+	"ger": "German",
+	"grc": "Greek, Ancient",
+	"gre": "Greek, Modern",
+	"heb": "Hebrew",
+	"hin": "Hindi",
+	"hun": "Hungarian",
+	"ita": "Italian",
+	"jpn": "Japanese",
+	"kor": "Korean",
+	"lat": "Latin",
+	"mul": "Multiple languages",
+	"nor": "Norwegian",
+	"per": "Persian",
+	"pol": "Polish",
+	"por": "Portuguese",
+	"rus": "Russian",
+	"spa": "Spanish",
+	"swe": "Swedish",
+	"tur": "Turkish",
+	"ukr": "Ukrainian",
+	"und": "Undetermined",
+	"urd": "Urdu",
+	"vie": "Vietnamese",
+	"yid": "Yiddish",
+}
+
+// getLanguageName returns the display name for a language code. Unknown codes are returned as-is.
+func getLanguageName(code string) string {
+	if name, found := languageNames[strings.ToLower(strings.TrimSpace(code))]; found {
+		return name
+	}
+	return code
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
 )
 
 // Version of the service
@@ -21,7 +22,10 @@ func main() {
 
 	// Get config params and use them to init service context. Any issues are fatal
 	cfg := LoadConfiguration()
-	svc := InitializeService(version, cfg)
+	svc, err := InitializeService(version, cfg, nil)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err.Error())
+	}
 
 	log.Printf("Setup routes...")
 	gin.SetMode(gin.ReleaseMode)
@@ -31,25 +35,44 @@ func main() {
 	corsCfg := cors.DefaultConfig()
 	corsCfg.AllowAllOrigins = true
 	corsCfg.AllowCredentials = true
-	corsCfg.AddAllowHeaders("Authorization")
+	corsCfg.AddAllowHeaders("Authorization", "X-Api-Key")
 	router.Use(cors.New(corsCfg))
+	router.Use(requestIDMiddleware)
+	svc.addRoutes(router, cfg.Pprof)
+	router.Use(static.Serve("/assets", static.LocalFile(cfg.AssetsDir, true)))
+
+	portStr := fmt.Sprintf(":%d", cfg.Port)
+	log.Printf("Start service v%s on port %s", version, portStr)
+	log.Fatal(router.Run(portStr))
+}
 
+// addRoutes adds all of the service endpoints to the router. The pprof endpoints are only
+// added when enabled.
+func (svc *ServiceContext) addRoutes(router *gin.Engine, pprof bool) {
 	router.GET("/", svc.getVersion)
 	router.GET("/favicon.ico", svc.ignoreFavicon)
 	router.GET("/version", svc.getVersion)
+	router.GET("/healthz", svc.liveness)
 	router.GET("/healthcheck", svc.healthCheck)
+	router.GET("/stats", svc.statsHandler)
 	router.GET("/identify", svc.identifyHandler)
+	if pprof {
+		svc.addPprofRoutes(router)
+	}
 	api := router.Group("/api")
 	{
 		api.GET("/providers", svc.providersHandler)
+		api.GET("/fields", svc.fieldsHandler)
+		api.GET("/openapi.json", svc.openAPIHandler)
 		api.POST("/search", svc.authMiddleware, svc.search)
 		api.POST("/search/facets", svc.authMiddleware, svc.facets)
+		api.POST("/search/preview", svc.authMiddleware, svc.searchPreview)
+		api.POST("/resource", svc.authMiddleware, svc.requireRole(v4jwt.User), svc.batchResource)
 		api.GET("/resource/:id", svc.authMiddleware, svc.getResource)
+		api.GET("/resource/:id/marcxml", svc.authMiddleware, svc.getMARCXML)
+		api.GET("/resource/:id/holdings", svc.authMiddleware, svc.getHoldings)
+		api.POST("/resource/:id/ill", svc.authMiddleware, svc.requestILL)
+		api.POST("/cache/flush", svc.apiKeyMiddleware, svc.flushCacheHandler)
+		api.GET("/cache/stats", svc.apiKeyMiddleware, svc.cacheStatsHandler)
 	}
-
-	router.Use(static.Serve("/assets", static.LocalFile("./assets", true)))
-
-	portStr := fmt.Sprintf(":%d", cfg.Port)
-	log.Printf("Start service v%s on port %s", version, portStr)
-	log.Fatal(router.Run(portStr))
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+)
+
+// marcRecord is a MARCXML record. Only the parts needed to fill in a wcRecord are parsed.
+type marcRecord struct {
+	ControlFields []struct {
+		Tag   string `xml:"tag,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"controlfield"`
+	DataFields []marcDataField `xml:"datafield"`
+}
+
+type marcDataField struct {
+	Tag       string `xml:"tag,attr"`
+	Subfields []struct {
+		Code  string `xml:"code,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"subfield"`
+}
+
+// subfields returns the values of the specified subfield codes joined with a space
+func (df *marcDataField) subfields(codes string) string {
+	vals := make([]string, 0)
+	for _, sf := range df.Subfields {
+		if strings.Contains(codes, sf.Code) {
+			vals = append(vals, strings.TrimSpace(sf.Value))
+		}
+	}
+	return strings.Join(vals, " ")
+}
+
+// values returns the specified subfields of all data fields with one of the tags. Trailing
+// ISBD punctuation is removed.
+func (m *marcRecord) values(tags []string, codes string) []string {
+	out := make([]string, 0)
+	for _, df := range m.DataFields {
+		for _, tag := range tags {
+			if df.Tag != tag {
+				continue
+			}
+			if val := strings.TrimRight(df.subfields(codes), " /:;,."); val != "" {
+				out = append(out, val)
+			}
+		}
+	}
+	return out
+}
+
+// toWCRecord maps a MARCXML record into the Dublin Core based record used for V4 fields
+func (m *marcRecord) toWCRecord() wcRecord {
+	wcRec := wcRecord{}
+	for _, cf := range m.ControlFields {
+		switch cf.Tag {
+		case "001":
+			wcRec.ID = strings.TrimSpace(cf.Value)
+		case "008":
+			// 008/35-37 is the language code
+			if len(cf.Value) >= 38 {
+				wcRec.Language = strings.TrimSpace(cf.Value[35:38])
+			}
+		}
+	}
+	wcRec.Title = m.values([]string{"245"}, "abnp")
+	wcRec.Creator = m.values([]string{"100", "110", "111"}, "abcdq")
+	wcRec.Contributor = m.values([]string{"700", "710", "711"}, "abcdq")
+	wcRec.Subjects = m.values([]string{"600", "610", "650", "651"}, "abcdvxyz")
+	wcRec.Description = m.values([]string{"520"}, "a")
+	wcRec.Publishers = m.values([]string{"260", "264"}, "b")
+	wcRec.Places = m.values([]string{"260", "264"}, "a")
+	wcRec.Series = m.values([]string{"490", "830"}, "av")
+	wcRec.Formats = m.values([]string{"300"}, "a")
+	// Dublin Core identifiers include both ISBNs and access URLs
+	wcRec.ISBN = m.values([]string{"020"}, "a")
+	wcRec.ISBN = append(wcRec.ISBN, m.values([]string{"856"}, "u")...)
+	if dates := m.values([]string{"260", "264"}, "c"); len(dates) > 0 {
+		wcRec.Date = dates[0]
+	}
+	return wcRec
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uvalib/virgo4-api/v4api"
+)
+
+// openAPISpec is the OpenAPI 3 description of the service. It is built once from the
+// request and response types.
+var openAPISpec map[string]interface{}
+var openAPIOnce sync.Once
+
+// openAPIHandler returns the OpenAPI 3 description of the service as JSON
+func (svc *ServiceContext) openAPIHandler(c *gin.Context) {
+	openAPIOnce.Do(func() {
+		openAPISpec = buildOpenAPISpec(svc.Version)
+	})
+	c.JSON(http.StatusOK, openAPISpec)
+}
+
+// buildOpenAPISpec builds the OpenAPI 3 description of the main service routes. Request and
+// response schemas are generated from the Go types so they stay in sync with the code.
+func buildOpenAPISpec(version string) map[string]interface{} {
+	var resourceResp struct {
+		Fields []v4api.RecordField `json:"fields"`
+	}
+	var facetsResp struct {
+		Facets []v4api.Facet `json:"facets"`
+	}
+	var errorResp struct {
+		Status    int          `json:"status"`
+		Message   string       `json:"message"`
+		Errors    []fieldError `json:"errors,omitempty"`
+		RequestID string       `json:"request_id"`
+	}
+	errorSchema := openAPISchema(reflect.TypeOf(errorResp))
+	idParam := map[string]interface{}{"name": "id", "in": "path", "required": true,
+		"description": "OCLC number", "schema": map[string]interface{}{"type": "string"}}
+	bearer := []map[string]interface{}{{"bearerAuth": []string{}}}
+
+	paths := map[string]interface{}{
+		"/identify": map[string]interface{}{
+			"get": openAPIOperation("Describe the pool", nil, &v4api.PoolIdentity{}, errorSchema),
+		},
+		"/api/providers": map[string]interface{}{
+			"get": openAPIOperation("List online access providers", nil, &poolProviders{}, errorSchema),
+		},
+		"/api/fields": map[string]interface{}{
+			"get": openAPIOperation("List supported query fields", nil, &struct {
+				Fields []queryField `json:"fields"`
+			}{}, errorSchema),
+		},
+		"/api/search": map[string]interface{}{
+			"post": withSecurity(openAPIOperation("Search WorldCat", &v4api.SearchRequest{}, &pagedPoolResult{}, errorSchema), bearer),
+		},
+		"/api/search/facets": map[string]interface{}{
+			"post": withSecurity(openAPIOperation("Get search facets; WorldCat has none", &v4api.SearchRequest{}, &facetsResp, errorSchema), bearer),
+		},
+		"/api/resource/{id}": map[string]interface{}{
+			"get": withSecurity(withParams(openAPIOperation("Get a WorldCat resource", nil, &resourceResp, errorSchema),
+				idParam), bearer),
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Virgo4 WorldCat pool",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+// openAPIOperation describes an operation with an optional JSON request body and a JSON response
+func openAPIOperation(summary string, request interface{}, response interface{}, errorSchema map[string]interface{}) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary": summary,
+		"responses": map[string]interface{}{
+			"200":     openAPIContent("Success", openAPISchema(reflect.TypeOf(response))),
+			"default": openAPIContent("Error", errorSchema),
+		},
+	}
+	if request != nil {
+		body := openAPIContent("Request", openAPISchema(reflect.TypeOf(request)))
+		body["required"] = true
+		op["requestBody"] = body
+	}
+	return op
+}
+
+func withSecurity(op map[string]interface{}, security []map[string]interface{}) map[string]interface{} {
+	op["security"] = security
+	return op
+}
+
+func withParams(op map[string]interface{}, params ...map[string]interface{}) map[string]interface{} {
+	op["parameters"] = params
+	return op
+}
+
+// openAPIContent is a request body or response with JSON content of the schema
+func openAPIContent(description string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+// openAPISchema generates the JSON schema of a Go type from its JSON encoding
+func openAPISchema(t reflect.Type) map[string]interface{} {
+	return schemaForType(t, make(map[reflect.Type]bool))
+}
+
+func schemaForType(t reflect.Type, visiting map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem(), visiting)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem(), visiting)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		if visiting[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		props := make(map[string]interface{})
+		addStructProperties(t, props, visiting)
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return map[string]interface{}{}
+}
+
+// addStructProperties adds the JSON properties of a struct to props. The properties of
+// embedded structs are included as they are by encoding/json.
+func addStructProperties(t reflect.Type, props map[string]interface{}, visiting map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			for embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				addStructProperties(embedded, props, visiting)
+				continue
+			}
+		}
+		if field.IsExported() == false {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = schemaForType(field.Type, visiting)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// getPartnerHoldings returns the partner library symbols that hold each of the WorldCat
+// records, by record ID. One search is done for each partner. A failed search is logged and
+// that partner is left out.
+func (svc *ServiceContext) getPartnerHoldings(ids []string) map[string][]string {
+	holdings := make(map[string][]string)
+	if len(svc.PartnerSymbols) == 0 || len(ids) == 0 {
+		return holdings
+	}
+
+	idClauses := make([]string, 0, len(ids))
+	for _, id := range ids {
+		idClauses = append(idClauses, fmt.Sprintf("srw.no = %s", id))
+	}
+	idQuery := strings.Join(idClauses, " OR ")
+
+	var holdingsMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, symbol := range svc.PartnerSymbols {
+		wg.Add(1)
+		go func(symbol string) {
+			defer wg.Done()
+			query := fmt.Sprintf("(%s) AND srw.li = %s", idQuery, symbol)
+			qURL := fmt.Sprintf("%s/search/worldcat/sru?recordSchema=dc&query=%s&maximumRecords=%d&wskey=%s",
+				svc.WCAPI, url.QueryEscape(query), len(ids), svc.WCKey)
+			rawResp, respErr := svc.apiGet(qURL, "")
+			if respErr != nil {
+				log.Printf("ERROR: unable to check partner %s holdings: %s", symbol, respErr.Message)
+				return
+			}
+			wcResp, err := parseSearchResponse(rawResp)
+			if err != nil {
+				log.Printf("ERROR: unable to parse partner %s holdings: %s", symbol, err.Error())
+				return
+			}
+			holdingsMutex.Lock()
+			defer holdingsMutex.Unlock()
+			for _, rec := range wcResp.Records {
+				holdings[rec.ID] = append(holdings[rec.ID], symbol)
+			}
+		}(symbol)
+	}
+	wg.Wait()
+
+	// keep the symbols in the configured order no matter which search finished first
+	for id, symbols := range holdings {
+		ordered := make([]string, 0, len(symbols))
+		for _, symbol := range svc.PartnerSymbols {
+			for _, held := range symbols {
+				if held == symbol {
+					ordered = append(ordered, symbol)
+				}
+			}
+		}
+		holdings[id] = ordered
+	}
+	return holdings
+}
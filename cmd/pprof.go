@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http/pprof"
+
+	"github.com/gin-gonic/gin"
+)
+
+// addPprofRoutes adds the net/http/pprof profiling handlers under /debug/pprof. They expose
+// service internals, so all of them require the API key rather than a user JWT. The cmdline
+// handler is left out because it would return secrets passed as flags.
+func (svc *ServiceContext) addPprofRoutes(router *gin.Engine) {
+	log.Printf("WARNING: pprof profiling is enabled at /debug/pprof")
+	pprofRoutes := router.Group("/debug/pprof", svc.apiKeyMiddleware)
+	pprofRoutes.GET("/", gin.WrapF(pprof.Index))
+	pprofRoutes.GET("/profile", gin.WrapF(pprof.Profile))
+	pprofRoutes.GET("/symbol", gin.WrapF(pprof.Symbol))
+	pprofRoutes.POST("/symbol", gin.WrapF(pprof.Symbol))
+	pprofRoutes.GET("/trace", gin.WrapF(pprof.Trace))
+	// the named profiles like heap and goroutine are served by the index handler. It only
+	// serves runtime profiles, so cmdline is a 404
+	pprofRoutes.GET("/:profile", gin.WrapF(pprof.Index))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultProvider is used for access URLs that do not match any configured provider
+const defaultProvider = "worldcat"
+
+type providerDetails struct {
+	Provider    string   `json:"provider" toml:"provider"`
+	Label       string   `json:"label,omitempty" toml:"label"`
+	HomepageURL string   `json:"homepage_url,omitempty" toml:"homepage_url"`
+	LogoURL     string   `json:"logo_url,omitempty" toml:"logo_url"`
+	Match       []string `json:"-" toml:"match"`
+	Disabled    bool     `json:"-" toml:"disabled"`
+}
+
+// providerRule attributes access URLs containing Match to a provider. URLs that match a
+// disabled provider are not attributed to any provider.
+type providerRule struct {
+	Match    string
+	Provider string
+	Label    string
+	Disabled bool
+}
+
+type poolProviders struct {
+	Providers   []providerDetails `json:"providers" toml:"provider"`
+	BlockedURLs []string          `json:"-" toml:"blocked_urls"`
+}
+
+// loadProviders reads the online access providers and blocked access URL patterns from a TOML config file
+func loadProviders(filename string) (*poolProviders, error) {
+	log.Printf("Load providers from %s", filename)
+	var p poolProviders
+	if _, err := toml.DecodeFile(filename, &p); err != nil {
+		return nil, err
+	}
+	for _, prov := range p.Providers {
+		if prov.Provider == "" {
+			return nil, fmt.Errorf("%s contains a provider with no name", filename)
+		}
+		log.Printf("Provider %s matches %v; disabled %t", prov.Provider, prov.Match, prov.Disabled)
+	}
+	log.Printf("Blocked access URL patterns %v", p.BlockedURLs)
+	return &p, nil
+}
+
+// checkLogoURL returns the logo URL if it is not served from /assets or the logo file is in
+// the assets directory. A missing logo is logged and replaced by the fallback URL if there is one.
+func checkLogoURL(logoURL string, assetsDir string, fallbackURL string) string {
+	if strings.HasPrefix(logoURL, "/assets/") == false {
+		return logoURL
+	}
+	logoFile := filepath.Join(assetsDir, strings.TrimPrefix(logoURL, "/assets/"))
+	if _, err := os.Stat(logoFile); err == nil {
+		return logoURL
+	}
+	log.Printf("WARNING: logo %s is not available at %s", logoURL, logoFile)
+	if fallbackURL == "" {
+		return logoURL
+	}
+	return fallbackURL
+}
+
+// getProviderRules flattens the match strings of all providers into an ordered list of
+// matching rules. Match strings are lowercased so matching is case-insensitive.
+func getProviderRules(providers []providerDetails) []providerRule {
+	rules := make([]providerRule, 0)
+	for _, prov := range providers {
+		for _, match := range prov.Match {
+			match = strings.ToLower(strings.TrimSpace(match))
+			if match == "" {
+				continue
+			}
+			rules = append(rules, providerRule{Match: match, Provider: prov.Provider, Label: prov.Label, Disabled: prov.Disabled})
+		}
+	}
+	return rules
+}
+
+// ProvidersHandler returns a list of access_url providers for WorldCat. With ?enabled=true
+// providers that are disabled in the config are left out.
+func (svc *ServiceContext) providersHandler(c *gin.Context) {
+	p := poolProviders{Providers: svc.Providers}
+	if c.Query("enabled") == "true" {
+		p.Providers = make([]providerDetails, 0, len(svc.Providers))
+		for _, prov := range svc.Providers {
+			if prov.Disabled == false {
+				p.Providers = append(p.Providers, prov)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// getAccessProvider returns the name of the provider for an online access URL. Rules are
+// checked in order and the first match wins. Matching is case-insensitive. A URL that
+// matches a disabled provider gets the default provider.
+func (svc *ServiceContext) getAccessProvider(accessURL string) string {
+	lowerURL := strings.ToLower(accessURL)
+	for _, rule := range svc.ProviderRules {
+		if strings.Contains(lowerURL, rule.Match) {
+			if rule.Disabled {
+				log.Printf("Online access with disabled provider %s: %s", rule.Provider, accessURL)
+				return defaultProvider
+			}
+			log.Printf("Online access with %s", rule.Label)
+			return rule.Provider
+		}
+	}
+	log.Printf("Online access: %s", accessURL)
+	return defaultProvider
+}
+
+// isBlockedAccessURL returns true if an access URL should be skipped because it is not an http
+// URL or it contains one of the configured blocked patterns
+func (svc *ServiceContext) isBlockedAccessURL(accessURL string) bool {
+	lowerURL := strings.ToLower(strings.TrimSpace(accessURL))
+	if strings.HasPrefix(lowerURL, "http://") == false && strings.HasPrefix(lowerURL, "https://") == false {
+		log.Printf("DEBUG: skipping access URL that is not an http URL: %s", accessURL)
+		return true
+	}
+	for _, pattern := range svc.BlockedURLs {
+		if strings.Contains(lowerURL, strings.ToLower(pattern)) {
+			log.Printf("DEBUG: skipping access URL %s that matches blocked pattern %s", accessURL, pattern)
+			return true
+		}
+	}
+	return false
+}
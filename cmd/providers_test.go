@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeProvidersFile writes a providers config file to a temporary directory and returns its name
+func writeProvidersFile(t *testing.T, config string) string {
+	filename := filepath.Join(t.TempDir(), "providers.toml")
+	if err := os.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatalf("unable to write providers config: %s", err.Error())
+	}
+	return filename
+}
+
+// accessURLRecord returns a Dublin Core record with the access URLs
+func accessURLRecord(id string, urls ...string) string {
+	rec := fmt.Sprintf("<oclcdcs><recordIdentifier>%s</recordIdentifier><title>Title %s</title>", id, id)
+	for _, u := range urls {
+		rec += fmt.Sprintf("<identifier>%s</identifier>", u)
+	}
+	return rec + "</oclcdcs>"
+}
+
+func TestConfiguredProviders(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(2, accessURLRecord("5001", "https://archive.example.org/details/cats"),
+			accessURLRecord("5002", "https://other.example.com/cats")))
+	}
+	cfg := testConfig(mock)
+	cfg.ProvidersFile = writeProvidersFile(t, `
+[[provider]]
+provider = "archive"
+label = "Example Archive"
+homepage_url = "https://archive.example.org/"
+match = ["archive.example"]
+`)
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	resp := doRequest(router, http.MethodGet, "/api/providers", nil, nil)
+	var providers struct {
+		Providers []providerDetails `json:"providers"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &providers); err != nil {
+		t.Fatalf("unable to parse providers %s: %s", resp.Body.String(), err.Error())
+	}
+	expected := []providerDetails{{Provider: "archive", Label: "Example Archive", HomepageURL: "https://archive.example.org/"}}
+	if reflect.DeepEqual(providers.Providers, expected) == false {
+		t.Errorf("expected providers %+v, got %+v", expected, providers.Providers)
+	}
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	if provs := result.fieldProviders(0, "access_url"); reflect.DeepEqual(provs, []string{"archive"}) == false {
+		t.Errorf("expected the configured provider, got %v", provs)
+	}
+	if provs := result.fieldProviders(1, "access_url"); reflect.DeepEqual(provs, []string{defaultProvider}) == false {
+		t.Errorf("expected the default provider, got %v", provs)
+	}
+}
+
+func TestAccessURLProviders(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{url: "https://catalog.hathitrust.org/Record/001", expected: "hathitrust"},
+		{url: "HTTPS://CATALOG.HATHITRUST.ORG/Record/001", expected: "hathitrust"},
+		{url: "https://congressional.ProQuest.com/hearing/1", expected: "proquest"},
+		{url: "http://Books.Google.com/books?id=abc", expected: "google"},
+		{url: "https://www.VLeBooks.com/vleweb/product/1", expected: "vlebooks"},
+		{url: "https://www.canadiana.ca/view/oocihm.1", expected: "canadiana"},
+		{url: "https://www.overdrive.com/media/1", expected: "overdrive"},
+		{url: "https://example.com/ebook/1", expected: defaultProvider},
+	}
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		records := make([]string, 0, len(tests))
+		for idx, tc := range tests {
+			records = append(records, accessURLRecord(fmt.Sprintf("%d", 6000+idx), tc.url))
+		}
+		fmt.Fprint(w, sruRecordsResponse(len(records), records...))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	if len(result.Groups) != len(tests) {
+		t.Fatalf("expected %d groups, got %d", len(tests), len(result.Groups))
+	}
+	for idx, tc := range tests {
+		if provs := result.fieldProviders(idx, "access_url"); reflect.DeepEqual(provs, []string{tc.expected}) == false {
+			t.Errorf("expected provider %s for %s, got %v", tc.expected, tc.url, provs)
+		}
+	}
+}
+
+func TestBlockedAccessURLs(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(1, accessURLRecord("7001",
+			"https://catalog.hathitrust.org/Record/001",
+			"https://API.OverDrive.com/v1/collections/1",
+			"https://proxy.example.edu/login?url=[institution]",
+			"ftp://http.example.com/file",
+			"https://books.google.com/books?id=abc")))
+	}
+	cfg := testConfig(mock)
+	cfg.ProvidersFile = writeProvidersFile(t, `blocked_urls = ["api.overdrive", "[institution]"]`)
+	svc := newTestService(t, cfg, 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	expected := []string{"https://catalog.hathitrust.org/Record/001", "https://books.google.com/books?id=abc"}
+	if urls := result.fieldValues(0, "access_url"); reflect.DeepEqual(urls, expected) == false {
+		t.Errorf("expected access URLs %v, got %v", expected, urls)
+	}
+}
+
+func TestLogoFallback(t *testing.T) {
+	assetsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(assetsDir, "present.png"), []byte("png"), 0644); err != nil {
+		t.Fatalf("unable to write logo: %s", err.Error())
+	}
+	providersFile := writeProvidersFile(t, `
+[[provider]]
+provider = "present"
+logo_url = "/assets/present.png"
+
+[[provider]]
+provider = "missing"
+logo_url = "/assets/missing.png"
+
+[[provider]]
+provider = "external"
+logo_url = "https://logos.example.com/external.png"
+`)
+	tests := []struct {
+		name     string
+		fallback string
+		expected []string
+		identify string
+	}{
+		{name: "fallback", fallback: "https://example.com/default.png",
+			expected: []string{"/assets/present.png", "https://example.com/default.png", "https://logos.example.com/external.png"},
+			identify: "https://example.com/default.png"},
+		{name: "no fallback", expected: []string{"/assets/present.png", "/assets/missing.png", "https://logos.example.com/external.png"},
+			identify: "/assets/wclogo.png"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.AssetsDir, cfg.ProvidersFile, cfg.DefaultLogoURL = assetsDir, providersFile, tc.fallback
+			svc := newTestService(t, cfg, 5*time.Second)
+			router := newServiceRouter(svc, false)
+
+			resp := doRequest(router, http.MethodGet, "/api/providers", nil, nil)
+			var providers struct {
+				Providers []providerDetails `json:"providers"`
+			}
+			json.Unmarshal(resp.Body.Bytes(), &providers)
+			logos := make([]string, 0)
+			for _, prov := range providers.Providers {
+				logos = append(logos, prov.LogoURL)
+			}
+			if reflect.DeepEqual(logos, tc.expected) == false {
+				t.Errorf("expected logos %v, got %v", tc.expected, logos)
+			}
+			resp = doRequest(router, http.MethodGet, "/identify", nil, nil)
+			if strings.Contains(resp.Body.String(), fmt.Sprintf(`{"name":"logo_url","supported":true,"value":"%s"}`, tc.identify)) == false {
+				t.Errorf("expected identify logo %s, got %s", tc.identify, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestDisabledProviders(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(1, accessURLRecord("5001", "https://archive.example.org/details/cats",
+			"https://hidden.example.com/cats")))
+	}
+	cfg := testConfig(mock)
+	cfg.ProvidersFile = writeProvidersFile(t, `
+[[provider]]
+provider = "archive"
+label = "Example Archive"
+match = ["archive.example"]
+
+[[provider]]
+provider = "hidden"
+label = "Hidden Provider"
+match = ["hidden.example"]
+disabled = true
+`)
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	tests := map[string][]string{"/api/providers": {"archive", "hidden"}, "/api/providers?enabled=true": {"archive"}}
+	for path, expected := range tests {
+		resp := doRequest(router, http.MethodGet, path, nil, nil)
+		var providers struct {
+			Providers []providerDetails `json:"providers"`
+		}
+		json.Unmarshal(resp.Body.Bytes(), &providers)
+		names := make([]string, 0)
+		for _, prov := range providers.Providers {
+			names = append(names, prov.Provider)
+		}
+		if reflect.DeepEqual(names, expected) == false {
+			t.Errorf("expected %s to list %v, got %v", path, expected, names)
+		}
+	}
+
+	// access URLs of a disabled provider are attributed to the default provider
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	if provs := result.fieldProviders(0, "access_url"); reflect.DeepEqual(provs, []string{"archive", defaultProvider}) == false {
+		t.Errorf("expected access URL providers archive and %s, got %v", defaultProvider, provs)
+	}
+}
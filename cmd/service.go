@@ -1,86 +1,340 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
 	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"github.com/uvalib/virgo4-api/v4api"
 	"github.com/uvalib/virgo4-jwt/v4jwt"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/text/language"
+	"golang.org/x/time/rate"
 )
 
+// healthCheckOCLCNumber is a known OCLC number used to verify the SRU search endpoint
+const healthCheckOCLCNumber = "1"
+
+// oclcInitRetry is the delay between attempts to get the initial OCLC auth token
+const oclcInitRetry = 10 * time.Second
+
+// oclcRefreshMargin is the most time before expiry that the background refresh renews the
+// OCLC auth token. Short lived tokens are renewed when a tenth of their life is left.
+const oclcRefreshMargin = time.Minute
+
+// oclcHealthInterval is the shortest time between OCLC token requests made by the healthcheck
+const oclcHealthInterval = time.Minute
+
 // OCLC contains data necessary to get and use OCLC auth tokens
 type OCLC struct {
 	Key         string
 	Secret      string
 	AuthURL     string
 	MetadataAPI string
+	HoldingsAPI string
 	Token       string
 	Expires     time.Time
+	Ready       atomic.Bool
+	mutex       sync.Mutex
+	// the time and any error of the last token request made by the healthcheck
+	checked  time.Time
+	checkErr string
+}
+
+// getToken returns the current OCLC auth token
+func (o *OCLC) getToken() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.Token
+}
+
+// getExpires returns the expiry time of the current OCLC auth token
+func (o *OCLC) getExpires() time.Time {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.Expires
+}
+
+// configured returns true if the OCLC credentials and metadata API are all set. Without
+// them, format enrichment and holdings are not available.
+func (o *OCLC) configured() bool {
+	return o.Key != "" && o.Secret != "" && o.AuthURL != "" && o.MetadataAPI != ""
+}
+
+// invalidate clears the current OCLC auth token so the next refresh requests a new one
+func (o *OCLC) invalidate() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.Token = ""
+	o.Expires = time.Now()
 }
 
 // ServiceContext contains common data used by all handlers
 type ServiceContext struct {
-	Version    string
-	Port       int
-	WCKey      string
-	WCAPI      string
-	JWTKey     string
-	I18NBundle *i18n.Bundle
-	HTTPClient *http.Client
-	OCLC       OCLC
+	Version            string
+	Port               int
+	WCKey              string
+	WCAPI              string
+	JWTKey             string
+	APIKey             string
+	BatchMax           int
+	ILLURL             string
+	DefaultRows        int
+	MaxOffset          int
+	MaxBodySize        int64
+	GroupResults       bool
+	BroadKeyword       bool
+	AuthorVariants     bool
+	CoverImageURL      string
+	MinTermLength      int
+	RecordSchema       string
+	UserAgent          string
+	LogoURL            string
+	SearchMaxAge       int
+	ResourceMaxAge     int
+	DefaultSort        v4api.SortOrder
+	StrictSort         bool
+	PartnerSymbols     []string
+	IdentifierRelation string
+	MinConfidence      string
+	LowConfidenceRows  int
+	Providers          []providerDetails
+	ProviderRules      []providerRule
+	BlockedURLs        []string
+	I18NBundle         *i18n.Bundle
+	HTTPClient         *http.Client
+	RateLimiter        *rate.Limiter
+	SearchCache        *searchCache
+	SearchFlight       singleflight.Group
+	Identities         sync.Map
+	Stats              serviceStats
+	OCLC               OCLC
 }
 
 // RequestError contains http status code and message for and API request
 type RequestError struct {
-	StatusCode int
-	Message    string
+	StatusCode  int
+	Message     string
+	RetryAfter  string
+	FieldErrors []fieldError
+}
+
+// fieldError describes a problem with one field of a JSON request. Field is the JSON path of
+// the field, like pagination.start.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 // InitializeService will initialize the service context based on the config parameters.
-// Any pools found in the DB will be added to the context and polled for status.
-// Any errors are FATAL.
-func InitializeService(version string, cfg *ServiceConfig) *ServiceContext {
+// All outbound requests use the client; if it is nil a client is created from the config.
+// This allows the WorldCat and OCLC endpoints to be replaced with a mock server.
+// An error is returned if the providers or localization files cannot be loaded.
+func InitializeService(version string, cfg *ServiceConfig, client *http.Client) (*ServiceContext, error) {
 	log.Printf("Initializing Service")
-	svc := ServiceContext{Version: version, WCKey: cfg.WCKey, WCAPI: cfg.WCAPI, JWTKey: cfg.JWTKey}
-
+	svc := ServiceContext{Version: version, WCKey: cfg.WCKey, WCAPI: cfg.WCAPI, JWTKey: cfg.JWTKey,
+		APIKey: cfg.APIKey, MaxBodySize: cfg.MaxBodySize, DefaultRows: cfg.DefaultRows, MaxOffset: cfg.MaxOffset, ILLURL: cfg.ILLURL,
+		BatchMax: cfg.BatchMax, GroupResults: cfg.GroupResults, BroadKeyword: cfg.BroadKeyword,
+		AuthorVariants: cfg.AuthorVariants, CoverImageURL: cfg.CoverImageURL,
+		MinTermLength: cfg.MinTermLength, RecordSchema: cfg.RecordSchema, UserAgent: cfg.UserAgent,
+		IdentifierRelation: cfg.IdentifierRelation, MinConfidence: cfg.MinConfidence, LowConfidenceRows: cfg.LowConfidenceRows,
+		SearchMaxAge: cfg.SearchMaxAge, ResourceMaxAge: cfg.ResourceMaxAge, StrictSort: cfg.StrictSort,
+		DefaultSort: v4api.SortOrder{SortID: cfg.DefaultSort, Order: cfg.DefaultSortOrder}}
+
+	svc.Stats.started = time.Now()
 	svc.OCLC.AuthURL = cfg.OCLCAuthURL
 	svc.OCLC.Key = cfg.OCLCKey
 	svc.OCLC.Secret = cfg.OCLCSecret
 	svc.OCLC.MetadataAPI = cfg.OCLCMetadataAPI
+	svc.OCLC.HoldingsAPI = cfg.OCLCHoldingsAPI
+
+	for _, symbol := range strings.Split(cfg.PartnerSymbols, ",") {
+		symbol = strings.ToUpper(strings.TrimSpace(symbol))
+		if symbol != "" {
+			svc.PartnerSymbols = append(svc.PartnerSymbols, symbol)
+		}
+	}
+
+	providers, err := loadProviders(cfg.ProvidersFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load providers: %s", err.Error())
+	}
+	for idx := range providers.Providers {
+		prov := &providers.Providers[idx]
+		if prov.LogoURL != "" {
+			prov.LogoURL = checkLogoURL(prov.LogoURL, cfg.AssetsDir, cfg.DefaultLogoURL)
+		}
+	}
+	svc.Providers = providers.Providers
+	svc.LogoURL = checkLogoURL("/assets/wclogo.png", cfg.AssetsDir, cfg.DefaultLogoURL)
+	svc.ProviderRules = getProviderRules(providers.Providers)
+	svc.BlockedURLs = providers.BlockedURLs
+
+	log.Printf("Init search cache with window %d, ttl %ds and max %d entries", cfg.CacheWindow, cfg.CacheTTL, cfg.CacheMaxEntries)
+	svc.SearchCache = newSearchCache(cfg.CacheWindow, time.Duration(cfg.CacheTTL)*time.Second, cfg.CacheMaxEntries)
 
 	log.Printf("Init localization")
-	svc.I18NBundle = i18n.NewBundle(language.English)
-	svc.I18NBundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
-	svc.I18NBundle.MustLoadMessageFile("./i18n/active.en.toml")
-	svc.I18NBundle.MustLoadMessageFile("./i18n/active.es.toml")
-
-	log.Printf("Create HTTP Client")
-	defaultTransport := &http.Transport{
-		Dial: (&net.Dialer{
+	bundle, err := loadLocalizations("./i18n")
+	if err != nil {
+		return nil, fmt.Errorf("unable to init localization: %s", err.Error())
+	}
+	svc.I18NBundle = bundle
+
+	if client == nil {
+		log.Printf("Create HTTP Client")
+		client = &http.Client{
+			Transport: newHTTPTransport(cfg),
+			Timeout:   5 * time.Second,
+		}
+	}
+	svc.HTTPClient = client
+
+	limit := rate.Inf
+	if cfg.RateLimit > 0 {
+		limit = rate.Limit(cfg.RateLimit)
+	}
+	log.Printf("Limit WorldCat API requests to %v per second, burst %d", limit, cfg.RateBurst)
+	svc.RateLimiter = rate.NewLimiter(limit, cfg.RateBurst)
+
+	if svc.OCLC.configured() == false {
+		log.Printf("WARNING: OCLC is not configured; format enrichment and holdings are disabled")
+		svc.OCLC.Ready.Store(true)
+	} else if cfg.OCLCPrewarm {
+		log.Printf("Request initial OCLC auth token")
+		go svc.initOCLCAuth()
+	} else {
+		// without pre-warming, the token is requested by the first lookup that needs it
+		log.Printf("OCLC auth token pre-warming is disabled")
+		svc.OCLC.Ready.Store(true)
+	}
+	if svc.OCLC.configured() && cfg.OCLCRefresh {
+		log.Printf("Start background OCLC auth token refresh")
+		go svc.backgroundOCLCRefresh()
+	}
+
+	return &svc, nil
+}
+
+// newHTTPTransport creates the transport for all outbound requests. OCLC services are on
+// separate hosts, so idle connections are kept per host. A custom dialer would turn off
+// HTTP/2, so it is explicitly requested.
+func newHTTPTransport(cfg *ServiceConfig) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
 			Timeout:   2 * time.Second,
 			KeepAlive: 600 * time.Second,
-		}).Dial,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
 		TLSHandshakeTimeout: 2 * time.Second,
-		MaxIdleConns:        100,
-		MaxIdleConnsPerHost: 100,
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(cfg.IdleConnTimeout) * time.Second,
 	}
-	svc.HTTPClient = &http.Client{
-		Transport: defaultTransport,
-		Timeout:   5 * time.Second,
+}
+
+// loadLocalizations loads all active.*.toml message files from the i18n directory
+// into a new bundle. English is the default language.
+func loadLocalizations(i18nDir string) (*i18n.Bundle, error) {
+	bundle := i18n.NewBundle(language.English)
+	bundle.RegisterUnmarshalFunc("toml", toml.Unmarshal)
+	if _, err := os.Stat(i18nDir); err != nil {
+		return nil, fmt.Errorf("i18n directory %s is not available: %s", i18nDir, err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(i18nDir, "active.*.toml"))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no active.*.toml message files found in %s", i18nDir)
+	}
+	for _, msgFile := range files {
+		msgs, err := bundle.LoadMessageFile(msgFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load %s: %s", msgFile, err.Error())
+		}
+		log.Printf("Loaded %d %s messages from %s", len(msgs.Messages), msgs.Tag, msgFile)
 	}
+	return bundle, nil
+}
 
-	return &svc
+// initOCLCAuth requests the first OCLC auth token, retrying until it succeeds.
+// Until then, the service will report itself as not ready.
+func (svc *ServiceContext) initOCLCAuth() {
+	for {
+		err := svc.refreshOCLCAuth()
+		if err == nil {
+			log.Printf("INFO: initial OCLC auth token obtained")
+			return
+		}
+		log.Printf("ERROR: unable to get initial OCLC auth token: %s; retry in %s", err.Error(), oclcInitRetry)
+		time.Sleep(oclcInitRetry)
+	}
+}
+
+// backgroundOCLCRefresh renews the OCLC auth token shortly before it expires so lookups do not
+// wait for a token request. It shares the OCLC mutex with the refresh done by lookups, and a
+// token that was already replaced by one of them is not renewed again. Runs forever.
+func (svc *ServiceContext) backgroundOCLCRefresh() {
+	for {
+		expires := svc.OCLC.getExpires()
+		if remaining := time.Until(expires); remaining > 0 {
+			delay := oclcRefreshDelay(remaining)
+			log.Printf("INFO: background OCLC auth token refresh in %s", delay.Round(time.Second))
+			time.Sleep(delay)
+		}
+		err := svc.renewOCLCAuth(expires)
+		if err != nil {
+			log.Printf("ERROR: background OCLC auth token refresh failed: %s; retry in %s", err.Error(), oclcInitRetry)
+		}
+		// don't spin when the refresh failed or the new token has no usable expiry
+		if err != nil || time.Until(svc.OCLC.getExpires()) <= 0 {
+			time.Sleep(oclcInitRetry)
+		}
+	}
+}
+
+// oclcRefreshDelay returns how long to wait before renewing a token that expires after remaining
+func oclcRefreshDelay(remaining time.Duration) time.Duration {
+	margin := remaining / 10
+	if margin > oclcRefreshMargin {
+		margin = oclcRefreshMargin
+	}
+	return remaining - margin
+}
+
+// renewOCLCAuth requests a new OCLC auth token unless the token that expires at expires has
+// already been replaced
+func (svc *ServiceContext) renewOCLCAuth(expires time.Time) error {
+	svc.OCLC.mutex.Lock()
+	defer svc.OCLC.mutex.Unlock()
+	if svc.OCLC.Expires.Equal(expires) == false {
+		log.Printf("INFO: oclc auth token was already renewed")
+		return nil
+	}
+	if err := svc.oclcTokenRequest(); err != nil {
+		return errors.New(err.Message)
+	}
+	log.Printf("INFO: oclc auth successfully renewed in the background")
+	return nil
 }
 
 // IgnoreFavicon is a dummy to handle browser favicon requests without warnings
@@ -103,59 +357,192 @@ func (svc *ServiceContext) getVersion(c *gin.Context) {
 	c.JSON(http.StatusOK, vMap)
 }
 
-// HealthCheck reports the health of the serivce
+// Liveness reports that the service process is up. It is always a 200 and makes no
+// external calls, so it is suitable for a liveness probe.
+func (svc *ServiceContext) liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"alive": true})
+}
+
+// HealthCheck is the readiness check for the serivce. When pre-warming is enabled and the initial
+// OCLC auth token is still being obtained at startup it returns a 503. Once ready, a minimal SRU search and an
+// OCLC token request are made to verify the WorldCat dependencies; the token request is made at most
+// once per oclcHealthInterval. The response is then always a 200; the top level healthy flag will be
+// false if any dependency is down. The OCLC entry includes the expiry of the current token.
 func (svc *ServiceContext) healthCheck(c *gin.Context) {
 	type hcResp struct {
 		Healthy bool   `json:"healthy"`
 		Message string `json:"message,omitempty"`
+		Expires string `json:"expires,omitempty"`
 	}
-	hcMap := make(map[string]hcResp)
-
-	pingReq, _ := http.NewRequest("GET", svc.WCAPI, nil)
-	resp, postErr := svc.HTTPClient.Do(pingReq)
-	if resp != nil {
-		defer resp.Body.Close()
+	hcMap := make(map[string]interface{})
+	healthy := true
+
+	if svc.OCLC.Ready.Load() == false {
+		log.Printf("WARNING: healthcheck requested before initial OCLC auth token was obtained")
+		hcMap["oclc_auth"] = hcResp{Healthy: false, Message: "initial OCLC auth token has not been obtained"}
+		hcMap["healthy"] = false
+		c.JSON(http.StatusServiceUnavailable, hcMap)
+		return
 	}
-	if postErr != nil {
-		hcMap["worldcat_api"] = hcResp{Healthy: false, Message: postErr.Error()}
-	} else if resp.StatusCode != 200 {
-		hcMap["worldcat_api"] = hcResp{Healthy: false, Message: resp.Status}
+
+	// use the configured record schema so the check requests records the same way searches do
+	pingURL := fmt.Sprintf("%s/search/worldcat/sru?recordSchema=%s&query=%s&maximumRecords=1&wskey=%s",
+		svc.WCAPI, svc.RecordSchema, url.QueryEscape(fmt.Sprintf("srw.no = %s", healthCheckOCLCNumber)), svc.WCKey)
+	_, pingErr := svc.apiGet(pingURL, "")
+	if pingErr != nil {
+		healthy = false
+		hcMap["worldcat_api"] = hcResp{Healthy: false, Message: pingErr.Message}
 	} else {
 		hcMap["worldcat_api"] = hcResp{Healthy: true}
 	}
 
+	// without OCLC configuration there is no token to check
+	if svc.OCLC.configured() {
+		expires, authErr := svc.checkOCLCAuth()
+		authResp := hcResp{Healthy: true}
+		if authErr != nil {
+			healthy = false
+			authResp = hcResp{Healthy: false, Message: authErr.Error()}
+		}
+		if time.Until(expires) > 0 {
+			authResp.Expires = expires.UTC().Format(time.RFC3339)
+		}
+		hcMap["oclc_auth"] = authResp
+	}
+
+	hcMap["healthy"] = healthy
 	c.JSON(http.StatusOK, hcMap)
 }
 
 // IdentifyHandler returns localized identity information for this pool
 func (svc *ServiceContext) identifyHandler(c *gin.Context) {
-	acceptLang := strings.Split(c.GetHeader("Accept-Language"), ",")[0]
-	if acceptLang == "" {
-		acceptLang = "en-US"
+	locale := svc.getLocale(c)
+	log.Printf("Identify request Accept-Language %s uses locale %s", c.GetHeader("Accept-Language"), locale)
+
+	// identity only varies by version and locale; clients can skip the download if unchanged.
+	// Key on the bundle language that best matches the request so the cache stays small
+	etag := fmt.Sprintf(`"%s-%s"`, svc.Version, locale)
+	c.Header("ETag", etag)
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
 	}
-	log.Printf("Identify request Accept-Language %s", acceptLang)
-	localizer := i18n.NewLocalizer(svc.I18NBundle, acceptLang)
 
+	if cached, found := svc.Identities.Load(locale); found {
+		c.JSON(http.StatusOK, cached)
+		return
+	}
+
+	resp := svc.buildIdentity(i18n.NewLocalizer(svc.I18NBundle, locale))
+	svc.Identities.Store(locale, resp)
+	c.JSON(http.StatusOK, resp)
+}
+
+// buildIdentity creates the pool identity localized for the specified localizer
+func (svc *ServiceContext) buildIdentity(localizer *i18n.Localizer) *v4api.PoolIdentity {
 	resp := v4api.PoolIdentity{Attributes: make([]v4api.PoolAttribute, 0)}
 	resp.Name = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "PoolName"})
 	resp.Description = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "PoolDescription"})
 	resp.Mode = "record"
 
-	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "logo_url", Supported: true, Value: "/assets/wclogo.png"})
+	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "logo_url", Supported: true, Value: svc.LogoURL})
 	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "external_url", Supported: true, Value: "https://www.worldcat.org/"})
 	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "facets", Supported: false})
 	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "sorting", Supported: true})
 	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "ill_request", Supported: true})
+	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "default_rows", Supported: true, Value: strconv.Itoa(svc.DefaultRows)})
+	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "max_offset", Supported: true, Value: strconv.Itoa(svc.MaxOffset)})
 	resp.Attributes = append(resp.Attributes, v4api.PoolAttribute{Name: "item_message", Supported: true,
-		Value: `This resource is not held by the UVA Library. You may request an Interlibrary Loan using the 'Request Item' button below.`})
+		Value: localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "ItemMessage"})})
 
-	resp.SortOptions = make([]v4api.SortOption, 0)
-	resp.SortOptions = append(resp.SortOptions, v4api.SortOption{ID: v4api.SortRelevance.String(), Label: "Relevance"})
-	resp.SortOptions = append(resp.SortOptions, v4api.SortOption{ID: v4api.SortDate.String(), Label: "Date Published", Asc: "oldest first", Desc: "newest first"})
-	resp.SortOptions = append(resp.SortOptions, v4api.SortOption{ID: v4api.SortTitle.String(), Label: "Title", Asc: "A-Z", Desc: "Z-A"})
-	resp.SortOptions = append(resp.SortOptions, v4api.SortOption{ID: v4api.SortAuthor.String(), Label: "Author", Asc: "A-Z", Desc: "Z-A"})
+	resp.SortOptions = append(make([]v4api.SortOption, 0, len(sortOptions)), sortOptions...)
 
-	c.JSON(http.StatusOK, resp)
+	return &resp
+}
+
+// requestIDMiddleware assigns an ID to each request so errors can be matched to the logs.
+// An X-Request-Id from the client is used if present.
+func requestIDMiddleware(c *gin.Context) {
+	reqID := c.GetHeader("X-Request-Id")
+	if reqID == "" {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		reqID = hex.EncodeToString(buf)
+	}
+	c.Set("request_id", reqID)
+	c.Header("X-Request-Id", reqID)
+}
+
+// setCacheControl adds a Cache-Control header allowing a response to be cached for maxAge
+// seconds. A maxAge of 0 turns off caching. Responses to authenticated requests are only
+// cached privately.
+func setCacheControl(c *gin.Context, maxAge int) {
+	if maxAge <= 0 {
+		c.Header("Cache-Control", "no-store")
+		return
+	}
+	visibility := "public"
+	if getClaims(c) != nil {
+		visibility = "private"
+	}
+	c.Header("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, maxAge))
+}
+
+// respondError sends a JSON error response with the status code, message and request ID
+func respondError(c *gin.Context, code int, msg string) {
+	log.Printf("INFO: request %s failed with %d: %s", c.GetString("request_id"), code, msg)
+	c.JSON(code, gin.H{"status": code, "message": msg, "request_id": c.GetString("request_id")})
+}
+
+// respondRequestError sends a JSON error response for a failed request. If the upstream
+// service asked for requests to be retried later, its Retry-After header is passed on.
+// Invalid request fields are listed in the errors of the response.
+func respondRequestError(c *gin.Context, reqErr *RequestError) {
+	if reqErr.RetryAfter != "" {
+		c.Header("Retry-After", reqErr.RetryAfter)
+	}
+	if len(reqErr.FieldErrors) > 0 {
+		log.Printf("INFO: request %s failed with %d: %s %+v", c.GetString("request_id"), reqErr.StatusCode, reqErr.Message, reqErr.FieldErrors)
+		c.JSON(reqErr.StatusCode, gin.H{"status": reqErr.StatusCode, "message": reqErr.Message,
+			"errors": reqErr.FieldErrors, "request_id": c.GetString("request_id")})
+		return
+	}
+	respondError(c, reqErr.StatusCode, reqErr.Message)
+}
+
+// getLocale returns the loaded locale that best matches the Accept-Language header. All of
+// the languages in the header are considered in order of their quality values, so
+// fr,es;q=0.8 selects Spanish when there are no French messages. The bundle default
+// language is used when nothing matches or the header is missing or invalid.
+func (svc *ServiceContext) getLocale(c *gin.Context) string {
+	tags := svc.I18NBundle.LanguageTags()
+	accepted, _, err := language.ParseAcceptLanguage(c.GetHeader("Accept-Language"))
+	if err != nil {
+		log.Printf("WARNING: invalid Accept-Language %s: %s", c.GetHeader("Accept-Language"), err.Error())
+	}
+	_, idx, _ := language.NewMatcher(tags).Match(accepted...)
+	return tags[idx].String()
+}
+
+// readJSONBody decodes a JSON request body into tgt. The body size is limited and fields that
+// are not part of tgt are rejected.
+func (svc *ServiceContext) readJSONBody(c *gin.Context, tgt interface{}) *RequestError {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, svc.MaxBodySize)
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(tgt)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after JSON body")
+	}
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return &RequestError{StatusCode: http.StatusBadRequest,
+				Message: fmt.Sprintf("request body exceeds the maximum of %d bytes", svc.MaxBodySize)}
+		}
+		return &RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("invalid request: %s", err.Error())}
+	}
+	return nil
 }
 
 // getBearerToken is a helper to extract the user auth token from the Auth header
@@ -170,27 +557,64 @@ func getBearerToken(authorization string) (string, error) {
 	return components[1], nil
 }
 
+// apiKeyMiddleware only allows requests with the configured API key in the X-Api-Key header.
+// It protects operational routes that users may not call.
+func (svc *ServiceContext) apiKeyMiddleware(c *gin.Context) {
+	apiKey := c.Request.Header.Get("X-Api-Key")
+	if svc.APIKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(svc.APIKey)) != 1 {
+		log.Printf("Authentication failed; missing or invalid API key")
+		respondError(c, http.StatusUnauthorized, "invalid_api_key")
+		c.Abort()
+		return
+	}
+	log.Printf("INFO: authenticated service account with API key")
+	c.Set("service_account", true)
+}
+
 // AuthMiddleware is a middleware handler that verifies presence of a
 // user Bearer token in the Authorization header.
 func (svc *ServiceContext) authMiddleware(c *gin.Context) {
+	// server-to-server callers may use the static API key instead of a user JWT
+	apiKey := c.Request.Header.Get("X-Api-Key")
+	if apiKey != "" {
+		if svc.APIKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(svc.APIKey)) != 1 {
+			log.Printf("Authentication failed; invalid API key")
+			respondError(c, http.StatusUnauthorized, "invalid_api_key")
+			c.Abort()
+			return
+		}
+		log.Printf("INFO: authenticated service account with API key")
+		c.Set("service_account", true)
+		c.Set("claims", &v4jwt.V4Claims{Role: v4jwt.User})
+		return
+	}
+
 	tokenStr, err := getBearerToken(c.Request.Header.Get("Authorization"))
 	if err != nil {
 		log.Printf("Authentication failed: [%s]", err.Error())
-		c.AbortWithStatus(http.StatusUnauthorized)
+		respondError(c, http.StatusUnauthorized, "authentication required")
+		c.Abort()
 		return
 	}
 
 	if tokenStr == "undefined" {
 		log.Printf("Authentication failed; bearer token is undefined")
-		c.AbortWithStatus(http.StatusUnauthorized)
+		respondError(c, http.StatusUnauthorized, "authentication required")
+		c.Abort()
 		return
 	}
 
 	log.Printf("Validating JWT auth token...")
 	v4Claims, jwtErr := v4jwt.Validate(tokenStr, svc.JWTKey)
 	if jwtErr != nil {
-		log.Printf("JWT signature for %s is invalid: %s", tokenStr, jwtErr.Error())
-		c.AbortWithStatus(http.StatusUnauthorized)
+		reason := "token_invalid"
+		if isTokenExpired(jwtErr) {
+			reason = "token_expired"
+		}
+		log.Printf("JWT signature for %s is invalid (%s): %s", tokenStr, reason, jwtErr.Error())
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, reason))
+		respondError(c, http.StatusUnauthorized, reason)
+		c.Abort()
 		return
 	}
 
@@ -200,11 +624,89 @@ func (svc *ServiceContext) authMiddleware(c *gin.Context) {
 	log.Printf("got bearer token: [%s]: %+v", tokenStr, v4Claims)
 }
 
+// isTokenExpired returns true if a JWT validation error is due to an expired token
+func isTokenExpired(err error) bool {
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Errors&jwt.ValidationErrorExpired != 0
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "expired")
+}
+
+// getClaims returns the V4 claims added to the context by authMiddleware, or nil if there are none
+func getClaims(c *gin.Context) *v4jwt.V4Claims {
+	claims, found := c.Get("claims")
+	if !found {
+		return nil
+	}
+	v4Claims, ok := claims.(*v4jwt.V4Claims)
+	if !ok {
+		return nil
+	}
+	return v4Claims
+}
+
+// hasRole returns true if the claims have the specified role or a higher one. V4 roles are
+// ordered guest, user, staff, admin, pdaadmin, so staff and admins are also users.
+func hasRole(claims *v4jwt.V4Claims, role v4jwt.RoleEnum) bool {
+	if claims == nil {
+		return false
+	}
+	return claims.Role >= role
+}
+
+// requireRole returns a middleware handler that only allows users with the specified role.
+// It must follow authMiddleware. Authenticated users without the role get a 403.
+func (svc *ServiceContext) requireRole(role v4jwt.RoleEnum) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := getClaims(c)
+		if hasRole(claims, role) == false {
+			log.Printf("Authorization failed: %s requires role %s", c.Request.URL.Path, role.String())
+			respondError(c, http.StatusForbidden, "insufficient permissions")
+			c.Abort()
+			return
+		}
+	}
+}
+
+// debugRequested returns true if the request asked for debug information with ?debug=1 and
+// the authenticated user is allowed to see it. Debug data exposes query internals, so it is
+// limited to admin users.
+func (svc *ServiceContext) debugRequested(c *gin.Context) bool {
+	debugParam := c.Query("debug")
+	if debugParam != "1" && debugParam != "true" {
+		return false
+	}
+	if hasRole(getClaims(c), v4jwt.Admin) == false {
+		log.Printf("WARNING: debug requested by non-admin user")
+		return false
+	}
+	log.Printf("INFO: debug information requested")
+	return true
+}
+
 // APIGet sends a GET to the WorldCat API and returns results a byte array
 func (svc *ServiceContext) apiGet(tgtURL string, bearerToken string) ([]byte, *RequestError) {
 	log.Printf("WorldCat API GET request: %s", tgtURL)
+
+	// throttle outbound requests. If the wait would exceed the request timeout, fail now.
+	// A client without a timeout waits as long as needed.
+	ctx, cancel := context.WithCancel(context.Background())
+	if svc.HTTPClient.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), svc.HTTPClient.Timeout)
+	}
+	defer cancel()
+	if err := svc.RateLimiter.Wait(ctx); err != nil {
+		log.Printf("ERROR: rate limit exceeded for GET %s: %s", tgtURL, err.Error())
+		return nil, &RequestError{StatusCode: http.StatusTooManyRequests, Message: "too many WorldCat requests; please try again later"}
+	}
+
 	startTime := time.Now()
 	getReq, _ := http.NewRequest("GET", tgtURL, nil)
+	// SRU responses are large; ask for them compressed. Setting this header turns off
+	// the automatic decompression in the transport so handleAPIResponse decompresses.
+	getReq.Header.Set("Accept-Encoding", "gzip")
+	getReq.Header.Set("User-Agent", svc.UserAgent)
 	if bearerToken != "" {
 		log.Printf("INFO: adding bearer token to api request")
 		getReq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", bearerToken))
@@ -215,6 +717,7 @@ func (svc *ServiceContext) apiGet(tgtURL string, bearerToken string) ([]byte, *R
 	elapsedMS := int64(elapsedNanoSec / time.Millisecond)
 
 	if err != nil {
+		svc.Stats.worldcatErrors.Add(1)
 		log.Printf("ERROR: Failed response from GET %s %d. Elapsed Time: %d (ms). %s",
 			tgtURL, err.StatusCode, elapsedMS, err.Message)
 	} else {
@@ -223,13 +726,35 @@ func (svc *ServiceContext) apiGet(tgtURL string, bearerToken string) ([]byte, *R
 	return resp, err
 }
 
+// oclcTokenRequest gets a new OCLC auth token. The caller must hold the OCLC mutex.
 func (svc *ServiceContext) oclcTokenRequest() *RequestError {
-	log.Printf("INFO: request OCLC token from %s", svc.OCLC.AuthURL)
 	svc.OCLC.Expires = time.Now()
 	svc.OCLC.Token = ""
+	token, expires, err := svc.requestOCLCToken()
+	if err != nil {
+		return err
+	}
+	svc.setOCLCToken(token, expires)
+	return nil
+}
+
+// setOCLCToken makes the token the current OCLC auth token. The caller must hold the OCLC mutex.
+func (svc *ServiceContext) setOCLCToken(token string, expires time.Time) {
+	log.Printf("INFO: update OCLC auth token data")
+	svc.OCLC.Token = token
+	svc.OCLC.Expires = expires
+	svc.OCLC.Ready.Store(true)
+	svc.Stats.tokenRefreshes.Add(1)
+}
+
+// requestOCLCToken requests a new OCLC auth token and returns it with its expiry time.
+// The current token is not changed.
+func (svc *ServiceContext) requestOCLCToken() (string, time.Time, *RequestError) {
+	log.Printf("INFO: request OCLC token from %s", svc.OCLC.AuthURL)
 	startTime := time.Now()
 	req, _ := http.NewRequest("POST", svc.OCLC.AuthURL, nil)
 	req.SetBasicAuth(svc.OCLC.Key, svc.OCLC.Secret)
+	req.Header.Set("User-Agent", svc.UserAgent)
 	rawResp, rawErr := svc.HTTPClient.Do(req)
 	resp, err := handleAPIResponse(svc.OCLC.AuthURL, rawResp, rawErr)
 	elapsedNanoSec := time.Since(startTime)
@@ -238,11 +763,10 @@ func (svc *ServiceContext) oclcTokenRequest() *RequestError {
 	if err != nil {
 		log.Printf("ERROR: failed response from OCLC auth reques %s %d. Elapsed Time: %d (ms). %s",
 			svc.OCLC.AuthURL, err.StatusCode, elapsedMS, err.Message)
-		return err
+		return "", time.Time{}, err
 	}
 
 	log.Printf("INFO: successful response from GET %s. Elapsed Time: %d (ms)", svc.OCLC.AuthURL, elapsedMS)
-	log.Printf("INFO: update OCLC auth token data")
 	var authResponse struct {
 		Token   string `json:"access_token"`
 		Expires string `json:"expires_at"`
@@ -256,33 +780,97 @@ func (svc *ServiceContext) oclcTokenRequest() *RequestError {
 	expTime, _ := time.Parse("2006-01-02 15:04:05Z", authResponse.Expires)
 	delTime := expTime.Sub(now)
 	log.Printf("INFO: oclc token expires %+v or %2.2f seconds", expTime, delTime.Seconds())
-	svc.OCLC.Token = authResponse.Token
-	svc.OCLC.Expires = expTime
+	return authResponse.Token, expTime, nil
+}
 
-	return nil
+// checkOCLCAuth verifies that an OCLC auth token can be obtained by requesting a new one, and
+// returns the expiry time of the current token. A check is only done once per oclcHealthInterval
+// so frequent health checks do not use up the OCLC quota; in between, the last result is
+// returned. A failed request leaves the current token in place for lookups.
+func (svc *ServiceContext) checkOCLCAuth() (time.Time, error) {
+	svc.OCLC.mutex.Lock()
+	defer svc.OCLC.mutex.Unlock()
+	if time.Since(svc.OCLC.checked) >= oclcHealthInterval {
+		svc.OCLC.checked = time.Now()
+		svc.OCLC.checkErr = ""
+		token, expires, err := svc.requestOCLCToken()
+		if err != nil {
+			svc.OCLC.checkErr = err.Message
+		} else {
+			svc.setOCLCToken(token, expires)
+		}
+	}
+	if svc.OCLC.checkErr != "" {
+		return svc.OCLC.Expires, fmt.Errorf("unable to obtain an OCLC auth token: %s", svc.OCLC.checkErr)
+	}
+	return svc.OCLC.Expires, nil
 }
 
 func handleAPIResponse(URL string, resp *http.Response, err error) ([]byte, *RequestError) {
 	if err != nil {
-		status := http.StatusBadRequest
-		errMsg := err.Error()
-		if strings.Contains(err.Error(), "Timeout") {
-			status = http.StatusRequestTimeout
-			errMsg = fmt.Sprintf("%s timed out", URL)
-		} else if strings.Contains(err.Error(), "connection refused") {
-			status = http.StatusServiceUnavailable
-			errMsg = fmt.Sprintf("%s refused connection", URL)
-		}
-		return nil, &RequestError{StatusCode: status, Message: errMsg}
-	} else if resp.StatusCode != http.StatusOK {
-		defer resp.Body.Close()
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		status := resp.StatusCode
-		errMsg := string(bodyBytes)
+		status, errMsg := classifyRequestError(URL, err)
 		return nil, &RequestError{StatusCode: status, Message: errMsg}
 	}
 
 	defer resp.Body.Close()
-	bodyBytes, _ := io.ReadAll(resp.Body)
+	bodyBytes, readErr := readResponseBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("ERROR: %s returned %d: %s", URL, resp.StatusCode, bodyBytes)
+		return nil, getUpstreamError(resp)
+	}
+	if readErr != nil {
+		log.Printf("ERROR: unable to read response from %s: %s", URL, readErr.Error())
+		return nil, &RequestError{StatusCode: http.StatusBadGateway, Message: fmt.Sprintf("unable to read response from %s", URL)}
+	}
 	return bodyBytes, nil
 }
+
+// getUpstreamError returns the error for a non-200 upstream response. The upstream body is
+// not returned to the client. Upstream server errors are reported as a bad gateway, or as
+// unavailable for a 503, so they are not mistaken for errors in this service.
+func getUpstreamError(resp *http.Response) *RequestError {
+	host := resp.Request.URL.Host
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RequestError{StatusCode: http.StatusTooManyRequests, RetryAfter: resp.Header.Get("Retry-After"),
+			Message: fmt.Sprintf("too many requests to %s; please try again later", host)}
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		return &RequestError{StatusCode: http.StatusServiceUnavailable, RetryAfter: resp.Header.Get("Retry-After"),
+			Message: fmt.Sprintf("%s is unavailable", host)}
+	case resp.StatusCode >= 500:
+		return &RequestError{StatusCode: http.StatusBadGateway, Message: fmt.Sprintf("%s returned an error", host)}
+	}
+	return &RequestError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("%s returned status %d", host, resp.StatusCode)}
+}
+
+// classifyRequestError returns the status code and message for an error sending a request
+// to the URL. Timeouts, refused connections, DNS failures and cancellations are identified
+// by error type; anything else is a bad request.
+func classifyRequestError(URL string, err error) (int, string) {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusRequestTimeout, fmt.Sprintf("%s timed out", URL)
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, fmt.Sprintf("request to %s was canceled", URL)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return http.StatusServiceUnavailable, fmt.Sprintf("%s refused connection", URL)
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, fmt.Sprintf("%s could not be resolved", URL)
+	}
+	return http.StatusBadRequest, err.Error()
+}
+
+// readResponseBody reads a response body, decompressing it if it is gzip encoded
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") == false {
+		return io.ReadAll(resp.Body)
+	}
+	gzReader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer gzReader.Close()
+	return io.ReadAll(gzReader)
+}
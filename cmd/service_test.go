@@ -0,0 +1,1428 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/uvalib/virgo4-api/v4api"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+// TestMain runs the tests from the repository root so InitializeService finds the
+// i18n, config and assets directories the same way the deployed service does
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		log.Fatalf("unable to change to the repository root: %s", err.Error())
+	}
+	gin.SetMode(gin.TestMode)
+	if os.Getenv("TEST_LOG") == "" {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// mockWorldCat is a WorldCat SRU and OCLC token server. Each handler can be replaced
+// by a test; the default handlers return sruRecords and a token that expires in an hour.
+// Requests to each endpoint are counted.
+type mockWorldCat struct {
+	server     *httptest.Server
+	sruRecords []string
+	onSearch   http.HandlerFunc
+	onContent  http.HandlerFunc
+	onToken    http.HandlerFunc
+	onHoldings http.HandlerFunc
+	searches   atomic.Int32
+	contents   atomic.Int32
+	tokens     atomic.Int32
+}
+
+// newMockWorldCat starts a mock WorldCat server that is closed when the test finishes
+func newMockWorldCat(t *testing.T) *mockWorldCat {
+	mock := &mockWorldCat{sruRecords: []string{"1001", "1002", "1003"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search/worldcat/sru", func(w http.ResponseWriter, r *http.Request) {
+		mock.searches.Add(1)
+		if mock.onSearch != nil {
+			mock.onSearch(w, r)
+			return
+		}
+		fmt.Fprint(w, sruResponse(len(mock.sruRecords), mock.sruRecords...))
+	})
+	mux.HandleFunc("/content/", func(w http.ResponseWriter, r *http.Request) {
+		mock.contents.Add(1)
+		if mock.onContent != nil {
+			mock.onContent(w, r)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/content/")
+		fmt.Fprint(w, dcRecord(id))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		mock.tokens.Add(1)
+		if mock.onToken != nil {
+			mock.onToken(w, r)
+			return
+		}
+		fmt.Fprint(w, tokenResponse(time.Hour))
+	})
+	mux.HandleFunc("/holdings", func(w http.ResponseWriter, r *http.Request) {
+		if mock.onHoldings != nil {
+			mock.onHoldings(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"numberOfRecords":0}`)
+	})
+	mux.HandleFunc("/metadata/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"generalFormat":"Book","specificFormat":"Digital"}`)
+	})
+	mock.server = httptest.NewServer(mux)
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+// dcRecord returns a Dublin Core record for a WorldCat resource
+func dcRecord(id string) string {
+	return fmt.Sprintf("<oclcdcs><recordIdentifier>%s</recordIdentifier><title>Title %s</title>"+
+		"<creator>Author %s</creator><date>2001</date></oclcdcs>", id, id, id)
+}
+
+// sruResponse returns an SRU search response with a total count and a record for each id
+func sruResponse(count int, ids ...string) string {
+	records := make([]string, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, dcRecord(id))
+	}
+	return sruRecordsResponse(count, records...)
+}
+
+// sruRecordsResponse returns an SRU search response with a total count and the Dublin Core records
+func sruRecordsResponse(count int, dcRecords ...string) string {
+	var records strings.Builder
+	for _, rec := range dcRecords {
+		fmt.Fprintf(&records, "<record><recordData>%s</recordData></record>", rec)
+	}
+	return fmt.Sprintf("<searchRetrieveResponse><numberOfRecords>%d</numberOfRecords><records>%s</records></searchRetrieveResponse>",
+		count, records.String())
+}
+
+// tokenResponse returns an OCLC auth token response for a token that expires after ttl
+func tokenResponse(ttl time.Duration) string {
+	return fmt.Sprintf(`{"access_token":"tok","expires_at":"%s"}`, time.Now().Add(ttl).UTC().Format("2006-01-02 15:04:05Z"))
+}
+
+// testConfig returns a service configuration that uses the mock server for all WorldCat and
+// OCLC requests. OCLC is not configured; tests that need it set the key and secret.
+func testConfig(mock *mockWorldCat) *ServiceConfig {
+	return &ServiceConfig{WCAPI: mock.server.URL, WCKey: "wckey", JWTKey: "jwtkey", APIKey: "apikey",
+		OCLCAuthURL: mock.server.URL + "/token", OCLCMetadataAPI: mock.server.URL + "/metadata",
+		OCLCHoldingsAPI: mock.server.URL + "/holdings",
+		DefaultRows:     20, MaxOffset: 1000, BatchMax: 5, MaxBodySize: 10000, RateBurst: 1,
+		ProvidersFile: "config/providers.toml", AssetsDir: "assets", UserAgent: "virgo4-test",
+		DefaultSort: "SortRelevance", DefaultSortOrder: "desc", RecordSchema: "dc",
+		MinTermLength: 3, IdentifierRelation: "=", CacheTTL: 10, CacheMaxEntries: 100}
+}
+
+// newTestService creates a service that sends all requests to the mock server using a
+// client with the timeout
+func newTestService(t *testing.T, cfg *ServiceConfig, timeout time.Duration) *ServiceContext {
+	svc, err := InitializeService("test", cfg, &http.Client{Timeout: timeout})
+	if err != nil {
+		t.Fatalf("unable to initialize service: %s", err.Error())
+	}
+	return svc
+}
+
+// newTestRouter returns a router with the search and resource endpoints. Authentication
+// is not done so the handlers can be called directly.
+func newTestRouter(svc *ServiceContext) *gin.Engine {
+	router := gin.New()
+	router.POST("/api/search", svc.search)
+	router.GET("/api/resource/:id", svc.getResource)
+	router.POST("/api/resource", svc.batchResource)
+	return router
+}
+
+// newServiceRouter returns a router with all of the service routes and authentication,
+// set up the same way as main does
+func newServiceRouter(svc *ServiceContext, pprof bool) *gin.Engine {
+	router := gin.New()
+	router.Use(requestIDMiddleware)
+	svc.addRoutes(router, pprof)
+	return router
+}
+
+// mintToken returns a JWT for a user with the role that expires after ttl. A negative ttl
+// returns an expired token.
+func mintToken(t *testing.T, svc *ServiceContext, role v4jwt.RoleEnum, ttl time.Duration) string {
+	token, err := v4jwt.Mint(v4jwt.V4Claims{UserID: "tuser", Role: role}, ttl, svc.JWTKey)
+	if err != nil {
+		t.Fatalf("unable to mint token: %s", err.Error())
+	}
+	return token
+}
+
+// bearer returns the headers to authenticate with the token
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// doRequest sends a request to the router and returns the recorded response. A body that is
+// not nil is sent as JSON.
+func doRequest(router http.Handler, method string, path string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		payload, _ := json.Marshal(body)
+		reader = bytes.NewReader(payload)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, val := range headers {
+		req.Header.Set(name, val)
+	}
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	return resp
+}
+
+// postJSON sends the body as JSON to the router and returns the recorded response
+func postJSON(router http.Handler, path string, body interface{}) *httptest.ResponseRecorder {
+	return doRequest(router, http.MethodPost, path, body, nil)
+}
+
+// searchResult is the part of a search response checked by the tests
+type searchResult struct {
+	StatusCode    int    `json:"status_code"`
+	StatusMessage string `json:"status_msg"`
+	Confidence    string `json:"confidence"`
+	Pagination    struct {
+		Start int `json:"start"`
+		Rows  int `json:"rows"`
+		Total int `json:"total"`
+	} `json:"pagination"`
+	Groups []struct {
+		Value   string `json:"value"`
+		Count   int    `json:"count"`
+		Records []struct {
+			Fields []struct {
+				Name     string `json:"name"`
+				Value    string `json:"value"`
+				Provider string `json:"provider"`
+			} `json:"fields"`
+		} `json:"record_list"`
+	} `json:"group_list"`
+	Warnings []string               `json:"warnings"`
+	Debug    map[string]interface{} `json:"debug"`
+}
+
+// searchUpstream sends the search request to a new service using the configuration and
+// returns the response and the query params of the WorldCat search it made, if any
+func searchUpstream(t *testing.T, mock *mockWorldCat, cfg *ServiceConfig, body interface{}) (*httptest.ResponseRecorder, url.Values) {
+	var params url.Values
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		params = r.URL.Query()
+		fmt.Fprint(w, sruResponse(len(mock.sruRecords), mock.sruRecords...))
+	}
+	svc := newTestService(t, cfg, 5*time.Second)
+	resp := postJSON(newTestRouter(svc), "/api/search", body)
+	return resp, params
+}
+
+// fieldProviders returns the providers of the named field in the first record of a group
+func (r *searchResult) fieldProviders(group int, name string) []string {
+	provs := make([]string, 0)
+	if group >= len(r.Groups) || len(r.Groups[group].Records) == 0 {
+		return provs
+	}
+	for _, f := range r.Groups[group].Records[0].Fields {
+		if f.Name == name {
+			provs = append(provs, f.Provider)
+		}
+	}
+	return provs
+}
+
+// fieldValues returns the values of the named field in the first record of a group
+func (r *searchResult) fieldValues(group int, name string) []string {
+	vals := make([]string, 0)
+	if group >= len(r.Groups) || len(r.Groups[group].Records) == 0 {
+		return vals
+	}
+	for _, f := range r.Groups[group].Records[0].Fields {
+		if f.Name == name {
+			vals = append(vals, f.Value)
+		}
+	}
+	return vals
+}
+
+func parseSearchResult(t *testing.T, resp *httptest.ResponseRecorder) searchResult {
+	var result searchResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unable to parse search response %s: %s", resp.Body.String(), err.Error())
+	}
+	return result
+}
+
+func TestSearchSuccess(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var sruQuery string
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		sruQuery = r.URL.Query().Get("query")
+		fmt.Fprint(w, sruResponse(42, mock.sruRecords...))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	resp := postJSON(newTestRouter(svc), "/api/search",
+		map[string]interface{}{"query": "title: {calico cats}", "pagination": map[string]int{"start": 0, "rows": 3}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	result := parseSearchResult(t, resp)
+	if len(result.Groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(result.Groups))
+	}
+	for idx, id := range mock.sruRecords {
+		if result.Groups[idx].Value != id {
+			t.Errorf("expected group %d to be %s, got %s", idx, id, result.Groups[idx].Value)
+		}
+	}
+	if result.Pagination.Total != 42 || result.Pagination.Rows != 3 {
+		t.Errorf("expected total 42 and rows 3, got %+v", result.Pagination)
+	}
+	if strings.Contains(sruQuery, "srw.ti all calico cats") == false || strings.Contains(sruQuery, "NOT srw.li = VA@") == false {
+		t.Errorf("unexpected SRU query %s", sruQuery)
+	}
+}
+
+func TestSearchUpstreamErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstream   int
+		expected   int
+		retryAfter string
+	}{
+		{name: "bad request", upstream: http.StatusBadRequest, expected: http.StatusBadRequest},
+		{name: "forbidden", upstream: http.StatusForbidden, expected: http.StatusForbidden},
+		{name: "too many requests", upstream: http.StatusTooManyRequests, expected: http.StatusTooManyRequests, retryAfter: "30"},
+		{name: "server error", upstream: http.StatusInternalServerError, expected: http.StatusBadGateway},
+		{name: "bad gateway", upstream: http.StatusBadGateway, expected: http.StatusBadGateway},
+		{name: "unavailable", upstream: http.StatusServiceUnavailable, expected: http.StatusServiceUnavailable, retryAfter: "60"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.upstream)
+				fmt.Fprint(w, "upstream failure details")
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+			if resp.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+			if got := resp.Header().Get("Retry-After"); got != tc.retryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tc.retryAfter, got)
+			}
+			if strings.Contains(resp.Body.String(), "upstream failure details") {
+				t.Errorf("upstream body was returned to the client: %s", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchTimeout(t *testing.T) {
+	mock := newMockWorldCat(t)
+	release := make(chan struct{})
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	// unblock the handler before the server is closed
+	t.Cleanup(func() { close(release) })
+	svc := newTestService(t, testConfig(mock), 100*time.Millisecond)
+
+	resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+	if resp.Code != http.StatusRequestTimeout {
+		t.Fatalf("expected status 408, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+// oclcTestConfig returns a test configuration with OCLC configured to use the mock server.
+// The token is requested by the first lookup that needs it.
+func oclcTestConfig(mock *mockWorldCat) *ServiceConfig {
+	cfg := testConfig(mock)
+	cfg.OCLCKey = "oclckey"
+	cfg.OCLCSecret = "oclcsecret"
+	return cfg
+}
+
+func TestConcurrentOCLCRefresh(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onToken = func(w http.ResponseWriter, r *http.Request) {
+		// hold the request open so the other callers arrive while it is in flight
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, tokenResponse(time.Hour))
+	}
+	svc := newTestService(t, oclcTestConfig(mock), 5*time.Second)
+
+	const callers = 20
+	errs := make(chan error, callers)
+	tokens := make(chan string, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- svc.refreshOCLCAuth()
+			tokens <- svc.OCLC.getToken()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(tokens)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected refresh error: %s", err.Error())
+		}
+	}
+	for token := range tokens {
+		if token != "tok" {
+			t.Errorf("expected every caller to see the new token, got %q", token)
+		}
+	}
+	if got := mock.tokens.Load(); got != 1 {
+		t.Errorf("expected 1 token request, got %d", got)
+	}
+}
+
+func TestBackgroundOCLCRefresh(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onToken = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, tokenResponse(2*time.Second))
+	}
+	cfg := oclcTestConfig(mock)
+	cfg.OCLCRefresh = true
+	svc := newTestService(t, cfg, 5*time.Second)
+
+	// the first token is requested right away and renewed again before it expires
+	deadline := time.Now().Add(5 * time.Second)
+	for mock.tokens.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := mock.tokens.Load(); got < 2 {
+		t.Fatalf("expected the background refresh to renew the token, got %d token requests", got)
+	}
+	if svc.OCLC.getToken() != "tok" || time.Until(svc.OCLC.getExpires()) <= 0 {
+		t.Errorf("expected an unexpired token after the background refresh, got %q expiring %s",
+			svc.OCLC.getToken(), svc.OCLC.getExpires())
+	}
+}
+
+func TestOCLCRefreshDelay(t *testing.T) {
+	tests := []struct {
+		remaining time.Duration
+		expected  time.Duration
+	}{
+		{remaining: 10 * time.Second, expected: 9 * time.Second},
+		{remaining: 5 * time.Minute, expected: 270 * time.Second},
+		{remaining: time.Hour, expected: 59 * time.Minute},
+	}
+	for _, tc := range tests {
+		if got := oclcRefreshDelay(tc.remaining); got != tc.expected {
+			t.Errorf("expected a token expiring in %s to be renewed after %s, got %s", tc.remaining, tc.expected, got)
+		}
+	}
+}
+
+func TestConcurrentResourceLookupsShareOCLCToken(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, oclcTestConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/resource/%d", 1000+id), nil)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, req)
+			if resp.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.Contains(resp.Body.String(), "general_format") == false {
+				t.Errorf("expected the general format in %s", resp.Body.String())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := mock.tokens.Load(); got != 1 {
+		t.Errorf("expected 1 token request, got %d", got)
+	}
+}
+
+func TestAPIGetRateLimit(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var arrivalMutex sync.Mutex
+	arrivals := make([]time.Time, 0)
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		arrivalMutex.Lock()
+		arrivals = append(arrivals, time.Now())
+		arrivalMutex.Unlock()
+		fmt.Fprint(w, dcRecord("1001"))
+	}
+	cfg := testConfig(mock)
+	cfg.RateLimit = 20
+	svc := newTestService(t, cfg, 5*time.Second)
+
+	const calls = 10
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.apiGet(mock.server.URL+"/content/1001", ""); err != nil {
+				t.Errorf("unexpected error: %s", err.Message)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(arrivals) != calls {
+		t.Fatalf("expected %d requests, got %d", calls, len(arrivals))
+	}
+	sort.Slice(arrivals, func(i, j int) bool { return arrivals[i].Before(arrivals[j]) })
+	// 20 per second is one request every 50ms. Each request is checked against the first since
+	// the gap between two requests can be shortened by delays in sending the earlier one.
+	for i := 1; i < calls; i++ {
+		minElapsed := time.Duration(i)*50*time.Millisecond - 30*time.Millisecond
+		if elapsed := arrivals[i].Sub(arrivals[0]); elapsed < minElapsed {
+			t.Errorf("request %d was only %s after the first", i, elapsed)
+		}
+	}
+	if total := arrivals[calls-1].Sub(arrivals[0]); total < 400*time.Millisecond {
+		t.Errorf("expected %d requests to take at least 400ms, took %s", calls, total)
+	}
+}
+
+func TestAPIGetRateLimitDeadline(t *testing.T) {
+	mock := newMockWorldCat(t)
+	cfg := testConfig(mock)
+	cfg.RateLimit = 1
+	svc := newTestService(t, cfg, 100*time.Millisecond)
+
+	if _, err := svc.apiGet(mock.server.URL+"/content/1001", ""); err != nil {
+		t.Fatalf("unexpected error: %s", err.Message)
+	}
+	// the next request is not allowed for a second, which is beyond the client timeout
+	start := time.Now()
+	_, err := svc.apiGet(mock.server.URL+"/content/1001", "")
+	if err == nil || err.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 error, got %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the request to fail without waiting, waited %s", elapsed)
+	}
+	if got := mock.contents.Load(); got != 1 {
+		t.Errorf("expected 1 upstream request, got %d", got)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	type hcEntry struct {
+		Healthy bool   `json:"healthy"`
+		Message string `json:"message"`
+		Expires string `json:"expires"`
+	}
+	tests := []struct {
+		name         string
+		oclc         bool
+		searchStatus int
+		tokenStatus  int
+		healthy      bool
+		worldcat     bool
+		auth         bool
+	}{
+		{name: "healthy", oclc: true, healthy: true, worldcat: true, auth: true},
+		{name: "search down", oclc: true, searchStatus: http.StatusServiceUnavailable, worldcat: false, auth: true},
+		{name: "token request fails", oclc: true, tokenStatus: http.StatusUnauthorized, worldcat: true, auth: false},
+		{name: "oclc not configured", healthy: true, worldcat: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			var pingQuery, pingSchema string
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				pingQuery, pingSchema = r.URL.Query().Get("query"), r.URL.Query().Get("recordSchema")
+				if tc.searchStatus != 0 {
+					w.WriteHeader(tc.searchStatus)
+					return
+				}
+				fmt.Fprint(w, sruResponse(1, "1001"))
+			}
+			mock.onToken = func(w http.ResponseWriter, r *http.Request) {
+				if tc.tokenStatus != 0 {
+					w.WriteHeader(tc.tokenStatus)
+					return
+				}
+				fmt.Fprint(w, tokenResponse(time.Hour))
+			}
+			cfg := testConfig(mock)
+			if tc.oclc {
+				cfg = oclcTestConfig(mock)
+			}
+			svc := newTestService(t, cfg, 5*time.Second)
+
+			resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/healthcheck", nil, nil)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			var hc struct {
+				Healthy  bool     `json:"healthy"`
+				WorldCat hcEntry  `json:"worldcat_api"`
+				Auth     *hcEntry `json:"oclc_auth"`
+			}
+			if err := json.Unmarshal(resp.Body.Bytes(), &hc); err != nil {
+				t.Fatalf("unable to parse healthcheck %s: %s", resp.Body.String(), err.Error())
+			}
+			if hc.Healthy != tc.healthy || hc.WorldCat.Healthy != tc.worldcat {
+				t.Errorf("unexpected healthcheck %s", resp.Body.String())
+			}
+			if pingQuery != "srw.no = "+healthCheckOCLCNumber || pingSchema != "dc" {
+				t.Errorf("unexpected ping query %s with schema %s", pingQuery, pingSchema)
+			}
+			if tc.oclc == false {
+				if hc.Auth != nil || mock.tokens.Load() != 0 {
+					t.Errorf("expected no OCLC auth check, got %s", resp.Body.String())
+				}
+				return
+			}
+			if hc.Auth == nil || hc.Auth.Healthy != tc.auth {
+				t.Fatalf("unexpected OCLC auth check %s", resp.Body.String())
+			}
+			if tc.auth && hc.Auth.Expires == "" {
+				t.Errorf("expected the token expiry in %s", resp.Body.String())
+			}
+			if tc.auth == false && strings.HasPrefix(hc.Auth.Message, "unable to obtain an OCLC auth token") == false {
+				t.Errorf("unexpected OCLC auth message %s", hc.Auth.Message)
+			}
+		})
+	}
+}
+
+func TestHealthCheckTokenInterval(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var fail atomic.Bool
+	mock.onToken = func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, tokenResponse(time.Hour))
+	}
+	svc := newTestService(t, oclcTestConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	// a token that is still valid is requested again to prove the OCLC auth service is up
+	if err := svc.refreshOCLCAuth(); err != nil {
+		t.Fatalf("unexpected refresh error: %s", err.Error())
+	}
+	doRequest(router, http.MethodGet, "/healthcheck", nil, nil)
+	if got := mock.tokens.Load(); got != 2 {
+		t.Fatalf("expected the healthcheck to request a token, got %d requests", got)
+	}
+
+	// within the interval the last result is reported without another request
+	fail.Store(true)
+	resp := doRequest(router, http.MethodGet, "/healthcheck", nil, nil)
+	if got := mock.tokens.Load(); got != 2 || strings.Contains(resp.Body.String(), `"healthy":false`) {
+		t.Errorf("expected the last healthy result without a request, got %d requests: %s", got, resp.Body.String())
+	}
+
+	// after the interval a failed request is reported, and lookups keep the current token
+	svc.OCLC.mutex.Lock()
+	svc.OCLC.checked = time.Now().Add(-oclcHealthInterval)
+	svc.OCLC.mutex.Unlock()
+	resp = doRequest(router, http.MethodGet, "/healthcheck", nil, nil)
+	if got := mock.tokens.Load(); got != 3 || strings.Contains(resp.Body.String(), `"healthy":false`) == false {
+		t.Errorf("expected an unhealthy result after a new request, got %d requests: %s", got, resp.Body.String())
+	}
+	if svc.OCLC.getToken() != "tok" {
+		t.Errorf("expected the current token to be kept after a failed check")
+	}
+}
+
+func TestLivenessAndReadiness(t *testing.T) {
+	mock := newMockWorldCat(t)
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseToken := func() { releaseOnce.Do(func() { close(release) }) }
+	mock.onToken = func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, tokenResponse(time.Hour))
+	}
+	t.Cleanup(releaseToken)
+	cfg := oclcTestConfig(mock)
+	cfg.OCLCPrewarm = true
+	svc := newTestService(t, cfg, 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	// while the initial token is being obtained the service is alive but not ready
+	if resp := doRequest(router, http.MethodGet, "/healthz", nil, nil); resp.Code != http.StatusOK {
+		t.Errorf("expected liveness status 200 during startup, got %d", resp.Code)
+	}
+	if resp := doRequest(router, http.MethodGet, "/healthcheck", nil, nil); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness status 503 during startup, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	releaseToken()
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.OCLC.Ready.Load() == false && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := doRequest(router, http.MethodGet, "/healthz", nil, nil); resp.Code != http.StatusOK {
+		t.Errorf("expected liveness status 200 once ready, got %d", resp.Code)
+	}
+	if resp := doRequest(router, http.MethodGet, "/healthcheck", nil, nil); resp.Code != http.StatusOK {
+		t.Errorf("expected readiness status 200 once ready, got %d: %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestIdentifyItemMessage(t *testing.T) {
+	tests := []struct {
+		language string
+		expected string
+	}{
+		{language: "en-US", expected: "This resource is not held by the UVA Library."},
+		{language: "es", expected: "Este recurso no forma parte de la colección de la Biblioteca de UVA."},
+		{language: "de", expected: "This resource is not held by the UVA Library."},
+	}
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	for _, tc := range tests {
+		t.Run(tc.language, func(t *testing.T) {
+			resp := doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": tc.language})
+			var identity v4api.PoolIdentity
+			if err := json.Unmarshal(resp.Body.Bytes(), &identity); err != nil {
+				t.Fatalf("unable to parse identity %s: %s", resp.Body.String(), err.Error())
+			}
+			message := ""
+			for _, attr := range identity.Attributes {
+				if attr.Name == "item_message" {
+					message = attr.Value
+				}
+			}
+			if strings.HasPrefix(message, tc.expected) == false {
+				t.Errorf("expected item_message starting %q, got %q", tc.expected, message)
+			}
+		})
+	}
+}
+
+func TestLoadLocalizations(t *testing.T) {
+	i18nDir := t.TempDir()
+	for lang, name := range map[string]string{"en": "WorldCat", "de": "WorldCat auf Deutsch"} {
+		msgs := fmt.Sprintf("[PoolName]\nother = %q\n", name)
+		if err := os.WriteFile(filepath.Join(i18nDir, "active."+lang+".toml"), []byte(msgs), 0644); err != nil {
+			t.Fatalf("unable to write messages: %s", err.Error())
+		}
+	}
+	if err := os.WriteFile(filepath.Join(i18nDir, "translate.fr.toml"), []byte("[PoolName]\nother = \"x\"\n"), 0644); err != nil {
+		t.Fatalf("unable to write messages: %s", err.Error())
+	}
+
+	bundle, err := loadLocalizations(i18nDir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	tags := make([]string, 0)
+	for _, tag := range bundle.LanguageTags() {
+		tags = append(tags, tag.String())
+	}
+	sort.Strings(tags)
+	if reflect.DeepEqual(tags, []string{"de", "en"}) == false {
+		t.Errorf("expected languages de and en, got %v", tags)
+	}
+	name := i18n.NewLocalizer(bundle, "de").MustLocalize(&i18n.LocalizeConfig{MessageID: "PoolName"})
+	if name != "WorldCat auf Deutsch" {
+		t.Errorf("expected the German pool name, got %s", name)
+	}
+
+	if _, err := loadLocalizations(filepath.Join(i18nDir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+	if _, err := loadLocalizations(t.TempDir()); err == nil {
+		t.Errorf("expected an error for a directory without message files")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		role     v4jwt.RoleEnum
+		expected int
+	}{
+		{role: v4jwt.Guest, expected: http.StatusForbidden},
+		{role: v4jwt.User, expected: http.StatusOK},
+		{role: v4jwt.Admin, expected: http.StatusOK},
+	}
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	for _, tc := range tests {
+		t.Run(tc.role.String(), func(t *testing.T) {
+			resp := doRequest(router, http.MethodPost, "/api/resource", []string{"1001"}, bearer(mintToken(t, svc, tc.role, time.Hour)))
+			if resp.Code != tc.expected {
+				t.Errorf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+		})
+	}
+
+	resp := doRequest(router, http.MethodPost, "/api/resource", []string{"1001"}, nil)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without a token, got %d", resp.Code)
+	}
+}
+
+func TestAuthTokenErrors(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	badSignature, err := v4jwt.Mint(v4jwt.V4Claims{UserID: "tuser", Role: v4jwt.User}, time.Hour, "otherkey")
+	if err != nil {
+		t.Fatalf("unable to mint token: %s", err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		reason string
+	}{
+		{name: "expired", token: mintToken(t, svc, v4jwt.User, -time.Hour), reason: "token_expired"},
+		{name: "bad signature", token: badSignature, reason: "token_invalid"},
+		{name: "malformed", token: "not.a.jwt", reason: "token_invalid"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}, bearer(tc.token))
+			if resp.Code != http.StatusUnauthorized {
+				t.Fatalf("expected status 401, got %d: %s", resp.Code, resp.Body.String())
+			}
+			var body struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(resp.Body.Bytes(), &body)
+			if body.Message != tc.reason {
+				t.Errorf("expected message %s, got %s", tc.reason, body.Message)
+			}
+			expected := fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, tc.reason)
+			if resp.Header().Get("WWW-Authenticate") != expected {
+				t.Errorf("expected WWW-Authenticate %s, got %s", expected, resp.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+	if mock.searches.Load() != 0 {
+		t.Errorf("expected no WorldCat searches, got %d", mock.searches.Load())
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected int
+	}{
+		{name: "valid key", headers: map[string]string{"X-Api-Key": "apikey"}, expected: http.StatusOK},
+		{name: "invalid key", headers: map[string]string{"X-Api-Key": "wrongkey"}, expected: http.StatusUnauthorized},
+		{name: "jwt fallback", expected: http.StatusOK},
+		{name: "neither", headers: map[string]string{}, expected: http.StatusUnauthorized},
+	}
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := tc.headers
+			if headers == nil {
+				headers = bearer(mintToken(t, svc, v4jwt.User, time.Hour))
+			}
+			resp := doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}, headers)
+			if resp.Code != tc.expected {
+				t.Errorf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestIdentifyETag(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	first := doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": "es"})
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag != fmt.Sprintf(`"%s-es"`, svc.Version) {
+		t.Fatalf("expected status 200 with a version and locale ETag, got %d with %s", first.Code, etag)
+	}
+
+	second := doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": "es", "If-None-Match": etag})
+	if second.Code != http.StatusNotModified || second.Body.Len() != 0 {
+		t.Errorf("expected status 304 with no body, got %d: %s", second.Code, second.Body.String())
+	}
+
+	// the ETag for another locale does not match
+	english := doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": "en", "If-None-Match": etag})
+	if english.Code != http.StatusOK || english.Header().Get("ETag") == etag {
+		t.Errorf("expected status 200 with a different ETag, got %d with %s", english.Code, english.Header().Get("ETag"))
+	}
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		body    interface{}
+		message string
+	}{
+		{name: "oversize search", path: "/api/search", body: map[string]interface{}{"query": "keyword: {" + strings.Repeat("cats ", 3000) + "}"},
+			message: "request body exceeds the maximum of 10000 bytes"},
+		{name: "oversize facets", path: "/api/search/facets", body: map[string]interface{}{"query": "keyword: {" + strings.Repeat("cats ", 3000) + "}"},
+			message: "request body exceeds the maximum of 10000 bytes"},
+		{name: "unknown field", path: "/api/search", body: map[string]interface{}{"query": "keyword: {cats}", "colour": "blue"},
+			message: `invalid request: json: unknown field \"colour\"`},
+		{name: "batch unknown type", path: "/api/resource", body: map[string]interface{}{"ids": []string{"1001"}},
+			message: "invalid request: json: cannot unmarshal object"},
+	}
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := doRequest(router, http.MethodPost, tc.path, tc.body, map[string]string{"X-Api-Key": "apikey"})
+			if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.message) == false {
+				t.Errorf("expected status 400 with %s, got %d: %s", tc.message, resp.Code, resp.Body.String())
+			}
+		})
+	}
+
+	// trailing data after the JSON body is rejected
+	req := httptest.NewRequest(http.MethodPost, "/api/search", strings.NewReader(`{"query": "keyword: {cats}"} {"query": "x"}`))
+	req.Header.Set("X-Api-Key", "apikey")
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), "unexpected data after JSON body") == false {
+		t.Errorf("expected status 400 for trailing data, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if mock.searches.Load() != 0 {
+		t.Errorf("expected no WorldCat searches, got %d", mock.searches.Load())
+	}
+}
+
+func TestOCLCPrewarm(t *testing.T) {
+	mock := newMockWorldCat(t)
+	cfg := oclcTestConfig(mock)
+	cfg.OCLCPrewarm = true
+	svc := newTestService(t, cfg, 5*time.Second)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for svc.OCLC.Ready.Load() == false && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if svc.OCLC.Ready.Load() == false {
+		t.Fatalf("expected the service to be ready after the token was pre-warmed")
+	}
+	svc.OCLC.mutex.Lock()
+	token := svc.OCLC.Token
+	svc.OCLC.mutex.Unlock()
+	if token != "tok" || mock.tokens.Load() != 1 {
+		t.Errorf("expected the pre-warmed token from 1 request, got %q from %d", token, mock.tokens.Load())
+	}
+
+	// the first lookup uses the pre-warmed token
+	resp := doRequest(newTestRouter(svc), http.MethodGet, "/api/resource/1001", nil, nil)
+	if resp.Code != http.StatusOK || mock.tokens.Load() != 1 {
+		t.Errorf("expected status 200 without another token request, got %d and %d requests", resp.Code, mock.tokens.Load())
+	}
+
+	// without pre-warming no token is requested at startup
+	unwarmed := newMockWorldCat(t)
+	svc = newTestService(t, oclcTestConfig(unwarmed), 5*time.Second)
+	if svc.OCLC.Ready.Load() == false || unwarmed.tokens.Load() != 0 {
+		t.Errorf("expected the service to be ready with no token requests, got %d", unwarmed.tokens.Load())
+	}
+}
+
+func TestJSONErrorResponses(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     interface{}
+		expected int
+	}{
+		{name: "malformed search", method: http.MethodPost, path: "/api/search", body: map[string]interface{}{"query": "keyword {cats"},
+			expected: http.StatusBadRequest},
+		{name: "upstream failure", method: http.MethodGet, path: "/api/resource/1001", expected: http.StatusBadGateway},
+		{name: "no auth", method: http.MethodPost, path: "/api/search/facets", body: map[string]interface{}{"query": "keyword: {cats}"},
+			expected: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{"X-Request-Id": "req-" + strings.ReplaceAll(tc.name, " ", "-")}
+			if tc.expected != http.StatusUnauthorized {
+				headers["X-Api-Key"] = "apikey"
+			}
+			resp := doRequest(router, tc.method, tc.path, tc.body, headers)
+			if resp.Code != tc.expected || strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json") == false {
+				t.Fatalf("expected JSON with status %d, got %d %s: %s", tc.expected, resp.Code, resp.Header().Get("Content-Type"), resp.Body.String())
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unable to parse error %s: %s", resp.Body.String(), err.Error())
+			}
+			if body["status"] != float64(tc.expected) || body["request_id"] != headers["X-Request-Id"] || body["message"] == "" || len(body) != 3 {
+				t.Errorf("unexpected error response %v", body)
+			}
+		})
+	}
+}
+
+func TestAPIGetGzip(t *testing.T) {
+	for _, compressed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("gzip %t", compressed), func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			acceptEncoding := ""
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				acceptEncoding = r.Header.Get("Accept-Encoding")
+				body := sruResponse(1, "1001")
+				if compressed == false {
+					fmt.Fprint(w, body)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gzWriter := gzip.NewWriter(w)
+				fmt.Fprint(gzWriter, body)
+				gzWriter.Close()
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+			var result searchResult
+			json.Unmarshal(resp.Body.Bytes(), &result)
+			if resp.Code != http.StatusOK || result.Pagination.Total != 1 {
+				t.Fatalf("expected one result, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if titles := result.fieldValues(0, "title"); reflect.DeepEqual(titles, []string{"Title 1001"}) == false {
+				t.Errorf("expected the decoded title, got %v", titles)
+			}
+			if acceptEncoding != "gzip" {
+				t.Errorf("expected gzip to be requested, got %q", acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+	headers := map[string]string{"X-Api-Key": "apikey"}
+
+	doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}, headers)
+	doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {dogs}"}, headers)
+	doRequest(router, http.MethodGet, "/api/resource/1001", nil, headers)
+
+	resp := doRequest(router, http.MethodGet, "/stats", nil, nil)
+	var stats map[string]float64
+	if err := json.Unmarshal(resp.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("unable to parse stats %s: %s", resp.Body.String(), err.Error())
+	}
+	expected := map[string]float64{"searches": 2, "resource_lookups": 1, "worldcat_errors": 1, "oclc_token_refreshes": 0}
+	for name, count := range expected {
+		if stats[name] != count {
+			t.Errorf("expected %s to be %v, got %v", name, count, stats[name])
+		}
+	}
+	if _, ok := stats["average_search_ms"]; ok == false {
+		t.Errorf("expected average search time in %s", resp.Body.String())
+	}
+	if _, ok := stats["uptime_seconds"]; ok == false {
+		t.Errorf("expected uptime in %s", resp.Body.String())
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-maxidle", "50", "-maxidleperhost", "10", "-idletimeout", "30"})
+	if err != nil {
+		t.Fatalf("unable to parse config: %s", err.Error())
+	}
+	transport := newHTTPTransport(cfg)
+	if transport.MaxIdleConns != 50 || transport.MaxIdleConnsPerHost != 10 || transport.IdleConnTimeout != 30*time.Second {
+		t.Errorf("expected idle connections 50, 10 per host with a 30s timeout, got %d, %d and %s",
+			transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+	if transport.ForceAttemptHTTP2 == false {
+		t.Errorf("expected HTTP/2 to be enabled")
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxAge   [2]int
+		auth     bool
+		expected [2]string
+	}{
+		{name: "public", maxAge: [2]int{30, 600}, expected: [2]string{"public, max-age=30", "public, max-age=600"}},
+		{name: "authenticated", maxAge: [2]int{30, 600}, auth: true, expected: [2]string{"private, max-age=30", "private, max-age=600"}},
+		{name: "disabled", maxAge: [2]int{0, 0}, auth: true, expected: [2]string{"no-store", "no-store"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.SearchMaxAge, cfg.ResourceMaxAge = tc.maxAge[0], tc.maxAge[1]
+			svc := newTestService(t, cfg, 5*time.Second)
+			router := newTestRouter(svc)
+			var headers map[string]string
+			if tc.auth {
+				router = newServiceRouter(svc, false)
+				headers = map[string]string{"X-Api-Key": "apikey"}
+			}
+
+			search := doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}, headers)
+			resource := doRequest(router, http.MethodGet, "/api/resource/1001", nil, headers)
+			got := [2]string{search.Header().Get("Cache-Control"), resource.Header().Get("Cache-Control")}
+			if got != tc.expected {
+				t.Errorf("expected search and resource Cache-Control %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestInitializeServiceErrors(t *testing.T) {
+	mock := newMockWorldCat(t)
+	cfg := testConfig(mock)
+	cfg.ProvidersFile = "config/missing.toml"
+	if _, err := InitializeService("test", cfg, http.DefaultClient); err == nil || strings.Contains(err.Error(), "config/missing.toml") == false {
+		t.Errorf("expected an error naming the missing providers file, got %v", err)
+	}
+
+	// the localization files are loaded from ./i18n; a directory without them is an error
+	cfg = testConfig(mock)
+	cfg.ProvidersFile, _ = filepath.Abs(cfg.ProvidersFile)
+	cfg.AssetsDir, _ = filepath.Abs(cfg.AssetsDir)
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("unable to change directory: %s", err.Error())
+	}
+	defer os.Chdir(wd)
+	if _, err := InitializeService("test", cfg, http.DefaultClient); err == nil || strings.Contains(err.Error(), "i18n") == false {
+		t.Errorf("expected an error naming the missing i18n directory, got %v", err)
+	}
+}
+
+// timeoutError is a net.Error that reports a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyRequestError(t *testing.T) {
+	wrap := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://wc.test/sru", Err: err}
+	}
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+		msg      string
+	}{
+		{name: "timeout", err: wrap(timeoutError{}), expected: http.StatusRequestTimeout, msg: "http://wc.test/sru timed out"},
+		{name: "deadline", err: wrap(context.DeadlineExceeded), expected: http.StatusRequestTimeout, msg: "http://wc.test/sru timed out"},
+		{name: "canceled", err: wrap(context.Canceled), expected: http.StatusServiceUnavailable, msg: "request to http://wc.test/sru was canceled"},
+		{name: "refused", err: wrap(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			expected: http.StatusServiceUnavailable, msg: "http://wc.test/sru refused connection"},
+		{name: "dns", err: wrap(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "wc.test"}}),
+			expected: http.StatusBadGateway, msg: "http://wc.test/sru could not be resolved"},
+		{name: "other", err: wrap(errors.New("unsupported protocol scheme")), expected: http.StatusBadRequest,
+			msg: `Get "http://wc.test/sru": unsupported protocol scheme`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, msg := classifyRequestError("http://wc.test/sru", tc.err)
+			if status != tc.expected || msg != tc.msg {
+				t.Errorf("expected %d %q, got %d %q", tc.expected, tc.msg, status, msg)
+			}
+		})
+	}
+
+	// real client errors are classified the same way
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	for tgtURL, expected := range map[string]int{slow.URL: http.StatusRequestTimeout, closed.URL: http.StatusServiceUnavailable} {
+		resp, err := client.Get(tgtURL)
+		if _, reqErr := handleAPIResponse(tgtURL, resp, err); reqErr == nil || reqErr.StatusCode != expected {
+			t.Errorf("expected status %d for %s, got %+v", expected, tgtURL, reqErr)
+		}
+	}
+}
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		upstream   int
+		retryAfter string
+		expected   int
+	}{
+		{upstream: http.StatusTooManyRequests, retryAfter: "30", expected: http.StatusTooManyRequests},
+		{upstream: http.StatusInternalServerError, expected: http.StatusBadGateway},
+		{upstream: http.StatusServiceUnavailable, retryAfter: "120", expected: http.StatusServiceUnavailable},
+		{upstream: http.StatusForbidden, expected: http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		t.Run(strconv.Itoa(tc.upstream), func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.upstream)
+				fmt.Fprint(w, "stack trace with internal details")
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := doRequest(newTestRouter(svc), http.MethodGet, "/api/resource/1001", nil, nil)
+			if resp.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+			if resp.Header().Get("Retry-After") != tc.retryAfter {
+				t.Errorf("expected Retry-After %q, got %q", tc.retryAfter, resp.Header().Get("Retry-After"))
+			}
+			if strings.Contains(resp.Body.String(), "internal details") {
+				t.Errorf("expected the upstream body to be hidden, got %s", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var agents sync.Map
+	capture := func(name string, handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			agents.Store(name, r.Header.Get("User-Agent"))
+			handler(w, r)
+		}
+	}
+	mock.onSearch = capture("search", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, sruResponse(1, "1001")) })
+	mock.onContent = capture("content", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, dcRecord("1001")) })
+	mock.onToken = capture("token", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, tokenResponse(time.Hour)) })
+	svc := newTestService(t, oclcTestConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	postJSON(router, "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+	doRequest(router, http.MethodGet, "/api/resource/1001", nil, nil)
+	for _, name := range []string{"search", "content", "token"} {
+		if agent, _ := agents.Load(name); agent != "virgo4-test" {
+			t.Errorf("expected %s request User-Agent virgo4-test, got %v", name, agent)
+		}
+	}
+
+	cfg, err := parseConfig(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatalf("unable to parse config: %s", err.Error())
+	}
+	if cfg.UserAgent != "virgo4-pool-worldcat-ws/"+version {
+		t.Errorf("expected a default User-Agent with the service name and version, got %s", cfg.UserAgent)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/api/openapi.json", nil, nil)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.Code)
+	}
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Info    struct {
+			Version string `json:"version"`
+		} `json:"info"`
+		Paths map[string]map[string]struct {
+			RequestBody struct {
+				Content map[string]struct {
+					Schema struct {
+						Properties map[string]interface{} `json:"properties"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema struct {
+						Properties map[string]interface{} `json:"properties"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("expected valid JSON, got %s: %s", err.Error(), resp.Body.String())
+	}
+	if spec.OpenAPI != "3.0.3" || spec.Info.Version != "test" {
+		t.Errorf("expected OpenAPI 3.0.3 for version test, got %s for %s", spec.OpenAPI, spec.Info.Version)
+	}
+	paths := make([]string, 0)
+	for path := range spec.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	expected := []string{"/api/fields", "/api/providers", "/api/resource/{id}", "/api/search", "/api/search/facets", "/identify"}
+	if reflect.DeepEqual(paths, expected) == false {
+		t.Errorf("expected paths %v, got %v", expected, paths)
+	}
+
+	search := spec.Paths["/api/search"]["post"]
+	request := search.RequestBody.Content["application/json"].Schema.Properties
+	response := search.Responses["200"].Content["application/json"].Schema.Properties
+	for _, name := range []string{"query", "pagination", "sort"} {
+		if _, found := request[name]; found == false {
+			t.Errorf("expected search request property %s, got %v", name, request)
+		}
+	}
+	for _, name := range []string{"group_list", "pagination", "next_start", "prev_start"} {
+		if _, found := response[name]; found == false {
+			t.Errorf("expected search response property %s, got %v", name, response)
+		}
+	}
+}
+
+func TestPprofRoutes(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	apiKey := map[string]string{"X-Api-Key": "apikey"}
+	tests := []struct {
+		name     string
+		enabled  bool
+		path     string
+		headers  map[string]string
+		expected int
+	}{
+		{name: "disabled", path: "/debug/pprof/", headers: apiKey, expected: http.StatusNotFound},
+		{name: "disabled heap", path: "/debug/pprof/heap", headers: apiKey, expected: http.StatusNotFound},
+		{name: "enabled", enabled: true, path: "/debug/pprof/", headers: apiKey, expected: http.StatusOK},
+		{name: "enabled heap", enabled: true, path: "/debug/pprof/heap", headers: apiKey, expected: http.StatusOK},
+		{name: "enabled without key", enabled: true, path: "/debug/pprof/", expected: http.StatusUnauthorized},
+		{name: "enabled cmdline", enabled: true, path: "/debug/pprof/cmdline", headers: apiKey, expected: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := doRequest(newServiceRouter(svc, tc.enabled), http.MethodGet, tc.path, nil, tc.headers)
+			if resp.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, resp.Code)
+			}
+		})
+	}
+}
+
+func TestAcceptLanguageFallback(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	// only English and Spanish are available
+	i18nDir := t.TempDir()
+	for _, lang := range []string{"en", "es"} {
+		src, err := os.ReadFile(filepath.Join("i18n", "active."+lang+".toml"))
+		if err != nil {
+			t.Fatalf("unable to read messages: %s", err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(i18nDir, "active."+lang+".toml"), src, 0644); err != nil {
+			t.Fatalf("unable to write messages: %s", err.Error())
+		}
+	}
+	bundle, err := loadLocalizations(i18nDir)
+	if err != nil {
+		t.Fatalf("unable to load messages: %s", err.Error())
+	}
+	svc.I18NBundle = bundle
+	router := newServiceRouter(svc, false)
+
+	spanish, english := "Este recurso", "This resource"
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{header: "fr,es;q=0.8", expected: spanish},
+		{header: "fr-CA, de;q=0.9, es;q=0.5, en;q=0.1", expected: spanish},
+		{header: "es;q=0.2, en;q=0.9", expected: english},
+		{header: "fr", expected: english},
+		{header: "", expected: english},
+		{header: ";;invalid", expected: english},
+	}
+	for _, tc := range tests {
+		t.Run(tc.header, func(t *testing.T) {
+			resp := doRequest(router, http.MethodGet, "/identify", nil, map[string]string{"Accept-Language": tc.header})
+			var identity v4api.PoolIdentity
+			json.Unmarshal(resp.Body.Bytes(), &identity)
+			message := ""
+			for _, attr := range identity.Attributes {
+				if attr.Name == "item_message" {
+					message = attr.Value
+				}
+			}
+			if strings.HasPrefix(message, tc.expected) == false {
+				t.Errorf("expected item_message starting %q, got %q", tc.expected, message)
+			}
+		})
+	}
+}
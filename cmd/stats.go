@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceStats contains cumulative runtime counters for the service
+type serviceStats struct {
+	started         time.Time
+	searches        atomic.Int64
+	timedSearches   atomic.Int64
+	searchMS        atomic.Int64
+	resourceLookups atomic.Int64
+	worldcatErrors  atomic.Int64
+	tokenRefreshes  atomic.Int64
+}
+
+// recordSearchTime adds the elapsed time of a completed search to the search latency
+func (s *serviceStats) recordSearchTime(elapsedMS int64) {
+	s.timedSearches.Add(1)
+	s.searchMS.Add(elapsedMS)
+}
+
+// statsHandler returns the runtime counters for the service
+func (svc *ServiceContext) statsHandler(c *gin.Context) {
+	stats := &svc.Stats
+	avgMS := int64(0)
+	if timed := stats.timedSearches.Load(); timed > 0 {
+		avgMS = stats.searchMS.Load() / timed
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"searches":             stats.searches.Load(),
+		"average_search_ms":    avgMS,
+		"resource_lookups":     stats.resourceLookups.Load(),
+		"worldcat_errors":      stats.worldcatErrors.Load(),
+		"oclc_token_refreshes": stats.tokenRefreshes.Load(),
+		"uptime_seconds":       int64(time.Since(stats.started) / time.Second),
+	})
+}
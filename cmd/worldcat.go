@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
@@ -12,250 +13,719 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"github.com/uvalib/virgo4-api/v4api"
 	"github.com/uvalib/virgo4-parser/v4parser"
 )
 
-type providerDetails struct {
-	Provider    string `json:"provider"`
-	Label       string `json:"label,omitempty"`
-	HomepageURL string `json:"homepage_url,omitempty"`
-	LogoURL     string `json:"logo_url,omitempty"`
+// maxSearchRows is the largest page of results that WorldCat will return for a search
+const maxSearchRows = 100
+
+// sortLibraryCount is the sort ID for ordering by the number of holding libraries.
+// It is specific to this pool so it is not one of the shared v4api sort options.
+const sortLibraryCount = "SortLibraryCount"
+
+// sortOptions are the sorts supported by this pool. They are advertised in the identify response.
+var sortOptions = []v4api.SortOption{
+	{ID: v4api.SortRelevance.String(), Label: "Relevance"},
+	{ID: v4api.SortDate.String(), Label: "Date Published", Asc: "oldest first", Desc: "newest first"},
+	{ID: v4api.SortTitle.String(), Label: "Title", Asc: "A-Z", Desc: "Z-A"},
+	{ID: v4api.SortAuthor.String(), Label: "Author", Asc: "A-Z", Desc: "Z-A"},
+	{ID: sortLibraryCount, Label: "Number of Libraries", Asc: "fewest first", Desc: "most first"},
+}
+
+// fieldClauseRegex matches a V4 field clause like: title: {"war and peace"}
+// The first submatch is the field name and the second is the search terms.
+var fieldClauseRegex = regexp.MustCompile(`([a-z_]+):\s*\{([^}]*)\}`)
+
+// queryTermRegex matches a quoted phrase or a single word in the terms of a field clause
+var queryTermRegex = regexp.MustCompile(`"[^"]*"|[^\s"]+`)
+
+// wildcardTermRegex matches a search term that contains an asterisk
+var wildcardTermRegex = regexp.MustCompile(`[^\s{}()"]*\*[^\s{}()"]*`)
+
+// minWildcardPrefix is the number of characters WorldCat requires before a truncation wildcard
+const minWildcardPrefix = 3
+
+// personalNameRegex matches a personal name in natural (Mark Twain) or inverted
+// (Twain, Mark) order
+var personalNameRegex = regexp.MustCompile(`^(\p{L}[\p{L}.'-]*( \p{L}[\p{L}.'-]*){1,2}|\p{L}[\p{L}.'-]*( \p{L}[\p{L}.'-]*)?, \p{L}[\p{L}.'-]*( \p{L}[\p{L}.'-]*)?)$`)
+
+// yearRegex matches the first 4 digit year in a date. The year can't be part of a longer
+// run of digits.
+var yearRegex = regexp.MustCompile(`(?:^|\D)(\d{4})(?:\D|$)`)
+
+// longNumberRegex matches a run of more than 4 digits, which is not a year
+var longNumberRegex = regexp.MustCompile(`\d{5,}`)
+
+// shortYearRegex matches an early year of 1 to 3 digits, optionally approximate or
+// bracketed like c888 or [888]. The submatch is the year.
+var shortYearRegex = regexp.MustCompile(`^c?\[?(\d{1,3})\]?$`)
+
+// oclcNumberRegex matches an OCLC number with an optional ocm, ocn, on or (OCoLC) prefix.
+// The submatch is the number.
+var oclcNumberRegex = regexp.MustCompile(`^(?i:\(OCoLC\)|ocm|ocn|on)?(\d{1,15})$`)
+
+// trailingExclusionRegex matches a NOT srw.li library exclusion at the end of an SRU query.
+// The submatch is the library symbol.
+var trailingExclusionRegex = regexp.MustCompile(`(?i)\s+NOT\s+srw\.li\s*=\s*"?([^\s"()]+)"?\s*$`)
+
+// lcCallNumberRegex loosely matches an LC call number like QA76.73.J38 or PS 3545 .H16
+var lcCallNumberRegex = regexp.MustCompile(`^(?i)[A-Z]{1,3}\s?\d{1,4}(\.\d+)?([\s.].*)?\*?$`)
+
+// deweyCallNumberRegex loosely matches a Dewey call number like 813.54 or 005.133 S
+var deweyCallNumberRegex = regexp.MustCompile(`^\d{3}(\.\d+)?([\s.].*)?\*?$`)
+
+// doiRegex matches a normalized DOI: a 10. prefix, registrant code, slash and suffix
+var doiRegex = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+
+// isbnRegex matches a normalized ISBN-10 or ISBN-13
+var isbnRegex = regexp.MustCompile(`^(\d{9}[\dX]|\d{13})$`)
+
+// unexpectedContentMsg is the client message when WorldCat returns something other than XML
+const unexpectedContentMsg = "upstream returned unexpected content"
+
+// formatFacets are the V4 facet IDs that filter by format
+var formatFacets = map[string]bool{"format": true, "FacetFormat": true, "material_type": true}
+
+// materialTypes maps V4 format filter values to WorldCat material type codes for srw.mt
+var materialTypes = map[string]string{
+	"book":  "bks",
+	"video": "vis",
+	"audio": "rec",
 }
 
-type poolProviders struct {
-	Providers []providerDetails `json:"providers"`
+// languageCodes maps language names and ISO 639 codes to the MARC language codes used by
+// srw.la. Other three letter codes are assumed to be MARC codes.
+var languageCodes = map[string]string{
+	"arabic": "ara", "ar": "ara",
+	"chinese": "chi", "zh": "chi", "zho": "chi",
+	"czech": "cze", "cs": "cze", "ces": "cze",
+	"danish": "dan", "da": "dan",
+	"dutch": "dut", "nl": "dut", "nld": "dut",
+	"english": "eng", "en": "eng",
+	"finnish": "fin", "fi": "fin",
+	"french": "fre", "fr": "fre", "fra": "fre",
+	"german": "ger", "de": "ger", "deu": "ger",
+	"greek": "gre", "el": "gre", "ell": "gre",
+	"hebrew": "heb", "he": "heb",
+	"hindi": "hin", "hi": "hin",
+	"italian": "ita", "it": "ita",
+	"japanese": "jpn", "ja": "jpn",
+	"korean": "kor", "ko": "kor",
+	"latin": "lat", "la": "lat",
+	"norwegian": "nor", "no": "nor",
+	"polish": "pol", "pl": "pol",
+	"portuguese": "por", "pt": "por",
+	"russian": "rus", "ru": "rus",
+	"spanish": "spa", "es": "spa",
+	"swedish": "swe", "sv": "swe",
+	"turkish": "tur", "tr": "tur",
+	"ukrainian": "ukr", "uk": "ukr",
 }
 
+// uvaLibraries are the WorldCat symbols for UVA libraries. Their holdings are already in
+// Virgo so they are excluded from all searches.
+var uvaLibraries = []string{"VA@", "VAL", "VAM"}
+
+// dcJSONContentType is the content type of a resource returned as Dublin Core JSON
+const dcJSONContentType = "application/vnd.dc+json"
+
+// marcXMLContentType is the content type of a resource returned as MARCXML
+const marcXMLContentType = "application/marcxml+xml"
+
+// batchWorkers is the maximum number of concurrent lookups for a batch resource request
+const batchWorkers = 5
+
+// wcSearchResponse is a WorldCat SRU search response. SRU, diagnostic, Dublin Core and MARC
+// elements are all namespaced, and WorldCat may send them with a prefix (srw:, dc:) or a
+// default namespace. The XML tags are deliberately unqualified: encoding/xml matches an
+// unqualified tag to the local name in any namespace, so the fields populate either way.
 type wcSearchResponse struct {
-	XMLName xml.Name   `xml:"searchRetrieveResponse"`
-	Count   int        `xml:"numberOfRecords"`
-	Records []wcRecord `xml:"records>record>recordData>oclcdcs"`
+	XMLName     xml.Name       `xml:"searchRetrieveResponse"`
+	Count       int            `xml:"numberOfRecords"`
+	Records     []wcRecord     `xml:"records>record>recordData>oclcdcs"`
+	MARCRecords []marcRecord   `xml:"records>record>recordData>record"`
+	Diagnostics []wcDiagnostic `xml:"diagnostics>diagnostic"`
+	Suggestions []string       `xml:"extraResponseData>suggestions>suggestion"`
 }
 
+// wcDiagnostic is an SRU diagnostic returned in place of records when a search fails.
+// The URI is of the form info:srw/diagnostic/1/NN where NN identifies the problem.
+type wcDiagnostic struct {
+	URI     string `xml:"uri"`
+	Message string `xml:"message"`
+	Details string `xml:"details"`
+}
+
+// wcRecord is a WorldCat Dublin Core record. The JSON tags are used when the record
+// is returned as Dublin Core JSON rather than V4 fields.
 type wcRecord struct {
-	XMLName     xml.Name `xml:"oclcdcs"`
-	ID          string   `xml:"recordIdentifier"`
-	Date        string   `xml:"date"`
-	Language    string   `xml:"language"`
-	ISBN        []string `xml:"identifier"`
-	Creator     []string `xml:"creator,omitempty"`
-	Contributor []string `xml:"contributor,omitempty"`
-	Description []string `xml:"description,omitempty"`
-	Subjects    []string `xml:"subject,omitempty"`
-	Title       []string `xml:"title,omitempty"`
-	Type        []string `xml:"type,omitempty"`
-	Formats     []string `xml:"format,omitempty"`
-	Publishers  []string `xml:"publisher,omitempty"`
-}
-
-// ProvidersHandler returns a list of access_url providers for JMRL
-func (svc *ServiceContext) providersHandler(c *gin.Context) {
-	p := poolProviders{Providers: make([]providerDetails, 0)}
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "worldcat",
-		Label:       "WorldCat",
-		LogoURL:     "/assets/wclogo.png",
-		HomepageURL: "https://www.worldcat.org/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "hathitrust",
-		Label:       "Hathi Trust Digital Library",
-		LogoURL:     "/assets/hathitrust.png",
-		HomepageURL: "https://www.hathitrust.org/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "proquest",
-		Label:       "ProQuest U.S. Congressional Hearings Digital Collection",
-		LogoURL:     "/assets/proquest.jpg",
-		HomepageURL: "https://www.proquest.com/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "google",
-		Label:       "Google Books",
-		LogoURL:     "/assets/google.png",
-		HomepageURL: "https://books.google.com/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "vlebooks",
-		Label:       "VLeBooks",
-		LogoURL:     "/assets/vlebooks.png",
-		HomepageURL: "https://www.vlebooks.com/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "canadiana",
-		Label:       "Canadiana",
-		LogoURL:     "/assets/canadiana.png",
-		HomepageURL: "http://www.canadiana.ca/",
-	})
-	p.Providers = append(p.Providers, providerDetails{
-		Provider:    "overdrive",
-		Label:       "Overdrive",
-		LogoURL:     "/assets/overdrive.png",
-		HomepageURL: "https://www.overdrive.com",
-	})
-	c.JSON(http.StatusOK, p)
+	XMLName     xml.Name `xml:"oclcdcs" json:"-"`
+	ID          string   `xml:"recordIdentifier" json:"recordIdentifier"`
+	Date        string   `xml:"date" json:"date,omitempty"`
+	Language    string   `xml:"language" json:"language,omitempty"`
+	ISBN        []string `xml:"identifier" json:"identifier,omitempty"`
+	Creator     []string `xml:"creator,omitempty" json:"creator,omitempty"`
+	Contributor []string `xml:"contributor,omitempty" json:"contributor,omitempty"`
+	Description []string `xml:"description,omitempty" json:"description,omitempty"`
+	Subjects    []string `xml:"subject,omitempty" json:"subject,omitempty"`
+	Title       []string `xml:"title,omitempty" json:"title,omitempty"`
+	Type        []string `xml:"type,omitempty" json:"type,omitempty"`
+	Formats     []string `xml:"format,omitempty" json:"format,omitempty"`
+	Publishers  []string `xml:"publisher,omitempty" json:"publisher,omitempty"`
+	// Dublin Core has no place of publication; it is only set from MARCXML
+	Places []string `xml:"-" json:"publicationPlace,omitempty"`
+	Series []string `xml:"relation,omitempty" json:"relation,omitempty"`
 }
 
-// Search accepts a search POST, transforms the query into JMRL format and perfoms the search
-func (svc *ServiceContext) search(c *gin.Context) {
-	log.Printf("Search requested")
-	var req v4api.SearchRequest
-	if err := c.BindJSON(&req); err != nil {
-		log.Printf("ERROR: unable to parse search request: %s", err.Error())
-		c.String(http.StatusBadRequest, "invalid request")
-		return
-	}
+// isEmpty returns true if the record has no identifier or title. WorldCat returns a record
+// like this, rather than an error, for some unknown OCLC numbers.
+func (r *wcRecord) isEmpty() bool {
+	return strings.TrimSpace(r.ID) == "" && len(r.Title) == 0
+}
 
-	acceptLang := strings.Split(c.GetHeader("Accept-Language"), ",")[0]
-	if acceptLang == "" {
-		acceptLang = "en-US"
-	}
+// pagedPoolResult is a V4 pool result with the start offsets of the next and previous pages.
+// The offsets are null on the last and first pages.
+type pagedPoolResult struct {
+	*v4api.PoolResult
+	NextStart *int `json:"next_start"`
+	PrevStart *int `json:"prev_start"`
+}
+
+// sruSearch is a V4 search request converted into WorldCat SRU search parameters
+type sruSearch struct {
+	Query      string   `json:"sru_query"`
+	SortKey    string   `json:"sort_key"`
+	Start      int      `json:"start"`
+	Rows       int      `json:"rows"`
+	OnlineOnly bool     `json:"online_only"`
+	Filtered   bool     `json:"filtered"`
+	Warnings   []string `json:"warnings"`
+}
 
+// convertSearch validates a V4 search request and converts it into SRU search parameters.
+// Pagination in the request is adjusted to the values that will be used. Soft problems
+// with the request are reported in the warnings.
+func (svc *ServiceContext) convertSearch(req *v4api.SearchRequest) (*sruSearch, *RequestError) {
 	log.Printf("Raw query: %s, %+v %+v", req.Query, req.Pagination, req.Sort)
-	valid, errors := v4parser.Validate(req.Query)
+	if fieldErrs := validateSearchRequest(req); len(fieldErrs) > 0 {
+		log.Printf("ERROR: search request has %d invalid fields", len(fieldErrs))
+		return nil, &RequestError{StatusCode: http.StatusBadRequest, Message: "Invalid search request", FieldErrors: fieldErrs}
+	}
+	req.Query = normalizeBooleans(req.Query)
+	valid, errors := v4parser.Validate(validationQuery(req.Query))
 	if valid == false {
 		log.Printf("ERROR: Query [%s] is not valid: %s", req.Query, errors)
-		c.String(http.StatusBadRequest, "Malformed search")
-		return
+		return nil, &RequestError{StatusCode: http.StatusBadRequest, Message: "Malformed search"}
 	}
 
 	// journal queries are not supported
 	// We mark these messages as WARNING's because they are expected
 	if strings.Contains(req.Query, "journal_title:") {
 		log.Printf("WARNING: journal title queries are not supported")
-		c.String(http.StatusNotImplemented, "Journal Title queries are not supported")
-		return
+		return nil, &RequestError{StatusCode: http.StatusNotImplemented, Message: "Journal Title queries are not supported"}
+	}
+
+	// soft problems with the request are reported back to the client as warnings
+	warnings := make([]string, 0)
+	if req.Pagination.Rows > maxSearchRows {
+		log.Printf("WARNING: pagination rows %d exceeds max %d", req.Pagination.Rows, maxSearchRows)
+		warnings = append(warnings, fmt.Sprintf("Pagination rows %d exceeds the maximum and was changed to %d", req.Pagination.Rows, maxSearchRows))
+		req.Pagination.Rows = maxSearchRows
+	} else if req.Pagination.Rows == 0 {
+		log.Printf("INFO: no pagination rows requested; using default %d", svc.DefaultRows)
+		req.Pagination.Rows = svc.DefaultRows
 	}
 
-	paginationStr := fmt.Sprintf("startRecord=%d&maximumRecords=%d", req.Pagination.Start, req.Pagination.Rows)
-	sortKey := fmt.Sprintf("sortKeys=%s", getSortKey(req.Sort))
+	// WorldCat does not page deeply into results; reject pages beyond the limit
+	if req.Pagination.Start+req.Pagination.Rows > svc.MaxOffset {
+		log.Printf("ERROR: pagination start %d rows %d exceeds max offset %d", req.Pagination.Start, req.Pagination.Rows, svc.MaxOffset)
+		return nil, &RequestError{StatusCode: http.StatusBadRequest,
+			Message: fmt.Sprintf("Only the first %d results are available; start plus rows cannot exceed %d", svc.MaxOffset, svc.MaxOffset)}
+	}
 
-	// Convert V4 query into WorldCat format
-	// EX: keyword: {(calico OR "tortoise shell") AND cats}
-	// DATES: date: {1987} OR date: {AFTER 2010} OR date: {BEFORE 1990} OR date: {1987 TO 1990}
-	parsedQ, dErr := convertDateCriteria(req.Query)
-	if dErr != nil {
-		log.Printf("ERROR: invalid date in query %s: %s", req.Query, dErr.Error())
-		c.String(http.StatusBadRequest, dErr.Error())
-		return
+	// filter clauses in the query can't be searched in WorldCat; drop them
+	if filterQ := removeFieldClauses(req.Query, "filter"); filterQ != req.Query {
+		log.Printf("WARNING: filter clauses removed from query [%s]", req.Query)
+		warnings = append(warnings, "Filters in the query are not supported by WorldCat and were ignored")
+		req.Query = filterQ
 	}
-	parsedQ = strings.ReplaceAll(parsedQ, "{", "")
-	parsedQ = strings.ReplaceAll(parsedQ, "}", "")
-	parsedQ = strings.ReplaceAll(parsedQ, "keyword:", "srw.kw all")
-	parsedQ = strings.ReplaceAll(parsedQ, "title:", "srw.ti all")
-	parsedQ = strings.ReplaceAll(parsedQ, "author:", "srw.au all")
-	parsedQ = strings.ReplaceAll(parsedQ, "subject:", "srw.su all")
-	parsedQ = strings.ReplaceAll(parsedQ, "identifier:", "srw.bn =")
-	parsedQ = strings.TrimSpace(parsedQ)
-	log.Printf("Raw parsed query [%s]", parsedQ)
-	if parsedQ == "srw.kw all" || parsedQ == "srw.kw all *" {
-		c.String(http.StatusNotImplemented, "At least 3 characters are required.")
-		return
+
+	// online: {true} is not a WorldCat index; records without online access are removed
+	// from the results after the search
+	onlineOnly := hasOnlineClause(req.Query)
+	if onlineOnly {
+		log.Printf("INFO: only online results requested")
+	}
+	req.Query = removeFieldClauses(req.Query, "online", "fulltext")
+	if strings.TrimSpace(req.Query) == "" {
+		return nil, &RequestError{StatusCode: http.StatusBadRequest, Message: "A search term is required."}
+	}
+
+	bareQuery := strings.TrimSpace(strings.NewReplacer("keyword:", "", "{", "", "}", "").Replace(req.Query))
+	if bareQuery == "" || bareQuery == "*" {
+		return nil, &RequestError{StatusCode: http.StatusNotImplemented,
+			Message: fmt.Sprintf("At least %d characters are required.", svc.MinTermLength)}
 	}
+	if presence := findPresenceClause(req.Query); presence != "" {
+		log.Printf("WARNING: query [%s] contains unsupported field presence clause %s", req.Query, presence)
+		return nil, &RequestError{StatusCode: http.StatusBadRequest,
+			Message: fmt.Sprintf("Searching for any value of a field (%s) is not supported.", presence)}
+	}
+	if termLen := shortestTermLength(req.Query); termLen >= 0 && termLen < svc.MinTermLength {
+		log.Printf("WARNING: query [%s] has a search term shorter than %d characters", req.Query, svc.MinTermLength)
+		return nil, &RequestError{StatusCode: http.StatusBadRequest,
+			Message: fmt.Sprintf("At least %d characters are required in each search term.", svc.MinTermLength)}
+	}
+
+	// Convert V4 query into WorldCat format, skipping any UVA libraries
+	expanders := make([]queryExpander, 0)
+	if svc.BroadKeyword {
+		expanders = append(expanders, expandKeywords)
+	}
+	if svc.AuthorVariants {
+		expanders = append(expanders, expandAuthorNames)
+	}
+	parsedQ, queryWarnings, qErr := convertQuery(req.Query, uvaLibraries, svc.IdentifierRelation, expanders...)
+	if qErr != nil {
+		log.Printf("ERROR: unable to convert query %s: %s", req.Query, qErr.Error())
+		return nil, &RequestError{StatusCode: http.StatusBadRequest, Message: qErr.Error()}
+	}
+	warnings = append(warnings, queryWarnings...)
 
-	// WorldCat does not support filtering. If a filter is specified in the search, return 0 hits
+	// WorldCat only supports filtering by material type. Any other filters are ignored
+	// and the search is done without them. CQL booleans are applied left to right, so the
+	// material type applies to the whole query.
 	// Note: when doing a next page request, the request contains:
 	//       Filters:[{PoolID:worldcat Facets:[]}]
 	//       accept this configuration
-	filtersSpecified := false
-	if len(req.Filters) > 1 {
-		filtersSpecified = true
-	} else if len(req.Filters) == 1 {
-		filtersSpecified = len(req.Filters[0].Facets) > 0
-	}
-	if filtersSpecified || strings.Contains(req.Query, "filter:") {
-		log.Printf("Filters specified in search, return no matches")
-		v4Resp := &v4api.PoolResult{ElapsedMS: 0, Confidence: "low"}
-		v4Resp.Groups = make([]v4api.Group, 0)
-		v4Resp.Pagination = v4api.Pagination{Start: 0, Total: 0, Rows: 0}
-		v4Resp.StatusCode = http.StatusOK
-		v4Resp.ContentLanguage = acceptLang
-		c.JSON(http.StatusOK, v4Resp)
-		return
+	materialTypeClause, unsupportedFilters := getMaterialTypeClause(req.Filters)
+	for _, facet := range unsupportedFilters {
+		warnings = append(warnings, fmt.Sprintf("Filter %s %s is not supported by WorldCat and was ignored", facet.FacetID, facet.Value))
+	}
+	if materialTypeClause != "" {
+		parsedQ = fmt.Sprintf("%s AND %s", parsedQ, materialTypeClause)
 	}
+	log.Printf("Final parsed query: %s", parsedQ)
 
-	// if a basic search that is ISBN is done (just a number) do an identifier search too
-	if strings.Contains(parsedQ, "srw.") &&
-		strings.Index(parsedQ, "srw.") == strings.LastIndex(parsedQ, "srw.") &&
-		strings.Index(parsedQ, "srw.") == strings.Index(parsedQ, "srw.kw") {
-		param := strings.Trim(strings.Split(parsedQ, "all")[1], " ")
-		if _, err := strconv.Atoi(param); err == nil {
-			log.Printf("%s looks like a keyword query for an identifier; add identifier search", parsedQ)
-			parsedQ += fmt.Sprintf(" OR srw.bn = %s", param)
+	// a missing sort uses the default. Unknown sorts are an error in strict mode; otherwise
+	// the default is used and the client is warned
+	if req.Sort.SortID == "" {
+		req.Sort = svc.DefaultSort
+	} else if isSortOption(req.Sort.SortID) == false {
+		if svc.StrictSort {
+			log.Printf("ERROR: unsupported sort %s", req.Sort.SortID)
+			return nil, &RequestError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("%s is not a supported sort", req.Sort.SortID)}
 		}
+		log.Printf("WARNING: unsupported sort %s; using %s", req.Sort.SortID, svc.DefaultSort.SortID)
+		warnings = append(warnings, fmt.Sprintf("Sort %s is not supported; results are sorted by %s", req.Sort.SortID, svc.DefaultSort.SortID))
+		req.Sort = svc.DefaultSort
+	}
+	// the order is echoed in the response, so make it match the sort that is done.
+	// Relevance is always most relevant first.
+	if req.Sort.Order != "asc" || req.Sort.SortID == v4api.SortRelevance.String() {
+		req.Sort.Order = "desc"
 	}
 
-	// skip any UVA libraries
-	log.Printf("Final parsed query: %s", parsedQ)
-	parsedQ += " NOT srw.li = VA@  NOT srw.li = VAL NOT srw.li = VAM"
+	return &sruSearch{Query: parsedQ, SortKey: getSortKey(req.Sort), Start: req.Pagination.Start,
+		Rows: req.Pagination.Rows, OnlineOnly: onlineOnly, Filtered: materialTypeClause != "", Warnings: warnings}, nil
 
-	startTime := time.Now()
-	qURL := fmt.Sprintf("%s/search/worldcat/sru?recordSchema=dc&query=%s&%s&%s&wskey=%s",
-		svc.WCAPI, url.QueryEscape(parsedQ), paginationStr, sortKey, svc.WCKey)
-	rawResp, respErr := svc.apiGet(qURL, "")
-	if respErr != nil {
-		c.String(respErr.StatusCode, respErr.Message)
+}
+
+// validateSearchRequest checks the fields of a search request that can be checked without
+// parsing the query. All of the invalid fields are returned.
+func validateSearchRequest(req *v4api.SearchRequest) []fieldError {
+	fieldErrs := make([]fieldError, 0)
+	if strings.TrimSpace(req.Query) == "" {
+		fieldErrs = append(fieldErrs, fieldError{Field: "query", Message: "a query is required"})
+	}
+	if req.Pagination.Start < 0 {
+		fieldErrs = append(fieldErrs, fieldError{Field: "pagination.start",
+			Message: fmt.Sprintf("%d is negative; start must be 0 or more", req.Pagination.Start)})
+	}
+	if req.Pagination.Rows < 0 {
+		fieldErrs = append(fieldErrs, fieldError{Field: "pagination.rows",
+			Message: fmt.Sprintf("%d is negative; rows must be 0 or more", req.Pagination.Rows)})
+	}
+	if req.Sort.Order != "" && req.Sort.Order != "asc" && req.Sort.Order != "desc" {
+		fieldErrs = append(fieldErrs, fieldError{Field: "sort.order",
+			Message: fmt.Sprintf("%s is not a sort order; order must be asc or desc", req.Sort.Order)})
+	}
+	for filterIdx, filter := range req.Filters {
+		for facetIdx, facet := range filter.Facets {
+			if strings.TrimSpace(facet.FacetID) == "" {
+				fieldErrs = append(fieldErrs, fieldError{Field: fmt.Sprintf("filters[%d].facets[%d].facet_id", filterIdx, facetIdx),
+					Message: "a facet is required"})
+			}
+		}
+	}
+	return fieldErrs
+}
+
+// queryExpander rewrites field clauses in a V4 query before the fields are mapped to SRU indexes
+type queryExpander func(v4Query string) string
+
+// convertQuery converts a V4 query into an SRU query that excludes records held by the
+// specified libraries. Identifiers that are not ISBNs are searched with the identifier
+// relation. Field clauses are rewritten by each expander before the remaining
+// fields are mapped to their SRU indexes. Problems that were corrected are reported in the
+// warnings; a query that can't be converted is an error.
+// EX: keyword: {(calico OR "tortoise shell") AND cats}
+// DATES: date: {1987} OR date: {AFTER 2010} OR date: {BEFORE 1990} OR date: {1987 TO 1990}
+func convertQuery(v4Query string, excludeLibs []string, identifierRelation string, expanders ...queryExpander) (string, []string, error) {
+	warnings := make([]string, 0)
+	sru, dateWarnings, err := convertDateCriteria(v4Query)
+	if err != nil {
+		return "", nil, err
+	}
+	warnings = append(warnings, dateWarnings...)
+	sru, err = convertLanguages(sru)
+	if err != nil {
+		return "", nil, err
+	}
+	sru = convertExactSubjects(sru)
+	sru, err = convertCallNumbers(sru)
+	if err != nil {
+		return "", nil, err
+	}
+	sru, doiWarnings, err := convertDOIs(sru)
+	if err != nil {
+		return "", nil, err
+	}
+	warnings = append(warnings, doiWarnings...)
+	sru, wildcardWarnings := convertWildcards(sru)
+	warnings = append(warnings, wildcardWarnings...)
+	sru = addIdentifierSearches(sru)
+	sru = convertIdentifiers(sru, identifierRelation)
+	for _, expand := range expanders {
+		sru = expand(sru)
+	}
+	sru = strings.ReplaceAll(sru, "{", "")
+	sru = strings.ReplaceAll(sru, "}", "")
+	sru = convertMappedFields(sru)
+	sru = strings.TrimSpace(sru)
+	log.Printf("Raw parsed query [%s]", sru)
+	return excludeLibraries(sru, excludeLibs), warnings, nil
+}
+
+// Search accepts a search POST, transforms the query into JMRL format and perfoms the search
+func (svc *ServiceContext) search(c *gin.Context) {
+	log.Printf("Search requested")
+	svc.Stats.searches.Add(1)
+	var req v4api.SearchRequest
+	if reqErr := svc.readJSONBody(c, &req); reqErr != nil {
+		log.Printf("ERROR: unable to parse search request: %s", reqErr.Message)
+		respondError(c, reqErr.StatusCode, reqErr.Message)
 		return
 	}
 
-	strResponse := string(rawResp)
-	if strings.Contains(strResponse, `xml version="1.1"`) == true {
-		// NOTE: golang only supports xml v1.0. From a golang issue, the only way to
-		// parse is to replace version="1.1" with version="1.0"
-		// the issue: https://github.com/golang/go/issues/25755
-		log.Printf("WARNING: xml response is using unsupported version 1.1; manually replacing version text with 1.0")
-		strResponse = strings.Replace(strResponse, `xml version="1.1"`, `xml version="1.0"`, 1)
+	locale := svc.getLocale(c)
+	localizer := i18n.NewLocalizer(svc.I18NBundle, locale)
+
+	sru, convErr := svc.convertSearch(&req)
+	if convErr != nil {
+		respondRequestError(c, convErr)
+		return
 	}
+	parsedQ := sru.Query
+	sortKey := fmt.Sprintf("sortKeys=%s", sru.SortKey)
+	warnings := sru.Warnings
+	onlineOnly := sru.OnlineOnly
 
-	// successful search; setup response
-	elapsedNanoSec := time.Since(startTime)
-	elapsedMS := int64(elapsedNanoSec / time.Millisecond)
-	v4Resp := &v4api.PoolResult{ElapsedMS: elapsedMS, Confidence: "low"}
+	v4Resp := &v4api.PoolResult{Confidence: "low"}
 	v4Resp.Groups = make([]v4api.Group, 0)
-	if req.Sort.SortID == "" {
-		v4Resp.Sort.SortID = v4api.SortRelevance.String()
-		v4Resp.Sort.Order = "desc"
-	} else {
-		v4Resp.Sort = req.Sort
+	v4Resp.Sort = req.Sort
+
+	// pages that fall within the cache window are served from the cache when possible. On a
+	// cache miss the whole window is requested from WorldCat and cached.
+	startTime := time.Now()
+	var wcElapsedMS, parseElapsedMS int64
+	cacheKey := fmt.Sprintf("%s|%s", parsedQ, sortKey)
+	useCache := svc.SearchCache.covers(req.Pagination.Start, req.Pagination.Rows)
+	var wcResp *wcSearchResponse
+	if useCache {
+		wcResp = svc.SearchCache.get(cacheKey, req.Pagination.Start, req.Pagination.Rows)
 	}
+	if wcResp == nil {
+		fetchStart := req.Pagination.Start
+		fetchRows := req.Pagination.Rows
+		if useCache {
+			fetchStart = 0
+			fetchRows = svc.SearchCache.window
+		}
 
-	wcResp := &wcSearchResponse{}
-	fmtErr := xml.Unmarshal([]byte(strResponse), wcResp)
-	if fmtErr != nil {
-		log.Printf("ERROR: Invalid response from WorldCat API: %s", fmtErr.Error())
-		log.Printf("Response: %s", strResponse)
-		v4Resp.StatusCode = http.StatusInternalServerError
-		v4Resp.StatusMessage = fmtErr.Error()
-		c.JSON(v4Resp.StatusCode, v4Resp)
-		return
+		// SRU startRecord is 1-based while the V4 start is 0-based
+		paginationStr := fmt.Sprintf("startRecord=%d&maximumRecords=%d", fetchStart+1, fetchRows)
+		qURL := fmt.Sprintf("%s/search/worldcat/sru?recordSchema=%s&query=%s&%s&%s&wskey=%s",
+			svc.WCAPI, svc.RecordSchema, url.QueryEscape(parsedQ), paginationStr, sortKey, svc.WCKey)
+		rawResp, respErr := svc.searchGet(qURL)
+		if respErr != nil {
+			respondRequestError(c, respErr)
+			return
+		}
+		wcElapsedMS = int64(time.Since(startTime) / time.Millisecond)
+
+		if isUnexpectedContent(rawResp) {
+			log.Printf("ERROR: WorldCat search returned non-XML content: %s", rawResp)
+			v4Resp.ElapsedMS = int64(time.Since(startTime) / time.Millisecond)
+			v4Resp.StatusCode = http.StatusBadGateway
+			v4Resp.StatusMessage = unexpectedContentMsg
+			c.JSON(v4Resp.StatusCode, v4Resp)
+			return
+		}
+
+		var fmtErr error
+		parseStart := time.Now()
+		wcResp, fmtErr = parseSearchResponse(rawResp)
+		parseElapsedMS = int64(time.Since(parseStart) / time.Millisecond)
+		if fmtErr != nil {
+			log.Printf("ERROR: Invalid response from WorldCat API: %s", fmtErr.Error())
+			log.Printf("Response: %s", rawResp)
+			v4Resp.ElapsedMS = int64(time.Since(startTime) / time.Millisecond)
+			v4Resp.StatusCode = http.StatusInternalServerError
+			v4Resp.StatusMessage = fmtErr.Error()
+			c.JSON(v4Resp.StatusCode, v4Resp)
+			return
+		}
+		if len(wcResp.Diagnostics) > 0 && len(wcResp.Records) == 0 {
+			diag := wcResp.Diagnostics[0]
+			log.Printf("ERROR: WorldCat SRU diagnostic for query %s: %s %s %s", parsedQ, diag.URI, diag.Message, diag.Details)
+			v4Resp.ElapsedMS = int64(time.Since(startTime) / time.Millisecond)
+			v4Resp.StatusCode = getDiagnosticStatus(diag)
+			v4Resp.StatusMessage = diag.Message
+			if diag.Details != "" {
+				v4Resp.StatusMessage = fmt.Sprintf("%s: %s", diag.Message, diag.Details)
+			}
+			v4Resp.Warnings = append(warnings, fmt.Sprintf("WorldCat was unable to process the search: %s", v4Resp.StatusMessage))
+			c.JSON(v4Resp.StatusCode, v4Resp)
+			return
+		}
+		if useCache {
+			wcResp = svc.SearchCache.put(cacheKey, wcResp, req.Pagination.Start, req.Pagination.Rows)
+		}
 	}
 
+	// successful search; setup response
+	v4Resp.ElapsedMS = int64(time.Since(startTime) / time.Millisecond)
+
+	debug := svc.debugRequested(c)
+	basicOnly := c.Query("fields") == "basic"
+	if debug {
+		v4Resp.Debug = make(map[string]interface{})
+		v4Resp.Debug["sru_query"] = parsedQ
+		v4Resp.Debug["sort_key"] = sru.SortKey
+		v4Resp.Debug["raw_record_count"] = len(wcResp.Records)
+	}
+
+	// Rows is the number of records actually returned, which may be fewer than requested
 	v4Resp.Pagination = v4api.Pagination{Start: req.Pagination.Start, Total: wcResp.Count,
 		Rows: len(wcResp.Records)}
-	for _, wcRec := range wcResp.Records {
+	beyondTotal := wcResp.Count > 0 && req.Pagination.Start >= wcResp.Count
+	if beyondTotal {
+		lastStart := getLastPageStart(wcResp.Count, req.Pagination.Rows)
+		log.Printf("WARNING: requested start %d is beyond total %d; last page starts at %d",
+			req.Pagination.Start, wcResp.Count, lastStart)
+		warnings = append(warnings, fmt.Sprintf("Requested start %d is beyond the %d available results; the last page starts at %d",
+			req.Pagination.Start, wcResp.Count, lastStart))
+		v4Resp.Pagination.Start = lastStart
+	}
+	// when grouping is enabled, records for the same work are collapsed into a single group
+	// tracked here by work key to group index
+	enrichStart := time.Now()
+	onlineCount := 0
+	workGroups := make(map[string]int)
+	var partnerHoldings map[string][]string
+	if len(svc.PartnerSymbols) > 0 && basicOnly == false {
+		ids := make([]string, 0, len(wcResp.Records))
+		for _, wcRec := range wcResp.Records {
+			ids = append(ids, wcRec.ID)
+		}
+		partnerHoldings = svc.getPartnerHoldings(ids)
+	}
+	for idx, wcRec := range wcResp.Records {
+		record := v4api.Record{}
+		record.Fields = svc.getResultFields(&wcRec, localizer)
+		if onlineOnly && hasOnlineAccess(record.Fields) == false {
+			continue
+		}
+		if basicOnly {
+			record.Fields = getBasicFields(record.Fields)
+		}
+		if partners := partnerHoldings[wcRec.ID]; len(partners) > 0 {
+			record.Fields = append(record.Fields, v4api.RecordField{Name: "partner_holding", Label: "Held by Partner Libraries",
+				Value: strings.Join(partners, ", "), Visibility: "detailed"})
+		}
+		onlineCount++
+		record.Fields = append(record.Fields, v4api.RecordField{Name: "score", Type: "score", Label: "Score",
+			Value: fmt.Sprintf("%.6f", getPositionScore(req.Pagination.Start+idx, wcResp.Count)), Display: "optional"})
+		if debug {
+			record.Debug = make(map[string]interface{})
+			record.Debug["position"] = req.Pagination.Start + idx
+		}
+
+		if svc.GroupResults {
+			workKey := getWorkKey(&wcRec)
+			if groupIdx, found := workGroups[workKey]; found {
+				log.Printf("INFO: group record %s with %s", wcRec.ID, v4Resp.Groups[groupIdx].Value)
+				v4Resp.Groups[groupIdx].Count++
+				v4Resp.Groups[groupIdx].Records = append(v4Resp.Groups[groupIdx].Records, record)
+				continue
+			}
+			workGroups[workKey] = len(v4Resp.Groups)
+		}
+
 		groupRec := v4api.Group{Value: wcRec.ID, Count: 1}
 		groupRec.Records = make([]v4api.Record, 0)
-		record := v4api.Record{}
-		record.Fields = getResultFields(&wcRec)
 		groupRec.Records = append(groupRec.Records, record)
 		v4Resp.Groups = append(v4Resp.Groups, groupRec)
 	}
 
-	if wcResp.Count > 0 {
-		v4Resp.Confidence = "medium"
+	// WorldCat can't restrict to online items so the total is estimated from this page
+	if onlineOnly && len(wcResp.Records) > 0 {
+		v4Resp.Pagination.Rows = onlineCount
+		v4Resp.Pagination.Total = wcResp.Count * onlineCount / len(wcResp.Records)
+		warnings = append(warnings, "Only online items are shown; the total number of results is approximate")
+	}
+
+	if debug {
+		// on a cache hit there is no WorldCat call or parse so those times are 0
+		v4Resp.Debug["timing_ms"] = map[string]int64{
+			"worldcat": wcElapsedMS,
+			"parse":    parseElapsedMS,
+			"enrich":   int64(time.Since(enrichStart) / time.Millisecond),
+			"total":    int64(time.Since(startTime) / time.Millisecond),
+		}
+	}
+
+	v4Resp.Confidence = computeConfidence(req.Query, wcResp.Count)
+	lowConfidence := svc.MinConfidence != "" && len(v4Resp.Groups) > 0 &&
+		confidenceRank(v4Resp.Confidence) < confidenceRank(svc.MinConfidence)
+	if lowConfidence && len(v4Resp.Groups) > svc.LowConfidenceRows {
+		log.Printf("INFO: %s confidence is below %s; return %d of %d groups", v4Resp.Confidence,
+			svc.MinConfidence, svc.LowConfidenceRows, len(v4Resp.Groups))
+		v4Resp.Groups = v4Resp.Groups[:svc.LowConfidenceRows]
+		v4Resp.Pagination.Rows = 0
+		for _, group := range v4Resp.Groups {
+			v4Resp.Pagination.Rows += len(group.Records)
+		}
+		// later pages would be limited the same way, so report these as all of the results
+		// and there is no next page
+		v4Resp.Pagination.Total = v4Resp.Pagination.Start + v4Resp.Pagination.Rows
+		if svc.LowConfidenceRows == 0 {
+			warnings = append(warnings, fmt.Sprintf("No results are returned because the match confidence is below %s", svc.MinConfidence))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("Only %d results are returned because the match confidence is below %s",
+				svc.LowConfidenceRows, svc.MinConfidence))
+		}
+	}
+
+	// WorldCat may suggest a different spelling for queries with few results
+	for _, suggestion := range wcResp.Suggestions {
+		if suggestion = strings.TrimSpace(suggestion); suggestion != "" {
+			log.Printf("INFO: WorldCat suggested %s for query %s", suggestion, parsedQ)
+			warnings = append(warnings, fmt.Sprintf("Did you mean: %s", suggestion))
+		}
+	}
+
+	// explain what may have caused a search with no results. A page beyond the total is
+	// already explained by the pagination warning.
+	if len(v4Resp.Groups) == 0 && lowConfidence == false && beyondTotal == false {
+		log.Printf("INFO: no results for query %s", parsedQ)
+		warnings = append(warnings, localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "NoResults"}))
+		if sru.Filtered || onlineOnly {
+			warnings = append(warnings, localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "NoResultsFiltered"}))
+		}
+		if hasFieldClause(req.Query) {
+			warnings = append(warnings, localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "NoResultsFields"}))
+		}
 	}
 
 	v4Resp.StatusCode = http.StatusOK
-	v4Resp.ContentLanguage = acceptLang
-	c.JSON(http.StatusOK, v4Resp)
+	v4Resp.ContentLanguage = locale
+	v4Resp.Warnings = warnings
+	svc.Stats.recordSearchTime(int64(time.Since(startTime) / time.Millisecond))
+	pagedResp := pagedPoolResult{PoolResult: v4Resp}
+	pagedResp.NextStart, pagedResp.PrevStart = getPageOffsets(v4Resp.Pagination.Start, req.Pagination.Rows, v4Resp.Pagination.Total)
+	setCacheControl(c, svc.SearchMaxAge)
+	c.JSON(http.StatusOK, pagedResp)
+}
+
+// getPositionScore returns a relevance score between 0 and 1 for a record at a 0-based position
+// in the full result set. WorldCat does not return scores, but results are in relevance order
+// so the score decreases with position. It is the same for a record on any page of the results.
+func getPositionScore(position int, total int) float64 {
+	if total <= 0 || position >= total {
+		return 0
+	}
+	return float64(total-position) / float64(total)
+}
+
+// searchPreview converts a V4 search request into SRU search parameters and returns them
+// without searching WorldCat. It is used to troubleshoot query conversion.
+func (svc *ServiceContext) searchPreview(c *gin.Context) {
+	log.Printf("Search preview requested")
+	var req v4api.SearchRequest
+	if reqErr := svc.readJSONBody(c, &req); reqErr != nil {
+		log.Printf("ERROR: unable to parse search preview request: %s", reqErr.Message)
+		respondError(c, reqErr.StatusCode, reqErr.Message)
+		return
+	}
+	sru, convErr := svc.convertSearch(&req)
+	if convErr != nil {
+		respondRequestError(c, convErr)
+		return
+	}
+	c.JSON(http.StatusOK, sru)
+}
+
+// isUnexpectedContent returns true if a WorldCat response is an HTML error page or JSON
+// instead of the requested XML
+func isUnexpectedContent(rawResp []byte) bool {
+	start := strings.ToLower(strings.TrimSpace(string(rawResp)))
+	if len(start) > 32 {
+		start = start[:32]
+	}
+	return strings.HasPrefix(start, "<html") || strings.HasPrefix(start, "<!doctype html") ||
+		strings.HasPrefix(start, "{") || strings.HasPrefix(start, "[")
+}
+
+// parseSearchResponse parses the XML from a WorldCat SRU search
+func parseSearchResponse(rawResp []byte) (*wcSearchResponse, error) {
+	strResponse := string(rawResp)
+	if strings.Contains(strResponse, `xml version="1.1"`) == true {
+		// NOTE: golang only supports xml v1.0. From a golang issue, the only way to
+		// parse is to replace version="1.1" with version="1.0"
+		// the issue: https://github.com/golang/go/issues/25755
+		log.Printf("WARNING: xml response is using unsupported version 1.1; manually replacing version text with 1.0")
+		strResponse = strings.Replace(strResponse, `xml version="1.1"`, `xml version="1.0"`, 1)
+	}
+
+	wcResp := &wcSearchResponse{}
+	err := xml.Unmarshal([]byte(strResponse), wcResp)
+	if err != nil {
+		return nil, err
+	}
+	for _, marcRec := range wcResp.MARCRecords {
+		wcResp.Records = append(wcResp.Records, marcRec.toWCRecord())
+	}
+	wcResp.MARCRecords = nil
+	return wcResp, nil
 }
 
 // Facets placeholder implementaion for a V4 facet POST.
 func (svc *ServiceContext) facets(c *gin.Context) {
+	var req v4api.SearchRequest
+	if reqErr := svc.readJSONBody(c, &req); reqErr != nil {
+		log.Printf("ERROR: unable to parse facets request: %s", reqErr.Message)
+		respondError(c, reqErr.StatusCode, reqErr.Message)
+		return
+	}
 	log.Printf("Facets requested, but WorldCat does not support this")
 	empty := make(map[string]interface{})
 	empty["facets"] = make([]v4api.Facet, 0)
@@ -264,36 +734,140 @@ func (svc *ServiceContext) facets(c *gin.Context) {
 
 // GetResource will get a WorkdCat resource by ID
 func (svc *ServiceContext) getResource(c *gin.Context) {
-	id := c.Param("id")
+	id, valid := getOCLCNumber(c)
+	if valid == false {
+		return
+	}
 	log.Printf("Resource %s details requested", id)
-	qURL := fmt.Sprintf("%s/content/%s?recordSchema=dc&serviceLevel=full&wskey=%s",
-		svc.WCAPI, id, svc.WCKey)
-	rawResp, respErr := svc.apiGet(qURL, "")
-	if respErr != nil {
-		c.String(respErr.StatusCode, respErr.Message)
+	if strings.Contains(c.GetHeader("Accept"), marcXMLContentType) {
+		svc.getMARCXML(c)
+		return
+	}
+	serviceLevel, valid := getServiceLevel(c)
+	if valid == false {
+		return
+	}
+	if dcJSONRequested(c) {
+		log.Printf("INFO: return resource %s as Dublin Core JSON", id)
+		wcRec, respErr := svc.getRecord(id, serviceLevel)
+		if respErr != nil {
+			respondRequestError(c, respErr)
+			return
+		}
+		c.Header("Content-Type", dcJSONContentType)
+		setCacheControl(c, svc.ResourceMaxAge)
+		c.JSON(http.StatusOK, wcRec)
 		return
 	}
 
-	wcResp := &wcRecord{}
-	fmtErr := xml.Unmarshal(rawResp, wcResp)
-	if fmtErr != nil {
-		log.Printf("ERROR: Invalid response from WorldCat API: %s", fmtErr.Error())
-		log.Printf("Response: %s", rawResp)
-		c.String(http.StatusInternalServerError, fmtErr.Error())
+	localizer := i18n.NewLocalizer(svc.I18NBundle, svc.getLocale(c))
+	fields, respErr := svc.getResourceFields(id, serviceLevel, localizer)
+	if respErr != nil {
+		respondRequestError(c, respErr)
 		return
 	}
 
 	var jsonResp struct {
 		Fields []v4api.RecordField `json:"fields"`
 	}
-	jsonResp.Fields = getResultFields(wcResp)
+	jsonResp.Fields = fields
+	setCacheControl(c, svc.ResourceMaxAge)
+	c.JSON(http.StatusOK, jsonResp)
+}
+
+// batchResource will get details for a list of WorldCat resources. Each is looked up
+// concurrently and any per-item failures are reported in the response for that item.
+func (svc *ServiceContext) batchResource(c *gin.Context) {
+	var ids []string
+	if reqErr := svc.readJSONBody(c, &ids); reqErr != nil {
+		log.Printf("ERROR: unable to parse batch resource request: %s", reqErr.Message)
+		respondError(c, reqErr.StatusCode, reqErr.Message)
+		return
+	}
+	if len(ids) == 0 {
+		respondError(c, http.StatusBadRequest, "at least one identifier is required")
+		return
+	}
+	if len(ids) > svc.BatchMax {
+		log.Printf("ERROR: batch resource request for %d items exceeds max %d", len(ids), svc.BatchMax)
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("a maximum of %d identifiers is allowed", svc.BatchMax))
+		return
+	}
+	log.Printf("Batch details requested for %d resources", len(ids))
+	localizer := i18n.NewLocalizer(svc.I18NBundle, svc.getLocale(c))
+
+	type batchItem struct {
+		Fields []v4api.RecordField `json:"fields,omitempty"`
+		Error  string              `json:"error,omitempty"`
+	}
+	results := make(map[string]batchItem)
+	var resultsMutex sync.Mutex
+	var wg sync.WaitGroup
+
+	idChan := make(chan string)
+	workers := batchWorkers
+	if len(ids) < workers {
+		workers = len(ids)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range idChan {
+				item := batchItem{}
+				oclcNum, err := normalizeOCLCNumber(id)
+				if err != nil {
+					item.Error = err.Error()
+					resultsMutex.Lock()
+					results[id] = item
+					resultsMutex.Unlock()
+					continue
+				}
+				fields, respErr := svc.getResourceFields(oclcNum, "full", localizer)
+				if respErr != nil {
+					log.Printf("ERROR: batch lookup of %s failed: %d %s", id, respErr.StatusCode, respErr.Message)
+					item.Error = respErr.Message
+				} else {
+					item.Fields = fields
+				}
+				resultsMutex.Lock()
+				results[id] = item
+				resultsMutex.Unlock()
+			}
+		}()
+	}
+
+	queued := make(map[string]bool)
+	for _, id := range ids {
+		if queued[id] {
+			continue
+		}
+		queued[id] = true
+		idChan <- id
+	}
+	close(idChan)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
+
+// getResourceFields looks up a single WorldCat resource at the service level and returns its V4 fields
+func (svc *ServiceContext) getResourceFields(id string, serviceLevel string, localizer *i18n.Localizer) ([]v4api.RecordField, *RequestError) {
+	wcResp, respErr := svc.getRecord(id, serviceLevel)
+	if respErr != nil {
+		return nil, respErr
+	}
+
+	fields := svc.getResultFields(wcResp, localizer)
+	if svc.OCLC.configured() == false {
+		return fields, nil
+	}
 
 	log.Printf("INFO: lookup generalFormat for %s", id)
 	err := svc.refreshOCLCAuth()
 	if err != nil {
 		log.Printf("INFO: unable to refresh OCLC auth: %s", err.Error())
-		c.JSON(http.StatusOK, jsonResp)
-		return
+		return fields, nil
 	}
 	genFmt, err := svc.getGeneralFormat(id)
 	if err != nil {
@@ -310,28 +884,153 @@ func (svc *ServiceContext) getResource(c *gin.Context) {
 			log.Printf("INFO: item %s has  format %s:%s", id, fmtJSON.GeneralFormat, fmtJSON.SpecificFormat)
 			gf := v4api.RecordField{Name: "general_format", Type: "format", Label: "General Format",
 				Value: fmtJSON.GeneralFormat, Display: "optional"}
-			jsonResp.Fields = append(jsonResp.Fields, gf)
+			fields = append(fields, gf)
 			sf := v4api.RecordField{Name: "specific_format", Type: "format", Label: "Specific Format",
 				Value: fmtJSON.GeneralFormat, Display: "optional"}
-			jsonResp.Fields = append(jsonResp.Fields, sf)
+			fields = append(fields, sf)
 		}
 	}
 
-	c.JSON(http.StatusOK, jsonResp)
+	return fields, nil
+}
+
+// getRecord looks up a single WorldCat resource and returns the parsed Dublin Core record.
+// MARCXML records are mapped into the Dublin Core fields.
+func (svc *ServiceContext) getRecord(id string, serviceLevel string) (*wcRecord, *RequestError) {
+	rawResp, respErr := svc.getContent(id, svc.RecordSchema, serviceLevel)
+	if respErr != nil {
+		return nil, respErr
+	}
+	if svc.RecordSchema == "marcxml" {
+		marcRec := &marcRecord{}
+		if fmtErr := xml.Unmarshal(rawResp, marcRec); fmtErr != nil {
+			log.Printf("ERROR: Invalid MARCXML response from WorldCat API: %s", fmtErr.Error())
+			return nil, &RequestError{StatusCode: http.StatusInternalServerError, Message: fmtErr.Error()}
+		}
+		wcRec := marcRec.toWCRecord()
+		if wcRec.isEmpty() {
+			return nil, recordNotFound(id)
+		}
+		return &wcRec, nil
+	}
+
+	wcResp := &wcRecord{}
+	fmtErr := xml.Unmarshal(rawResp, wcResp)
+	if fmtErr != nil {
+		log.Printf("ERROR: Invalid response from WorldCat API: %s", fmtErr.Error())
+		log.Printf("Response: %s", rawResp)
+		return nil, &RequestError{StatusCode: http.StatusInternalServerError, Message: fmtErr.Error()}
+	}
+	if wcResp.isEmpty() {
+		return nil, recordNotFound(id)
+	}
+	return wcResp, nil
+}
+
+// recordNotFound logs and returns the error for an OCLC number that has no WorldCat record
+func recordNotFound(id string) *RequestError {
+	log.Printf("INFO: no WorldCat record found for %s", id)
+	return &RequestError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("%s not found", id)}
+}
+
+// normalizeOCLCNumber validates an OCLC number and returns it without any prefix
+func normalizeOCLCNumber(id string) (string, error) {
+	match := oclcNumberRegex.FindStringSubmatch(strings.TrimSpace(id))
+	if match == nil {
+		return "", fmt.Errorf("%s is not a valid OCLC number", id)
+	}
+	return match[1], nil
+}
+
+// getOCLCNumber returns the normalized OCLC number from the id request param. If the id is
+// not valid a 400 is sent and false is returned.
+func getOCLCNumber(c *gin.Context) (string, bool) {
+	id, err := normalizeOCLCNumber(c.Param("id"))
+	if err != nil {
+		log.Printf("WARNING: %s", err.Error())
+		respondError(c, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	return id, true
+}
+
+// getServiceLevel returns the WorldCat service level from the serviceLevel request param.
+// The default is full. If the service level is not valid a 400 is sent and false is returned.
+func getServiceLevel(c *gin.Context) (string, bool) {
+	serviceLevel := c.DefaultQuery("serviceLevel", "full")
+	if serviceLevel != "full" && serviceLevel != "default" {
+		log.Printf("WARNING: invalid service level %s", serviceLevel)
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("serviceLevel must be full or default: %s", serviceLevel))
+		return "", false
+	}
+	return serviceLevel, true
+}
+
+// getContent gets the XML for a single WorldCat resource in the specified record schema
+// and service level
+func (svc *ServiceContext) getContent(id string, schema string, serviceLevel string) ([]byte, *RequestError) {
+	svc.Stats.resourceLookups.Add(1)
+	qURL := fmt.Sprintf("%s/content/%s?recordSchema=%s&serviceLevel=%s&wskey=%s",
+		svc.WCAPI, id, schema, serviceLevel, svc.WCKey)
+	rawResp, respErr := svc.apiGet(qURL, "")
+	if respErr != nil {
+		if respErr.StatusCode == http.StatusNotFound {
+			return nil, recordNotFound(id)
+		}
+		return nil, respErr
+	}
+	if len(bytes.TrimSpace(rawResp)) == 0 {
+		return nil, recordNotFound(id)
+	}
+
+	if isUnexpectedContent(rawResp) {
+		log.Printf("ERROR: WorldCat content for %s is not XML: %s", id, rawResp)
+		return nil, &RequestError{StatusCode: http.StatusBadGateway, Message: unexpectedContentMsg}
+	}
+	return rawResp, nil
+}
+
+// getMARCXML returns the MARCXML for a WorldCat resource as-is
+func (svc *ServiceContext) getMARCXML(c *gin.Context) {
+	id, valid := getOCLCNumber(c)
+	if valid == false {
+		return
+	}
+	log.Printf("Resource %s MARCXML requested", id)
+	serviceLevel, valid := getServiceLevel(c)
+	if valid == false {
+		return
+	}
+	rawResp, respErr := svc.getContent(id, "marcxml", serviceLevel)
+	if respErr != nil {
+		respondRequestError(c, respErr)
+		return
+	}
+	setCacheControl(c, svc.ResourceMaxAge)
+	c.Data(http.StatusOK, marcXMLContentType, rawResp)
+}
+
+// dcJSONRequested returns true if the client asked for a resource as Dublin Core JSON with
+// an Accept header of application/vnd.dc+json or ?format=dc
+func dcJSONRequested(c *gin.Context) bool {
+	return c.Query("format") == "dc" || strings.Contains(c.GetHeader("Accept"), dcJSONContentType)
 }
 
 func (svc *ServiceContext) getGeneralFormat(id string) ([]byte, error) {
-	resp, respErr := svc.apiGet(fmt.Sprintf("%s/%s", svc.OCLC.MetadataAPI, id), svc.OCLC.Token)
+	resp, respErr := svc.apiGet(fmt.Sprintf("%s/%s", svc.OCLC.MetadataAPI, id), svc.OCLC.getToken())
 	if respErr != nil {
-		svc.OCLC.Token = ""
-		svc.OCLC.Expires = time.Now()
+		svc.OCLC.invalidate()
 		return nil, errors.New(respErr.Message)
 	}
 	return resp, nil
 }
 
+// refreshOCLCAuth requests a new OCLC auth token if the current one has expired. Only one
+// refresh is done at a time; concurrent callers wait for it and then use the new token.
 func (svc *ServiceContext) refreshOCLCAuth() error {
 	log.Printf("INFO: check OCLC auth token")
+	svc.OCLC.mutex.Lock()
+	defer svc.OCLC.mutex.Unlock()
 	now := time.Now()
 	del := svc.OCLC.Expires.Sub(now)
 	log.Printf("INFO: token expire [%s] vs time now [%s] : delta [%d] secs", svc.OCLC.Expires.String(), now.String(), int(del.Seconds()))
@@ -348,7 +1047,563 @@ func (svc *ServiceContext) refreshOCLCAuth() error {
 	return nil
 }
 
-func convertDateCriteria(query string) (string, error) {
+// searchGet sends an SRU search request to WorldCat. Identical concurrent searches share a
+// single upstream request. Only in-flight requests are shared, so failures are not reused by
+// later searches. Each caller parses its own copy of the records from the shared response.
+func (svc *ServiceContext) searchGet(qURL string) ([]byte, *RequestError) {
+	type searchResult struct {
+		raw []byte
+		err *RequestError
+	}
+	out, _, shared := svc.SearchFlight.Do(qURL, func() (interface{}, error) {
+		raw, err := svc.apiGet(qURL, "")
+		return searchResult{raw: raw, err: err}, nil
+	})
+	if shared {
+		log.Printf("INFO: shared WorldCat response for identical concurrent search")
+	}
+	result := out.(searchResult)
+	return result.raw, result.err
+}
+
+// findPresenceClause returns the first clause in a V4 query that only asks whether a field
+// has a value, like title: {*}. SRU has no way to express this. Returns an empty string if
+// there is no such clause.
+func findPresenceClause(v4Query string) string {
+	for _, clause := range fieldClauseRegex.FindAllStringSubmatch(v4Query, -1) {
+		terms := strings.Trim(strings.TrimSpace(clause[2]), `"()`)
+		if terms != "" && strings.Trim(terms, "* ") == "" {
+			return clause[0]
+		}
+	}
+	return ""
+}
+
+// shortestTermLength returns the length of the shortest search term in a V4 query, counting
+// only letters and digits. A quoted phrase is counted as one term. Boolean operators and
+// terms without letters or digits are skipped, as are clauses for exact fields, like
+// identifier and date, and filters. If the query has no terms to check, -1 is returned.
+func shortestTermLength(v4Query string) int {
+	shortest := -1
+	for _, clause := range fieldClauseRegex.FindAllStringSubmatch(v4Query, -1) {
+		if clause[1] == "filter" || isExactField(clause[1]) {
+			continue
+		}
+		for _, term := range queryTermRegex.FindAllString(clause[2], -1) {
+			if term == "AND" || term == "OR" || term == "NOT" {
+				continue
+			}
+			termLen := 0
+			for _, r := range term {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					termLen++
+				}
+			}
+			if termLen > 0 && (shortest == -1 || termLen < shortest) {
+				shortest = termLen
+			}
+		}
+	}
+	return shortest
+}
+
+// convertWildcards converts wildcards in search terms into the CQL right truncation that
+// WorldCat supports: a single trailing asterisk after at least 3 characters, like comput*.
+// Leading wildcards are removed, a mid-word wildcard truncates the term at that point and
+// wildcards after too few characters are dropped. Each changed term gets one warning
+// describing the result. A term that is only an asterisk is left as-is.
+func convertWildcards(query string) (string, []string) {
+	warnings := make([]string, 0)
+	out := wildcardTermRegex.ReplaceAllStringFunc(query, func(origTerm string) string {
+		if strings.Trim(origTerm, "*") == "" {
+			return origTerm
+		}
+		term := strings.TrimLeft(origTerm, "*")
+		leading := term != origTerm
+		starIdx := strings.Index(term, "*")
+		if starIdx == -1 {
+			warnings = append(warnings, fmt.Sprintf("Leading wildcards are not supported and were removed from %s", origTerm))
+			return term
+		}
+		prefix := term[:starIdx]
+		if len([]rune(prefix)) < minWildcardPrefix {
+			warnings = append(warnings, fmt.Sprintf("At least %d characters are required before a wildcard; the wildcard was removed from %s", minWildcardPrefix, origTerm))
+			return prefix
+		}
+		if starIdx < len(term)-1 {
+			warnings = append(warnings, fmt.Sprintf("Wildcards are only supported at the end of a term; %s was changed to %s*", origTerm, prefix))
+		} else if leading {
+			warnings = append(warnings, fmt.Sprintf("Leading wildcards are not supported and were removed from %s", origTerm))
+		}
+		return prefix + "*"
+	})
+	return out, warnings
+}
+
+// normalizeBooleans uppercases and, or and not between field clauses so they are treated as
+// boolean operators. Field terms in braces, like title: {to be or not to be}, and quoted
+// phrases, like "war and peace", are unchanged.
+// EX: title: {cats} and author: {smith} becomes title: {cats} AND author: {smith}
+func normalizeBooleans(v4Query string) string {
+	var out strings.Builder
+	inQuote := false
+	braceDepth := 0
+	word := make([]rune, 0)
+	flushWord := func() {
+		w := string(word)
+		if inQuote == false && braceDepth == 0 {
+			switch strings.ToLower(w) {
+			case "and", "or", "not":
+				w = strings.ToUpper(w)
+			}
+		}
+		out.WriteString(w)
+		word = word[:0]
+	}
+	for _, r := range v4Query {
+		if unicode.IsLetter(r) {
+			word = append(word, r)
+			continue
+		}
+		flushWord()
+		if r == '"' {
+			inQuote = !inQuote
+		} else if r == '{' && inQuote == false {
+			braceDepth++
+		} else if r == '}' && inQuote == false && braceDepth > 0 {
+			braceDepth--
+		}
+		out.WriteRune(r)
+	}
+	flushWord()
+	return out.String()
+}
+
+// removeFieldClauses removes all V4 clauses for the specified fields, like filter: {FacetFormat},
+// and the boolean operator that joins them to the rest of the query
+func removeFieldClauses(v4Query string, fields ...string) string {
+	fieldsRE := strings.Join(fields, "|")
+	joinedClauseRegex := regexp.MustCompile(fmt.Sprintf(`\s*\b(AND|OR|NOT)\s+\b(%s):\s*\{[^}]*\}`, fieldsRE))
+	leadingClauseRegex := regexp.MustCompile(fmt.Sprintf(`\b(%s):\s*\{[^}]*\}\s*(AND|OR|NOT)?\s*`, fieldsRE))
+	out := joinedClauseRegex.ReplaceAllString(v4Query, "")
+	out = leadingClauseRegex.ReplaceAllString(out, "")
+	return strings.TrimSpace(out)
+}
+
+// hasOnlineClause returns true if a V4 query restricts results to online items with
+// online: {true} or fulltext: {true}
+func hasOnlineClause(v4Query string) bool {
+	for _, clause := range fieldClauseRegex.FindAllStringSubmatch(v4Query, -1) {
+		if (clause[1] == "online" || clause[1] == "fulltext") && strings.EqualFold(strings.TrimSpace(clause[2]), "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFieldClause returns true if a V4 query searches a field other than keyword
+func hasFieldClause(v4Query string) bool {
+	for _, clause := range fieldClauseRegex.FindAllStringSubmatch(v4Query, -1) {
+		if clause[1] != "keyword" {
+			return true
+		}
+	}
+	return false
+}
+
+// getPublicationPlaces returns the places of publication of a record. Dublin Core records
+// have no place, but some publishers are in the form "Place : Publisher"; the place is taken
+// from those.
+func getPublicationPlaces(wcRec *wcRecord) []string {
+	if len(wcRec.Places) > 0 {
+		return wcRec.Places
+	}
+	places := make([]string, 0)
+	for _, val := range wcRec.Publishers {
+		if place, _, found := strings.Cut(val, " : "); found && strings.TrimSpace(place) != "" {
+			places = append(places, strings.Trim(place, " []"))
+		}
+	}
+	return places
+}
+
+// getBasicFields returns the fields without any that are only shown in the detailed view
+func getBasicFields(fields []v4api.RecordField) []v4api.RecordField {
+	basic := make([]v4api.RecordField, 0, len(fields))
+	for _, field := range fields {
+		if field.Visibility != "detailed" {
+			basic = append(basic, field)
+		}
+	}
+	return basic
+}
+
+// hasOnlineAccess returns true if a record has an online access URL
+func hasOnlineAccess(fields []v4api.RecordField) bool {
+	for _, field := range fields {
+		if field.Name == "access_url" {
+			return true
+		}
+	}
+	return false
+}
+
+// facetFilter is a single facet value from a V4 search filter
+type facetFilter struct {
+	FacetID string `json:"facet_id"`
+	Value   string `json:"value"`
+}
+
+// getMaterialTypeClause converts V4 format filters into an SRU material type clause. Multiple
+// formats are combined with OR. EX: book and video become (srw.mt = bks OR srw.mt = vis).
+// Any filters that cannot be converted are returned as unsupported.
+func getMaterialTypeClause(filters []v4api.Filter) (string, []facetFilter) {
+	unsupported := make([]facetFilter, 0)
+	clauses := make([]string, 0)
+	for _, filter := range filters {
+		for _, facet := range filter.Facets {
+			mt, found := materialTypes[strings.ToLower(facet.Value)]
+			if formatFacets[facet.FacetID] == false || found == false {
+				log.Printf("WARNING: unsupported filter %s=%s", facet.FacetID, facet.Value)
+				unsupported = append(unsupported, facetFilter(facet))
+				continue
+			}
+			clauses = append(clauses, fmt.Sprintf("srw.mt = %s", mt))
+		}
+	}
+	if len(clauses) == 0 {
+		return "", unsupported
+	}
+	return fmt.Sprintf("(%s)", strings.Join(clauses, " OR ")), unsupported
+}
+
+// excludeLibraries adds clauses to an SRU query that exclude records held by the specified
+// library symbols. CQL boolean operators have equal precedence and are applied left to right,
+// so the original query is grouped to keep any user NOT or OR terms apart from the exclusions.
+// Symbols the query already excludes at the end, as in a replayed query, are not excluded again.
+// EX: cats NOT dogs becomes (cats NOT dogs) NOT srw.li = VA@
+func excludeLibraries(query string, symbols []string) string {
+	base, excluded := splitLibraryExclusions(query)
+	missing := make([]string, 0, len(symbols))
+	for _, sym := range symbols {
+		if containsSymbol(excluded, sym) {
+			log.Printf("INFO: query already excludes %s", sym)
+			continue
+		}
+		missing = append(missing, sym)
+	}
+	if len(missing) == 0 {
+		return query
+	}
+	out := fmt.Sprintf("(%s)", base)
+	for _, sym := range append(excluded, missing...) {
+		out += fmt.Sprintf(" NOT srw.li = %s", sym)
+	}
+	return out
+}
+
+// splitLibraryExclusions splits the NOT srw.li clauses at the end of an SRU query from the rest
+// of it. Only trailing clauses outside of any grouping exclude libraries from the whole query;
+// the same text elsewhere is part of the user query. The excluded symbols are returned in order.
+// EX: (cats) NOT srw.li = VA@ NOT srw.li = VAL returns (cats) and [VA@ VAL]
+func splitLibraryExclusions(query string) (string, []string) {
+	excluded := make([]string, 0)
+	for {
+		loc := trailingExclusionRegex.FindStringSubmatchIndex(query)
+		if loc == nil || loc[0] == 0 {
+			return query, excluded
+		}
+		excluded = append([]string{query[loc[2]:loc[3]]}, excluded...)
+		query = query[:loc[0]]
+	}
+}
+
+// containsSymbol returns true if the library symbol is in the list, ignoring case
+func containsSymbol(symbols []string, symbol string) bool {
+	for _, sym := range symbols {
+		if strings.EqualFold(sym, symbol) {
+			return true
+		}
+	}
+	return false
+}
+
+// addIdentifierSearches adds an identifier search to every keyword clause that is just a
+// number or an ISBN, so they match on ISBN as well as keyword. This is done for each keyword
+// clause no matter what other clauses are in the query.
+// EX: keyword: {12345} AND author: {smith} becomes
+// (keyword: {12345} OR identifier: {12345}) AND author: {smith}
+func addIdentifierSearches(query string) string {
+	return fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "keyword" {
+			return clause
+		}
+		terms := strings.TrimSpace(parts[2])
+		id := terms
+		if _, err := strconv.Atoi(terms); err != nil {
+			isbn, isISBN := normalizeISBN(terms)
+			if isISBN == false || strings.Contains(terms, " ") {
+				return clause
+			}
+			id = isbn
+		}
+		log.Printf("%s looks like a keyword query for an identifier; add identifier search", clause)
+		return fmt.Sprintf("(%s OR identifier: {%s})", clause, id)
+	})
+}
+
+// convertIdentifiers converts all V4 identifier clauses into SRU criteria. ISBNs are searched
+// with hyphens removed in the ISBN index, as are any other numbers. OCLC numbers with a prefix,
+// like ocm12345, are searched without the prefix in the OCLC number index. Any other standard
+// number is searched in the standard number index with the relation, or = if it is empty.
+// Identifiers can be combined with boolean operators.
+// EX: identifier: {978-0-14-044913-6 OR 0040-781X OR ocm12345} becomes
+// (srw.bn = 9780140449136 OR srw.sn = "0040-781X" OR srw.no = 12345)
+func convertIdentifiers(query string, relation string) string {
+	if relation == "" {
+		relation = "="
+	}
+	return fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "identifier" {
+			return clause
+		}
+		criteria := make([]string, 0)
+		for _, term := range strings.Fields(strings.Trim(parts[2], `" `)) {
+			if term == "AND" || term == "OR" || term == "NOT" {
+				criteria = append(criteria, term)
+			} else if isbn, isISBN := normalizeISBN(term); isISBN {
+				criteria = append(criteria, fmt.Sprintf("srw.bn = %s", isbn))
+			} else if _, err := strconv.Atoi(term); err == nil {
+				criteria = append(criteria, fmt.Sprintf("srw.bn = %s", term))
+			} else if oclcNum, err := normalizeOCLCNumber(term); err == nil && oclcNum != term {
+				criteria = append(criteria, fmt.Sprintf("srw.no = %s", oclcNum))
+			} else {
+				criteria = append(criteria, fmt.Sprintf(`srw.sn %s "%s"`, relation, term))
+			}
+		}
+		if len(criteria) == 0 {
+			return clause
+		}
+		if len(criteria) == 1 {
+			return criteria[0]
+		}
+		return fmt.Sprintf("(%s)", strings.Join(criteria, " "))
+	})
+}
+
+// expandKeywords converts simple V4 keyword clauses into an SRU search across the keyword,
+// title and author indexes for better recall. EX: keyword: {cats} becomes
+// (srw.kw all cats OR srw.ti all cats OR srw.au all cats). Clauses with boolean operators,
+// groupings or no terms are left for the normal keyword conversion.
+func expandKeywords(query string) string {
+	return fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "keyword" {
+			return clause
+		}
+		terms := strings.TrimSpace(parts[2])
+		if strings.Trim(terms, "* ") == "" || strings.ContainsAny(terms, "()") {
+			return clause
+		}
+		for _, term := range strings.Fields(terms) {
+			if term == "AND" || term == "OR" || term == "NOT" {
+				return clause
+			}
+		}
+		return fmt.Sprintf("(srw.kw all %s OR srw.ti all %s OR srw.au all %s)", terms, terms, terms)
+	})
+}
+
+// expandAuthorNames converts V4 author clauses that look like a personal name into an SRU
+// search for both the natural and inverted forms of the name. EX: author: {Mark Twain}
+// and author: {Twain, Mark} both become (srw.au all "Mark Twain" OR srw.au all "Twain, Mark").
+// Clauses with boolean operators, groupings or anything other than 2 to 4 names are unchanged.
+func expandAuthorNames(query string) string {
+	return fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "author" {
+			return clause
+		}
+		name := strings.Join(strings.Fields(strings.Trim(parts[2], `" `)), " ")
+		if personalNameRegex.MatchString(name) == false {
+			return clause
+		}
+		for _, term := range strings.Fields(name) {
+			if term == "AND" || term == "OR" || term == "NOT" {
+				return clause
+			}
+		}
+		var natural, inverted string
+		if commaIdx := strings.Index(name, ","); commaIdx > -1 {
+			inverted = name
+			natural = strings.TrimSpace(name[commaIdx+1:]) + " " + strings.TrimSpace(name[:commaIdx])
+		} else {
+			natural = name
+			lastIdx := strings.LastIndex(name, " ")
+			inverted = name[lastIdx+1:] + ", " + name[:lastIdx]
+		}
+		return fmt.Sprintf(`(srw.au all "%s" OR srw.au all "%s")`, natural, inverted)
+	})
+}
+
+// convertLanguages converts all V4 language clauses into srw.la criteria. Languages can be
+// names or ISO codes and can be combined with boolean operators.
+// EX: language: {french OR de} becomes (srw.la = fre OR srw.la = ger)
+func convertLanguages(query string) (string, error) {
+	var convErr error
+	out := fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "language" || convErr != nil {
+			return clause
+		}
+		terms := strings.Fields(strings.Trim(parts[2], `" `))
+		if len(terms) == 0 {
+			convErr = errors.New("a language is required")
+			return clause
+		}
+		criteria := make([]string, 0, len(terms))
+		for _, term := range terms {
+			if term == "AND" || term == "OR" || term == "NOT" {
+				criteria = append(criteria, term)
+				continue
+			}
+			lang := strings.ToLower(term)
+			code, found := languageCodes[lang]
+			if found == false {
+				if len(lang) != 3 || strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") != "" {
+					convErr = fmt.Errorf("%s is not a supported language", term)
+					return clause
+				}
+				code = lang
+			}
+			criteria = append(criteria, fmt.Sprintf("srw.la = %s", code))
+		}
+		if len(criteria) == 1 {
+			return criteria[0]
+		}
+		return fmt.Sprintf("(%s)", strings.Join(criteria, " "))
+	})
+	if convErr != nil {
+		return "", convErr
+	}
+	return out, nil
+}
+
+// convertExactSubjects converts all V4 subject_exact clauses into srw.su criteria that match
+// the whole subject heading rather than the words in it.
+// EX: subject_exact: {Cats -- Behavior} becomes srw.su = "Cats -- Behavior"
+func convertExactSubjects(query string) string {
+	return fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "subject_exact" {
+			return clause
+		}
+		heading := strings.Join(strings.Fields(strings.ReplaceAll(parts[2], `"`, "")), " ")
+		return fmt.Sprintf(`srw.su = "%s"`, heading)
+	})
+}
+
+// convertCallNumbers converts all V4 callnumber clauses into srw.lc criteria for LC call
+// numbers or srw.dd criteria for Dewey call numbers. Call numbers can be combined with
+// boolean operators.
+// EX: callnumber: {QA76.73 OR 005.133} becomes (srw.lc = "QA76.73" OR srw.dd = "005.133")
+func convertCallNumbers(query string) (string, error) {
+	var convErr error
+	out := fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "callnumber" || convErr != nil {
+			return clause
+		}
+		criteria := make([]string, 0)
+		callNum := make([]string, 0)
+		for _, term := range append(strings.Fields(strings.Trim(parts[2], `" `)), "") {
+			if term != "AND" && term != "OR" && term != "NOT" && term != "" {
+				callNum = append(callNum, term)
+				continue
+			}
+			if len(callNum) > 0 {
+				val := strings.Join(callNum, " ")
+				index := ""
+				if lcCallNumberRegex.MatchString(val) {
+					index = "srw.lc"
+				} else if deweyCallNumberRegex.MatchString(val) {
+					index = "srw.dd"
+				} else {
+					convErr = fmt.Errorf("%s is not a valid call number", val)
+					return clause
+				}
+				criteria = append(criteria, fmt.Sprintf(`%s = "%s"`, index, strings.ToUpper(val)))
+				callNum = callNum[:0]
+			}
+			if term != "" {
+				criteria = append(criteria, term)
+			}
+		}
+		if len(criteria) == 0 {
+			convErr = errors.New("a call number is required")
+			return clause
+		}
+		if len(criteria) == 1 {
+			return criteria[0]
+		}
+		return fmt.Sprintf("(%s)", strings.Join(criteria, " "))
+	})
+	if convErr != nil {
+		return "", convErr
+	}
+	return out, nil
+}
+
+// convertDOIs converts all V4 doi clauses into srw.sn criteria. WorldCat has no DOI index, so
+// DOIs are searched as standard numbers and a warning is returned. DOIs may be in URL form or
+// have a doi: prefix. EX: doi: {https://doi.org/10.1000/XYZ} becomes srw.sn = "10.1000/xyz"
+func convertDOIs(query string) (string, []string, error) {
+	warnings := make([]string, 0)
+	var convErr error
+	out := fieldClauseRegex.ReplaceAllStringFunc(query, func(clause string) string {
+		parts := fieldClauseRegex.FindStringSubmatch(clause)
+		if parts[1] != "doi" || convErr != nil {
+			return clause
+		}
+		doi := normalizeDOI(parts[2])
+		if doiRegex.MatchString(doi) == false {
+			convErr = fmt.Errorf("%s is not a valid DOI", strings.TrimSpace(parts[2]))
+			return clause
+		}
+		if len(warnings) == 0 {
+			warnings = append(warnings, "WorldCat has no DOI index; DOIs are searched as standard numbers and may not match")
+		}
+		return fmt.Sprintf(`srw.sn = "%s"`, doi)
+	})
+	if convErr != nil {
+		return "", nil, convErr
+	}
+	return out, warnings, nil
+}
+
+// normalizeDOI removes any URL or doi: prefix from a DOI. DOIs are case insensitive so the
+// result is lowercase. EX: https://doi.org/10.1000/XYZ becomes 10.1000/xyz
+func normalizeDOI(val string) string {
+	doi := strings.ToLower(strings.Trim(val, `" `))
+	for _, prefix := range []string{"https://", "http://", "dx.doi.org/", "doi.org/", "doi:"} {
+		doi = strings.TrimPrefix(doi, prefix)
+	}
+	return strings.TrimSpace(doi)
+}
+
+// convertDateCriteria converts all V4 date clauses into SRU year criteria. Any dates that
+// had to be adjusted to a plain year are reported in the returned warnings.
+func convertDateCriteria(query string) (string, []string, error) {
+	warnings := make([]string, 0)
+	checkAdjusted := func(origStr, year string) {
+		origStr = strings.TrimSpace(origStr)
+		if strings.TrimLeft(origStr, "0") != strings.TrimLeft(year, "0") {
+			log.Printf("INFO: date %s adjusted to %s", origStr, year)
+			warnings = append(warnings, fmt.Sprintf("Date %s was adjusted to %s", origStr, year))
+		}
+	}
 	for true {
 		dateIdx := strings.Index(query, "date:")
 		if dateIdx == -1 {
@@ -357,6 +1612,14 @@ func convertDateCriteria(query string) (string, error) {
 		chunk := query[dateIdx:]
 		i0 := strings.Index(chunk, "{")
 		i1 := strings.Index(chunk, "}")
+		if i0 == -1 || i1 < i0 {
+			return "", nil, fmt.Errorf("Date criteria must be in braces: %s", chunk)
+		}
+		// errors include the whole original clause so the bad part can be found in a long query
+		clause := chunk[:i1+1]
+		dateError := func(err error) error {
+			return fmt.Errorf("%s in %s", err.Error(), clause)
+		}
 		pre := strings.Trim(query[0:dateIdx], " ")
 		post := strings.Trim(query[dateIdx+i1+1:], " ")
 
@@ -366,74 +1629,244 @@ func convertDateCriteria(query string) (string, error) {
 			yearStr := strings.Trim(strings.ReplaceAll(qt, "AFTER", ""), " ")
 			year, err := extractYear(yearStr)
 			if err != nil {
-				return "", err
+				return "", nil, dateError(err)
 			}
+			checkAdjusted(yearStr, year)
 			qt = "srw.yr > " + year
 		} else if strings.Contains(qt, "BEFORE") {
 			yearStr := strings.Trim(strings.ReplaceAll(qt, "BEFORE", ""), " ")
 			year, err := extractYear(yearStr)
 			if err != nil {
-				return "", err
+				return "", nil, dateError(err)
 			}
+			checkAdjusted(yearStr, year)
 			qt = "srw.yr < " + year
 		} else if strings.Contains(qt, "TO") {
 			years := strings.Split(qt, " TO ")
+			if len(years) != 2 {
+				return "", nil, dateError(errors.New("Date range must have a starting and ending year"))
+			}
 			yearFrom, err := extractYear(years[0])
 			if err != nil {
-				return "", errors.New("Starting year is invalid")
+				return "", nil, dateError(fmt.Errorf("Starting year is invalid: %s", err.Error()))
 			}
-			yearTo, err := extractYear(years[0])
+			checkAdjusted(years[0], yearFrom)
+			yearTo, err := extractYear(years[1])
 			if err != nil {
-				return "", errors.New("Ending year is invalid")
+				return "", nil, dateError(fmt.Errorf("Ending year is invalid: %s", err.Error()))
 			}
+			checkAdjusted(years[1], yearTo)
 			qt = fmt.Sprintf("srw.yr >= %s and srw.yr <= %s", yearFrom, yearTo)
 		} else {
 			yearStr := strings.Trim(qt, " ")
 			year, err := extractYear(yearStr)
 			if err != nil {
-				return "", err
+				return "", nil, dateError(err)
 			}
+			checkAdjusted(yearStr, year)
 			qt = "srw.yr = " + year
 		}
 
 		query = fmt.Sprintf("%s %s %s", pre, qt, post)
 	}
-	return query, nil
+	return query, warnings, nil
 }
 
+// extractYear returns the first 4 digit year found in a date string. This accepts approximate
+// and bracketed years like c1987 or [1990]. Early years of 1 to 3 digits, like 888, are
+// accepted when they are the whole date and are searched as is. A date with no year, like
+// 19uu, or with more than 4 digits, like 12345, is an error.
 func extractYear(yearStr string) (string, error) {
-	parts := strings.Split(yearStr, "-")
-	year := parts[0]
-	match, _ := regexp.Match(`\d{4}`, []byte(year))
-	if !match {
-		return "", errors.New("Only 4 digit year is accepted in a date search")
+	if longNumberRegex.MatchString(yearStr) {
+		return "", fmt.Errorf("%q is not a year; it has more than 4 digits", strings.TrimSpace(yearStr))
+	}
+	if match := yearRegex.FindStringSubmatch(yearStr); match != nil {
+		return match[1], nil
 	}
-	return year, nil
+	match := shortYearRegex.FindStringSubmatch(strings.TrimSpace(yearStr))
+	if match == nil {
+		return "", fmt.Errorf("%q is not a year of 1 to 4 digits", strings.TrimSpace(yearStr))
+	}
+	return match[1], nil
 }
 
-func getSortKey(sort v4api.SortOrder) string {
-	if sort.SortID == v4api.SortAuthor.String() {
-		if sort.Order == "asc" {
-			return "Author"
+// getWorkKey generates a key used to identify records that are the same work. It is
+// made from the normalized title and first author. Records without a title are never grouped.
+func getWorkKey(wcRec *wcRecord) string {
+	if len(wcRec.Title) == 0 {
+		return wcRec.ID
+	}
+	key := normalizeForMatch(wcRec.Title[0])
+	if len(wcRec.Creator) > 0 {
+		key += "|" + normalizeForMatch(wcRec.Creator[0])
+	}
+	return key
+}
+
+// normalizeForMatch lowercases a string, removes punctuation and collapses whitespace
+func normalizeForMatch(val string) string {
+	val = strings.ToLower(html.UnescapeString(val))
+	val = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return r
 		}
-		return "Author,,0"
+		return -1
+	}, val)
+	return strings.Join(strings.Fields(val), " ")
+}
+
+// computeConfidence rates how well the results match the query:
+//   - exact: an identifier search with a single result
+//   - high: a quoted title phrase search with results
+//   - medium: any other search with results
+//   - low: no results
+func computeConfidence(v4Query string, total int) string {
+	if total == 0 {
+		return "low"
 	}
-	if sort.SortID == v4api.SortTitle.String() {
-		if sort.Order == "asc" {
-			return "Title"
+	clauses := fieldClauseRegex.FindAllStringSubmatch(v4Query, -1)
+	if total == 1 {
+		for _, clause := range clauses {
+			terms := strings.Trim(strings.TrimSpace(clause[2]), `"`)
+			if clause[1] == "identifier" {
+				return "exact"
+			}
+			if _, isISBN := normalizeISBN(terms); clause[1] == "keyword" && isISBN && len(clauses) == 1 {
+				return "exact"
+			}
+		}
+	}
+	for _, clause := range clauses {
+		terms := strings.TrimSpace(clause[2])
+		if clause[1] == "title" && len(terms) > 2 && strings.HasPrefix(terms, `"`) && strings.HasSuffix(terms, `"`) {
+			return "high"
+		}
+	}
+	return "medium"
+}
+
+// confidenceLevels are the search confidence values from lowest to highest
+var confidenceLevels = []string{"low", "medium", "high", "exact"}
+
+// confidenceRank returns the position of a confidence value in confidenceLevels, or -1 if
+// it is not a confidence value
+func confidenceRank(confidence string) int {
+	for idx, level := range confidenceLevels {
+		if level == confidence {
+			return idx
+		}
+	}
+	return -1
+}
+
+// getLastPageStart returns the start offset of the last page of results
+func getLastPageStart(total int, rows int) int {
+	if total <= 0 {
+		return 0
+	}
+	if rows <= 0 {
+		return total - 1
+	}
+	return ((total - 1) / rows) * rows
+}
+
+// getPageOffsets returns the start of the next and previous pages of results. Nil is
+// returned for the next page of the last page and the previous page of the first page.
+func getPageOffsets(start int, rows int, total int) (*int, *int) {
+	var next, prev *int
+	if rows <= 0 {
+		return nil, nil
+	}
+	if start+rows < total {
+		nextStart := start + rows
+		next = &nextStart
+	}
+	if start > 0 {
+		prevStart := start - rows
+		if prevStart < 0 {
+			prevStart = 0
 		}
-		return "Title,,0"
+		prev = &prevStart
+	}
+	return next, prev
+}
+
+// getDiagnosticStatus maps an SRU diagnostic to an HTTP status. SRU diagnostic numbers below 10
+// are general system errors on the WorldCat side; 10 and above are problems with the
+// query, sort or record request, which are reported as a bad request.
+func getDiagnosticStatus(diag wcDiagnostic) int {
+	parts := strings.Split(strings.TrimSpace(diag.URI), "/")
+	diagNum, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil || diagNum < 10 {
+		return http.StatusBadGateway
 	}
-	if sort.SortID == v4api.SortDate.String() {
-		if sort.Order == "asc" {
-			return "Date"
+	return http.StatusBadRequest
+}
+
+// isSortOption returns true if the sort ID is one of the sorts supported by this pool
+func isSortOption(sortID string) bool {
+	for _, opt := range sortOptions {
+		if opt.ID == sortID {
+			return true
 		}
-		return "Date,,0"
 	}
-	return "relevance"
+	return false
 }
 
-func getResultFields(wcRec *wcRecord) []v4api.RecordField {
+// getSortKey converts a V4 sort into an SRU sortKeys value. The SRU syntax is
+// "key,schema,ascending" where schema is left empty and ascending is 1 for ascending or
+// 0 for descending. When the direction is omitted WorldCat uses a per-key default, which
+// is not always ascending, so the direction is always given explicitly. Relevance is
+// always most relevant first.
+func getSortKey(sort v4api.SortOrder) string {
+	var key string
+	switch sort.SortID {
+	case v4api.SortAuthor.String():
+		key = "Author"
+	case v4api.SortTitle.String():
+		key = "Title"
+	case v4api.SortDate.String():
+		key = "Date"
+	case sortLibraryCount:
+		key = "LibraryCount"
+	default:
+		return "relevance,,0"
+	}
+	if sort.Order == "asc" {
+		return key + ",,1"
+	}
+	return key + ",,0"
+}
+
+// getCoverImageURL builds a cover image URL from the first usable ISBN in the record.
+// An empty string is returned if cover images are disabled or there is no usable ISBN.
+func (svc *ServiceContext) getCoverImageURL(wcRec *wcRecord) string {
+	if svc.CoverImageURL == "" {
+		return ""
+	}
+	for _, val := range wcRec.ISBN {
+		if isbn, ok := normalizeISBN(val); ok {
+			return strings.ReplaceAll(svc.CoverImageURL, "{isbn}", isbn)
+		}
+	}
+	return ""
+}
+
+// normalizeISBN extracts the ISBN from an identifier value like "978-0-14-044913-6 (pbk.)"
+// and removes hyphens. The second return value is false if the value is not an ISBN-10 or ISBN-13.
+func normalizeISBN(val string) (string, bool) {
+	parts := strings.Fields(val)
+	if len(parts) == 0 {
+		return "", false
+	}
+	isbn := strings.ToUpper(strings.ReplaceAll(parts[0], "-", ""))
+	if isbnRegex.MatchString(isbn) == false {
+		return "", false
+	}
+	return isbn, true
+}
+
+func (svc *ServiceContext) getResultFields(wcRec *wcRecord, localizer *i18n.Localizer) []v4api.RecordField {
 	fields := make([]v4api.RecordField, 0)
 	f := v4api.RecordField{Name: "id", Type: "identifier", Label: "Identifier",
 		Value: wcRec.ID, Display: "optional", CitationPart: "id"}
@@ -444,61 +1877,55 @@ func getResultFields(wcRec *wcRecord) []v4api.RecordField {
 	fields = append(fields, f)
 
 	f = v4api.RecordField{Name: "language", Type: "language", Label: "Language",
-		Value: wcRec.Language, Visibility: "detailed", CitationPart: "language"}
+		Value: getLanguageName(wcRec.Language), Visibility: "detailed", CitationPart: "language"}
 	fields = append(fields, f)
-
-	f = v4api.RecordField{Name: "title", Type: "title", Label: "Title", Value: wcRec.Title[0], CitationPart: "title"}
+	f = v4api.RecordField{Name: "language_code", Type: "language", Label: "Language Code",
+		Value: wcRec.Language, Display: "optional"}
 	fields = append(fields, f)
 
+	if len(wcRec.Title) > 0 {
+		f = v4api.RecordField{Name: "title", Type: "title", Label: "Title", Value: html.UnescapeString(wcRec.Title[0]), CitationPart: "title"}
+		fields = append(fields, f)
+	}
+
+	coverURL := svc.getCoverImageURL(wcRec)
+	if coverURL != "" {
+		f = v4api.RecordField{Name: "cover_image", Type: "url", Label: "Cover Image", Value: coverURL, Display: "optional"}
+		fields = append(fields, f)
+	}
+
+	// the same ISBN may be listed more than once, with or without hyphens; only the first is shown
 	online := false
+	seenISBNs := make(map[string]bool)
 	for _, val := range wcRec.ISBN {
-		if strings.Contains(val, "http") == false {
+		if strings.Contains(strings.ToLower(val), "http") == false {
+			isbnKey, isISBN := normalizeISBN(val)
+			if isISBN == false {
+				isbnKey = strings.TrimSpace(val)
+			}
+			if seenISBNs[isbnKey] {
+				continue
+			}
+			seenISBNs[isbnKey] = true
 			f = v4api.RecordField{Name: "isbn", Type: "isbn", Label: "ISBN", Value: val, CitationPart: "serial_number"}
 			fields = append(fields, f)
-		} else {
-			if strings.Contains(val, "api.overdrive") || strings.Contains(val, "[institution]") {
-				log.Printf("WARN: Skipping URL that appears invalid: %s", val)
-			} else {
-				online = true
-				onlineF := v4api.RecordField{Name: "access_url", Type: "url", Label: "Online Access", Value: val, Provider: "worldcat"}
-				if strings.Contains(val, "hathitrust") {
-					log.Printf("Online access with HathiTrust")
-					onlineF.Provider = "hathitrust"
-				} else if strings.Contains(val, "proquest") {
-					log.Printf("Online access with ProQuest")
-					onlineF.Provider = "proquest"
-				} else if strings.Contains(val, "google") {
-					log.Printf("Online access with Google")
-					onlineF.Provider = "google"
-				} else if strings.Contains(val, "vlebooks") {
-					log.Printf("Online access with VLeBooks")
-					onlineF.Provider = "vlebooks"
-				} else if strings.Contains(val, "canadiana") {
-					log.Printf("Online access with Canadiana")
-					onlineF.Provider = "canadiana"
-				} else if strings.Contains(val, "overdrive") {
-					log.Printf("Online access with Overdrive")
-					onlineF.Provider = "overdrive"
-				} else {
-					log.Printf("Online access: %s", val)
-				}
-
-				fields = append(fields, onlineF)
-			}
+		} else if svc.isBlockedAccessURL(val) == false {
+			// isBlockedAccessURL logs why a URL is skipped
+			online = true
+			onlineF := v4api.RecordField{Name: "access_url", Type: "url", Label: "Online Access", Value: val,
+				Provider: svc.getAccessProvider(val)}
+			fields = append(fields, onlineF)
 		}
 	}
 
+	availLabel := localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "AvailabilityLabel"})
+	availF := v4api.RecordField{Name: "availability", Type: "availability", Label: availLabel}
 	if online {
-		/*
-			availF := v4api.RecordField{Name: "availability", Type: "availability", Label: "Availability", Value: "Online"}
-			fields = append(fields, availF)
-		*/
+		availF.Value = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "AvailabilityOnline"})
 	} else {
-		/*
-			availF := v4api.RecordField{Name: "availability", Type: "availability", Label: "Availability", Value: "By Request"}
-			fields = append(fields, availF)
-		*/
+		availF.Value = localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "AvailabilityByRequest"})
 	}
+	fields = append(fields, availF)
 
 	f = v4api.RecordField{Name: "worldcat_url", Type: "url", Label: "View full metadata on WorldCat", Provider: "worldcat",
 		Value: fmt.Sprintf("http://worldcat.org/oclc/%s", wcRec.ID), Visibility: "detailed"}
@@ -514,24 +1941,37 @@ func getResultFields(wcRec *wcRecord) []v4api.RecordField {
 	}
 
 	for _, val := range wcRec.Subjects {
-		f = v4api.RecordField{Name: "subject", Type: "subject", Label: "Subject", Value: val, Visibility: "detailed", CitationPart: "subject"}
+		f = v4api.RecordField{Name: "subject", Type: "subject", Label: "Subject", Value: html.UnescapeString(val), Visibility: "detailed", CitationPart: "subject"}
 		fields = append(fields, f)
 	}
 
 	f = v4api.RecordField{Name: "description", Type: "summary", Label: "Description",
-		Value: strings.Join(wcRec.Description, " "), CitationPart: "abstract"}
+		Value: html.UnescapeString(strings.Join(wcRec.Description, " ")), CitationPart: "abstract"}
 	fields = append(fields, f)
 
 	for _, val := range wcRec.Publishers {
-		f = v4api.RecordField{Name: "publisher", Label: "Publisher", Visibility: "detailed", Value: val, CitationPart: "publisher"}
+		f = v4api.RecordField{Name: "publisher", Label: "Publisher", Visibility: "detailed", Value: html.UnescapeString(val), CitationPart: "publisher"}
+		fields = append(fields, f)
+	}
+
+	for _, val := range getPublicationPlaces(wcRec) {
+		f = v4api.RecordField{Name: "publication_place", Label: "Place of Publication", Visibility: "detailed", Value: html.UnescapeString(val)}
+		fields = append(fields, f)
+	}
+
+	for _, val := range wcRec.Series {
+		f = v4api.RecordField{Name: "series", Type: "series", Label: "Series", Visibility: "detailed", Value: html.UnescapeString(val)}
+		fields = append(fields, f)
 	}
 
 	for _, val := range wcRec.Formats {
-		f = v4api.RecordField{Name: "format", Label: "Format", Visibility: "detailed", Value: val}
+		f = v4api.RecordField{Name: "format", Label: "Format", Visibility: "detailed", Value: html.UnescapeString(val)}
+		fields = append(fields, f)
 	}
 
 	for _, val := range wcRec.Type {
-		f = v4api.RecordField{Name: "type", Label: "Type", Visibility: "detailed", Value: val}
+		f = v4api.RecordField{Name: "type", Label: "Type", Visibility: "detailed", Value: html.UnescapeString(val)}
+		fields = append(fields, f)
 	}
 
 	return fields
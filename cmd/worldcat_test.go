@@ -0,0 +1,2230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/uvalib/virgo4-api/v4api"
+	"github.com/uvalib/virgo4-jwt/v4jwt"
+)
+
+func TestConvertQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		relation string
+		expected string
+		warnings []string
+		err      string
+	}{
+		{name: "title", query: `title: {calico cats}`, expected: `srw.ti all calico cats`},
+		{name: "phrase", query: `title: {"tortoise shell"}`, expected: `srw.ti all "tortoise shell"`},
+		{name: "and", query: `author: {smith} AND subject: {cats}`, expected: `srw.au all smith AND srw.su all cats`},
+		{name: "or", query: `keyword: {cats} OR title: {dogs}`, expected: `srw.kw all cats OR srw.ti all dogs`},
+		{name: "not", query: `keyword: {cats} NOT title: {dogs}`, expected: `srw.kw all cats NOT srw.ti all dogs`},
+		{name: "nested booleans", query: `keyword: {(calico OR "tortoise shell") AND cats}`,
+			expected: `srw.kw all (calico OR "tortoise shell") AND cats`},
+		{name: "trailing wildcard", query: `title: {cat*}`, expected: `srw.ti all cat*`},
+		{name: "single character wildcard", query: `title: {c?t}`, expected: `srw.ti all c?t`},
+		{name: "embedded wildcard", query: `title: {calico*t}`, expected: `srw.ti all calico*`,
+			warnings: []string{"Wildcards are only supported at the end of a term; calico*t was changed to calico*"}},
+		{name: "short wildcard", query: `title: {ca*}`, expected: `srw.ti all ca`,
+			warnings: []string{"At least 3 characters are required before a wildcard; the wildcard was removed from ca*"}},
+		{name: "year", query: `date: {1987}`, expected: `srw.yr = 1987`},
+		{name: "after", query: `date: {AFTER 2010}`, expected: `srw.yr > 2010`},
+		{name: "before", query: `date: {BEFORE 1990}`, expected: `srw.yr < 1990`},
+		{name: "date range", query: `date: {1987 TO 1990}`, expected: `srw.yr >= 1987 and srw.yr <= 1990`},
+		{name: "early year", query: `date: {888}`, expected: `srw.yr = 888`},
+		{name: "medieval year", query: `date: {1200}`, expected: `srw.yr = 1200`},
+		{name: "early date range", query: `date: {800 TO 1200}`, expected: `srw.yr >= 800 and srw.yr <= 1200`},
+		{name: "date with other fields", query: `keyword: {cats} AND date: {AFTER 2010}`, expected: `srw.kw all cats AND srw.yr > 2010`},
+		{name: "full date", query: `date: {1987-05-12}`, expected: `srw.yr = 1987`,
+			warnings: []string{"Date 1987-05-12 was adjusted to 1987"}},
+		{name: "circa date", query: `date: {c1987}`, expected: `srw.yr = 1987`,
+			warnings: []string{"Date c1987 was adjusted to 1987"}},
+		{name: "long number date", query: `date: {123456}`, err: `"123456" is not a year; it has more than 4 digits in date: {123456}`},
+		{name: "text date", query: `date: {abc}`, err: `"abc" is not a year of 1 to 4 digits in date: {abc}`},
+		{name: "open date range", query: `date: {1987 TO}`, err: `Date range must have a starting and ending year in date: {1987 TO}`},
+		{name: "isbn-13", query: `identifier: {9780306406157}`, expected: `srw.bn = 9780306406157`},
+		{name: "hyphenated isbn-13", query: `identifier: {978-0-306-40615-7}`, expected: `srw.bn = 9780306406157`},
+		{name: "isbn-10", query: `identifier: {0306406152}`, expected: `srw.bn = 0306406152`},
+		{name: "isbn-10 check digit x", query: `identifier: {030640615X}`, expected: `srw.bn = 030640615X`},
+		{name: "hyphenated isbn-10", query: `identifier: {0-306-40615-2}`, expected: `srw.bn = 0306406152`},
+		{name: "numeric identifier", query: `identifier: {12345}`, expected: `srw.bn = 12345`},
+		{name: "numeric identifier all", query: `identifier: {12345}`, relation: "all", expected: `srw.bn = 12345`},
+		{name: "generic identifier", query: `identifier: {0040-781X}`, expected: `srw.sn = "0040-781X"`},
+		{name: "generic identifier all", query: `identifier: {0040-781X}`, relation: "all", expected: `srw.sn all "0040-781X"`},
+		{name: "oclc number", query: `identifier: {ocm12345}`, expected: `srw.no = 12345`},
+		{name: "oclc number all", query: `identifier: {(OCoLC)12345}`, relation: "all", expected: `srw.no = 12345`},
+		{name: "mixed identifiers", query: `identifier: {978-0-306-40615-7 OR 0040-781X OR ocn12345}`,
+			expected: `(srw.bn = 9780306406157 OR srw.sn = "0040-781X" OR srw.no = 12345)`},
+		{name: "identifier with other fields", query: `title: {cats} AND identifier: {978-0-306-40615-7}`,
+			expected: `srw.ti all cats AND srw.bn = 9780306406157`},
+		{name: "keyword isbn", query: `keyword: {9780306406157}`, expected: `(srw.kw all 9780306406157 OR srw.bn = 9780306406157)`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			relation := tc.relation
+			if relation == "" {
+				relation = "="
+			}
+			sru, warnings, err := convertQuery(tc.query, nil, relation)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if sru != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, sru)
+			}
+			if tc.warnings == nil {
+				tc.warnings = []string{}
+			}
+			if reflect.DeepEqual(warnings, tc.warnings) == false {
+				t.Errorf("expected warnings %q, got %q", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestConvertWildcards(t *testing.T) {
+	tests := []struct {
+		term     string
+		expected string
+		warning  string
+	}{
+		{term: "comput*", expected: "comput*"},
+		{term: "*", expected: "*"},
+		{term: "*comput", expected: "comput", warning: "Leading wildcards are not supported and were removed from *comput"},
+		{term: "**comput*", expected: "comput*", warning: "Leading wildcards are not supported and were removed from **comput*"},
+		{term: "comp*ter", expected: "comp*", warning: "Wildcards are only supported at the end of a term; comp*ter was changed to comp*"},
+		{term: "*comp*ter", expected: "comp*", warning: "Wildcards are only supported at the end of a term; *comp*ter was changed to comp*"},
+		{term: "comp**", expected: "comp*", warning: "Wildcards are only supported at the end of a term; comp** was changed to comp*"},
+		{term: "ab*", expected: "ab", warning: "At least 3 characters are required before a wildcard; the wildcard was removed from ab*"},
+		{term: "ab*cd", expected: "ab", warning: "At least 3 characters are required before a wildcard; the wildcard was removed from ab*cd"},
+		{term: "*ab*", expected: "ab", warning: "At least 3 characters are required before a wildcard; the wildcard was removed from *ab*"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.term, func(t *testing.T) {
+			out, warnings := convertWildcards("srw.kw all " + tc.term)
+			if out != "srw.kw all "+tc.expected {
+				t.Errorf("expected %s to become %s, got %s", tc.term, tc.expected, out)
+			}
+			expected := make([]string, 0)
+			if tc.warning != "" {
+				expected = append(expected, tc.warning)
+			}
+			if reflect.DeepEqual(warnings, expected) == false {
+				t.Errorf("expected warnings %v, got %v", expected, warnings)
+			}
+		})
+	}
+}
+
+func TestConvertQueryExcludesLibraries(t *testing.T) {
+	sru, _, err := convertQuery(`title: {cats}`, []string{"VA@", "VAL"}, "=")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if strings.HasPrefix(sru, "(srw.ti all cats)") == false ||
+		strings.Contains(sru, "NOT srw.li = VA@") == false || strings.Contains(sru, "NOT srw.li = VAL") == false {
+		t.Errorf("libraries were not excluded: %s", sru)
+	}
+}
+
+// namespacedSRURecord is a Dublin Core record as WorldCat returns it, with the dc and
+// oclcterms namespace prefixes. It is formatted with the SRU element prefix and the record ID.
+const namespacedSRURecord = `<%[1]srecord>
+        <%[1]srecordSchema>info:srw/schema/1/dc</%[1]srecordSchema>
+        <%[1]srecordPacking>xml</%[1]srecordPacking>
+        <%[1]srecordData>
+          <oclcdcs xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:oclcterms="http://purl.org/oclc/terms/">
+            <oclcterms:recordIdentifier>%[2]s</oclcterms:recordIdentifier>
+            <dc:title>Calico cats</dc:title>
+            <dc:creator>Smith, Jane</dc:creator>
+            <dc:contributor>Jones, Ann</dc:contributor>
+            <dc:date>2001</dc:date>
+            <dc:language xsi:type="http://purl.org/dc/terms/ISO639-2" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">eng</dc:language>
+            <dc:identifier>9780306406157</dc:identifier>
+            <dc:description>A study of cats.</dc:description>
+            <dc:subject>Cats</dc:subject>
+            <dc:type>Text</dc:type>
+            <dc:format>Book</dc:format>
+            <dc:publisher>Cat Press</dc:publisher>
+            <dc:relation>Cat studies ; 3</dc:relation>
+          </oclcdcs>
+        </%[1]srecordData>
+        <%[1]srecordPosition>1</%[1]srecordPosition>
+      </%[1]srecord>`
+
+func TestParseNamespacedSearchResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{name: "default namespace", payload: `<?xml version="1.0" encoding="UTF-8"?>
+<searchRetrieveResponse xmlns="http://www.loc.gov/zing/srw/" xmlns:oclcterms="http://purl.org/oclc/terms/">
+  <version>1.1</version>
+  <numberOfRecords>2</numberOfRecords>
+  <records>` + fmt.Sprintf(namespacedSRURecord, "", "1001") + fmt.Sprintf(namespacedSRURecord, "", "1002") + `</records>
+  <extraResponseData><suggestions><suggestion>calico cat</suggestion></suggestions></extraResponseData>
+</searchRetrieveResponse>`},
+		{name: "srw prefix", payload: `<?xml version="1.1" encoding="UTF-8"?>
+<srw:searchRetrieveResponse xmlns:srw="http://www.loc.gov/zing/srw/">
+  <srw:version>1.1</srw:version>
+  <srw:numberOfRecords>2</srw:numberOfRecords>
+  <srw:records>` + fmt.Sprintf(namespacedSRURecord, "srw:", "1001") + fmt.Sprintf(namespacedSRURecord, "srw:", "1002") + `</srw:records>
+  <srw:extraResponseData><srw:suggestions><srw:suggestion>calico cat</srw:suggestion></srw:suggestions></srw:extraResponseData>
+</srw:searchRetrieveResponse>`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			wcResp, err := parseSearchResponse([]byte(tc.payload))
+			if err != nil {
+				t.Fatalf("unable to parse response: %s", err.Error())
+			}
+			if wcResp.Count != 2 || len(wcResp.Records) != 2 {
+				t.Fatalf("expected 2 of 2 records, got %d of %d", len(wcResp.Records), wcResp.Count)
+			}
+			if reflect.DeepEqual(wcResp.Suggestions, []string{"calico cat"}) == false {
+				t.Errorf("unexpected suggestions %q", wcResp.Suggestions)
+			}
+			expected := wcRecord{ID: "1002", Date: "2001", Language: "eng", ISBN: []string{"9780306406157"},
+				Creator: []string{"Smith, Jane"}, Contributor: []string{"Jones, Ann"}, Description: []string{"A study of cats."},
+				Subjects: []string{"Cats"}, Title: []string{"Calico cats"}, Type: []string{"Text"}, Formats: []string{"Book"},
+				Publishers: []string{"Cat Press"}, Series: []string{"Cat studies ; 3"}}
+			got := wcResp.Records[1]
+			got.XMLName.Space, got.XMLName.Local = "", ""
+			if reflect.DeepEqual(got, expected) == false {
+				t.Errorf("expected %+v, got %+v", expected, got)
+			}
+		})
+	}
+}
+
+func TestParseNamespacedDiagnostics(t *testing.T) {
+	payload := `<?xml version="1.0" encoding="UTF-8"?>
+<srw:searchRetrieveResponse xmlns:srw="http://www.loc.gov/zing/srw/" xmlns:diag="http://www.loc.gov/zing/srw/diagnostic/">
+  <srw:version>1.1</srw:version>
+  <srw:numberOfRecords>0</srw:numberOfRecords>
+  <srw:diagnostics>
+    <diag:diagnostic>
+      <diag:uri>info:srw/diagnostic/1/10</diag:uri>
+      <diag:message>Query syntax error</diag:message>
+      <diag:details>unbalanced parentheses</diag:details>
+    </diag:diagnostic>
+  </srw:diagnostics>
+</srw:searchRetrieveResponse>`
+	wcResp, err := parseSearchResponse([]byte(payload))
+	if err != nil {
+		t.Fatalf("unable to parse response: %s", err.Error())
+	}
+	expected := []wcDiagnostic{{URI: "info:srw/diagnostic/1/10", Message: "Query syntax error", Details: "unbalanced parentheses"}}
+	if len(wcResp.Records) != 0 || reflect.DeepEqual(wcResp.Diagnostics, expected) == false {
+		t.Errorf("expected diagnostics %+v and no records, got %+v and %d records", expected, wcResp.Diagnostics, len(wcResp.Records))
+	}
+}
+
+func TestBatchResourcePartialFailure(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/content/")
+		if id == "1002" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, dcRecord(id))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	resp := postJSON(newTestRouter(svc), "/api/resource", []string{"1001", "1002", "1003"})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var results map[string]struct {
+		Fields []v4api.RecordField `json:"fields"`
+		Error  string              `json:"error"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &results); err != nil {
+		t.Fatalf("unable to parse batch response %s: %s", resp.Body.String(), err.Error())
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for _, id := range []string{"1001", "1003"} {
+		if results[id].Error != "" || len(results[id].Fields) == 0 {
+			t.Errorf("expected fields for %s, got %+v", id, results[id])
+		}
+	}
+	if results["1002"].Error != "1002 not found" || len(results["1002"].Fields) != 0 {
+		t.Errorf("expected 1002 to be not found, got %+v", results["1002"])
+	}
+}
+
+func TestBatchResourceMaxSize(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	resp := postJSON(newTestRouter(svc), "/api/resource", []string{"1", "2", "3", "4", "5", "6"})
+	if resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if got := mock.contents.Load(); got != 0 {
+		t.Errorf("expected no upstream requests, got %d", got)
+	}
+}
+
+func TestSearchWarnings(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    map[string]interface{}
+		warning    string
+		rows       int
+		maxRecords string
+	}{
+		{name: "unsupported filter",
+			request: map[string]interface{}{"query": "keyword: {cats}", "filters": []map[string]interface{}{
+				{"pool_id": "worldcat", "facets": []map[string]string{{"facet_id": "FacetLibrary", "value": "Alderman"}}}}},
+			warning: "Filter FacetLibrary Alderman is not supported by WorldCat and was ignored", rows: 3},
+		{name: "filter clause in query",
+			request: map[string]interface{}{"query": "keyword: {cats} AND filter: {FacetLibrary}"},
+			warning: "Filters in the query are not supported by WorldCat and were ignored", rows: 3},
+		{name: "coerced date",
+			request: map[string]interface{}{"query": "keyword: {cats} AND date: {1987-05-12}"},
+			warning: "Date 1987-05-12 was adjusted to 1987", rows: 3},
+		{name: "clamped rows",
+			request: map[string]interface{}{"query": "keyword: {cats}", "pagination": map[string]int{"start": 0, "rows": 500}},
+			warning: "Pagination rows 500 exceeds the maximum and was changed to 100", rows: 3, maxRecords: "100"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			var maxRecords string
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				maxRecords = r.URL.Query().Get("maximumRecords")
+				fmt.Fprint(w, sruResponse(3, mock.sruRecords...))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search", tc.request)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			result := parseSearchResult(t, resp)
+			if len(result.Groups) != tc.rows {
+				t.Errorf("expected %d results with the warning, got %d", tc.rows, len(result.Groups))
+			}
+			found := false
+			for _, warning := range result.Warnings {
+				found = found || warning == tc.warning
+			}
+			if found == false {
+				t.Errorf("expected warning %q, got %q", tc.warning, result.Warnings)
+			}
+			if tc.maxRecords != "" && maxRecords != tc.maxRecords {
+				t.Errorf("expected %s rows to be requested, got %s", tc.maxRecords, maxRecords)
+			}
+		})
+	}
+}
+
+func TestSearchWithoutWarnings(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats} AND date: {1987}",
+		"pagination": map[string]int{"start": 0, "rows": 20}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	if result := parseSearchResult(t, resp); len(result.Warnings) != 0 {
+		t.Errorf("expected no warnings, got %q", result.Warnings)
+	}
+}
+
+func TestConcurrentIdenticalSearches(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		// hold the request open so the other searches arrive while it is in flight
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, sruResponse(3, mock.sruRecords...))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := postJSON(router, "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+			if resp.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+				return
+			}
+			if result := parseSearchResult(t, resp); len(result.Groups) != 3 {
+				t.Errorf("expected 3 results, got %d", len(result.Groups))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := mock.searches.Load(); got != 1 {
+		t.Errorf("expected 1 upstream search, got %d", got)
+	}
+}
+
+func TestSearchErrorsAreNotShared(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var failed atomic.Bool
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		if failed.Swap(true) == false {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, sruResponse(3, mock.sruRecords...))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	for _, expected := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		resp := postJSON(router, "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+		if resp.Code != expected {
+			t.Errorf("expected status %d, got %d: %s", expected, resp.Code, resp.Body.String())
+		}
+	}
+	if got := mock.searches.Load(); got != 2 {
+		t.Errorf("expected 2 upstream searches, got %d", got)
+	}
+}
+
+func TestSearchDebug(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	tests := []struct {
+		name  string
+		role  v4jwt.RoleEnum
+		param string
+		debug bool
+	}{
+		{name: "admin with debug", role: v4jwt.Admin, param: "?debug=1", debug: true},
+		{name: "admin with debug true", role: v4jwt.Admin, param: "?debug=true", debug: true},
+		{name: "admin without debug", role: v4jwt.Admin},
+		{name: "user with debug", role: v4jwt.User, param: "?debug=1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := doRequest(router, http.MethodPost, "/api/search"+tc.param, map[string]interface{}{"query": "keyword: {cats}"},
+				bearer(mintToken(t, svc, tc.role, time.Hour)))
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			result := parseSearchResult(t, resp)
+			if tc.debug == false {
+				if result.Debug != nil || strings.Contains(resp.Body.String(), "sru_query") {
+					t.Errorf("expected no debug information, got %s", resp.Body.String())
+				}
+				return
+			}
+			if sruQuery, _ := result.Debug["sru_query"].(string); strings.HasPrefix(sruQuery, "(srw.kw all cats)") == false {
+				t.Errorf("unexpected debug sru_query %v", result.Debug["sru_query"])
+			}
+			if result.Debug["sort_key"] != "relevance,,0" || result.Debug["raw_record_count"] != float64(3) {
+				t.Errorf("unexpected debug information %+v", result.Debug)
+			}
+		})
+	}
+}
+
+func TestSearchGroupsSameWork(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    bool
+		expected []int
+	}{
+		{name: "grouped", group: true, expected: []int{2, 1}},
+		{name: "not grouped", group: false, expected: []int{1, 1, 1}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruRecordsResponse(3,
+					"<oclcdcs><recordIdentifier>2001</recordIdentifier><title>The Calico Cat</title><creator>Smith, Jane</creator></oclcdcs>",
+					"<oclcdcs><recordIdentifier>2002</recordIdentifier><title>The calico cat.</title><creator>Smith, Jane.</creator></oclcdcs>",
+					"<oclcdcs><recordIdentifier>2003</recordIdentifier><title>The Calico Cat</title><creator>Jones, Ann</creator></oclcdcs>"))
+			}
+			cfg := testConfig(mock)
+			cfg.GroupResults = tc.group
+			svc := newTestService(t, cfg, 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "title: {calico cat}"}))
+			if len(result.Groups) != len(tc.expected) {
+				t.Fatalf("expected %d groups, got %d", len(tc.expected), len(result.Groups))
+			}
+			for idx, count := range tc.expected {
+				if result.Groups[idx].Count != count || len(result.Groups[idx].Records) != count {
+					t.Errorf("expected group %d to have %d records, got count %d with %d records",
+						idx, count, result.Groups[idx].Count, len(result.Groups[idx].Records))
+				}
+			}
+		})
+	}
+}
+
+func TestSearchCoverImage(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(2,
+			"<oclcdcs><recordIdentifier>3001</recordIdentifier><title>Cats</title><identifier>no isbn</identifier>"+
+				"<identifier>0-14-044913-9 (pbk.)</identifier></oclcdcs>",
+			"<oclcdcs><recordIdentifier>3002</recordIdentifier><title>Dogs</title></oclcdcs>"))
+	}
+	cfg := testConfig(mock)
+	cfg.CoverImageURL = "https://covers.example.org/{isbn}.jpg"
+	svc := newTestService(t, cfg, 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {pets}"}))
+	if len(result.Groups) != 2 {
+		t.Fatalf("expected 2 groups, got %d", len(result.Groups))
+	}
+	if covers := result.fieldValues(0, "cover_image"); reflect.DeepEqual(covers, []string{"https://covers.example.org/0140449139.jpg"}) == false {
+		t.Errorf("unexpected cover image for a record with an ISBN: %v", covers)
+	}
+	if covers := result.fieldValues(1, "cover_image"); len(covers) != 0 {
+		t.Errorf("expected no cover image for a record without an ISBN, got %v", covers)
+	}
+}
+
+func TestSearchLibraryCountSort(t *testing.T) {
+	for _, order := range []string{"asc", "desc"} {
+		t.Run(order, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": "keyword: {cats}",
+				"sort": map[string]string{"sort_id": sortLibraryCount, "order": order}})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			expected := map[string]string{"asc": "LibraryCount,,1", "desc": "LibraryCount,,0"}[order]
+			if params.Get("sortKeys") != expected {
+				t.Errorf("expected sortKeys %s, got %s", expected, params.Get("sortKeys"))
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	found := false
+	for _, opt := range svc.buildIdentity(i18n.NewLocalizer(svc.I18NBundle, "en-US")).SortOptions {
+		found = found || opt.ID == sortLibraryCount
+	}
+	if found == false {
+		t.Errorf("expected the identity to include sort option %s", sortLibraryCount)
+	}
+}
+
+func TestSearchSortKeys(t *testing.T) {
+	tests := []struct {
+		sortID   string
+		order    string
+		expected string
+	}{
+		{sortID: v4api.SortRelevance.String(), order: "desc", expected: "relevance,,0"},
+		{sortID: v4api.SortRelevance.String(), order: "asc", expected: "relevance,,0"},
+		{sortID: v4api.SortDate.String(), order: "asc", expected: "Date,,1"},
+		{sortID: v4api.SortDate.String(), order: "desc", expected: "Date,,0"},
+		{sortID: v4api.SortTitle.String(), order: "asc", expected: "Title,,1"},
+		{sortID: v4api.SortTitle.String(), order: "desc", expected: "Title,,0"},
+		{sortID: v4api.SortAuthor.String(), order: "asc", expected: "Author,,1"},
+		{sortID: v4api.SortAuthor.String(), order: "desc", expected: "Author,,0"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.sortID+" "+tc.order, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": "keyword: {cats}",
+				"sort": map[string]string{"sort_id": tc.sortID, "order": tc.order}})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if params.Get("sortKeys") != tc.expected {
+				t.Errorf("expected sortKeys %s, got %s", tc.expected, params.Get("sortKeys"))
+			}
+		})
+	}
+}
+
+func TestSearchMinTermLength(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{query: "keyword: {ab}", expected: http.StatusBadRequest},
+		{query: "title: {ab}", expected: http.StatusBadRequest},
+		{query: "title: {abc xy}", expected: http.StatusBadRequest},
+		{query: "keyword: {cats} AND title: {ab}", expected: http.StatusBadRequest},
+		{query: "author: {smith} OR subject: {x*}", expected: http.StatusBadRequest},
+		{query: "keyword: {cat}", expected: http.StatusOK},
+		{query: "title: {cats AND dogs}", expected: http.StatusOK},
+		{query: `title: {"of mice"}`, expected: http.StatusOK},
+		{query: "keyword: {cats} AND identifier: {12}", expected: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": tc.query})
+			if resp.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+			if tc.expected == http.StatusBadRequest {
+				if strings.Contains(resp.Body.String(), "At least 3 characters are required in each search term") == false {
+					t.Errorf("unexpected error response %s", resp.Body.String())
+				}
+				if mock.searches.Load() != 0 {
+					t.Errorf("expected no WorldCat search, got %d", mock.searches.Load())
+				}
+			}
+		})
+	}
+}
+
+func TestSearchDiagnostics(t *testing.T) {
+	tests := []struct {
+		name     string
+		uri      string
+		details  string
+		expected int
+		message  string
+	}{
+		{name: "query error", uri: "info:srw/diagnostic/1/10", details: "unbalanced parentheses", expected: http.StatusBadRequest,
+			message: "Query syntax error: unbalanced parentheses"},
+		{name: "system error", uri: "info:srw/diagnostic/1/1", expected: http.StatusBadGateway, message: "Query syntax error"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "<searchRetrieveResponse><numberOfRecords>0</numberOfRecords><diagnostics><diagnostic>"+
+					"<uri>%s</uri><message>Query syntax error</message><details>%s</details></diagnostic></diagnostics></searchRetrieveResponse>",
+					tc.uri, tc.details)
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+			if resp.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+			result := parseSearchResult(t, resp)
+			if result.StatusMessage != tc.message {
+				t.Errorf("expected status message %q, got %q", tc.message, result.StatusMessage)
+			}
+			expected := []string{"WorldCat was unable to process the search: " + tc.message}
+			if reflect.DeepEqual(result.Warnings, expected) == false {
+				t.Errorf("expected warnings %v, got %v", expected, result.Warnings)
+			}
+		})
+	}
+}
+
+func TestSearchLanguageLabels(t *testing.T) {
+	codes := []string{"eng", "FRE", "ger", "xyz"}
+	expected := [][]string{{"English", "eng"}, {"French", "FRE"}, {"German", "ger"}, {"xyz", "xyz"}}
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		records := make([]string, 0)
+		for idx, code := range codes {
+			records = append(records, fmt.Sprintf("<oclcdcs><recordIdentifier>%d</recordIdentifier><title>Title</title>"+
+				"<language>%s</language></oclcdcs>", 4000+idx, code))
+		}
+		fmt.Fprint(w, sruRecordsResponse(len(records), records...))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	if len(result.Groups) != len(codes) {
+		t.Fatalf("expected %d groups, got %d", len(codes), len(result.Groups))
+	}
+	for idx, names := range expected {
+		got := []string{strings.Join(result.fieldValues(idx, "language"), ","), strings.Join(result.fieldValues(idx, "language_code"), ",")}
+		if reflect.DeepEqual(got, names) == false {
+			t.Errorf("expected language and code %v for %s, got %v", names, codes[idx], got)
+		}
+	}
+}
+
+func TestSearchAvailability(t *testing.T) {
+	tests := []struct {
+		language string
+		online   string
+		request  string
+	}{
+		{language: "en-US", online: "Online", request: "By Request"},
+		{language: "es", online: "En línea", request: "Bajo pedido"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.language, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruRecordsResponse(2, accessURLRecord("8001", "https://catalog.hathitrust.org/Record/001"),
+					accessURLRecord("8002", "0140449139")))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := doRequest(newTestRouter(svc), http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"},
+				map[string]string{"Accept-Language": tc.language})
+			result := parseSearchResult(t, resp)
+			if avail := result.fieldValues(0, "availability"); reflect.DeepEqual(avail, []string{tc.online}) == false {
+				t.Errorf("expected availability %s for an online record, got %v", tc.online, avail)
+			}
+			if avail := result.fieldValues(1, "availability"); reflect.DeepEqual(avail, []string{tc.request}) == false {
+				t.Errorf("expected availability %s for a print record, got %v", tc.request, avail)
+			}
+		})
+	}
+}
+
+func TestSearchPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    int
+		ids      []string
+		expected [3]int
+		warnings []string
+	}{
+		{name: "within range", start: 10, ids: []string{"1011", "1012", "1013"}, expected: [3]int{10, 3, 42}},
+		{name: "beyond total", start: 50, ids: []string{}, expected: [3]int{40, 0, 42},
+			warnings: []string{"Requested start 50 is beyond the 42 available results; the last page starts at 40"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruResponse(42, tc.ids...))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search",
+				map[string]interface{}{"query": "keyword: {cats}", "pagination": map[string]int{"start": tc.start, "rows": 10}}))
+			got := [3]int{result.Pagination.Start, result.Pagination.Rows, result.Pagination.Total}
+			if got != tc.expected {
+				t.Errorf("expected start, rows and total %v, got %v", tc.expected, got)
+			}
+			if len(result.Groups) != len(tc.ids) {
+				t.Errorf("expected %d groups, got %d", len(tc.ids), len(result.Groups))
+			}
+			if len(tc.warnings) > 0 && reflect.DeepEqual(result.Warnings, tc.warnings) == false {
+				t.Errorf("expected warnings %v, got %v", tc.warnings, result.Warnings)
+			}
+			if len(tc.warnings) == 0 && len(result.Warnings) > 0 {
+				t.Errorf("expected no warnings, got %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestComputeConfidence(t *testing.T) {
+	tests := []struct {
+		query    string
+		total    int
+		expected string
+	}{
+		{query: "keyword: {cats}", total: 0, expected: "low"},
+		{query: "identifier: {12345}", total: 0, expected: "low"},
+		{query: "identifier: {12345}", total: 1, expected: "exact"},
+		{query: "identifier: {12345}", total: 3, expected: "medium"},
+		{query: "keyword: {0140449139}", total: 1, expected: "exact"},
+		{query: "keyword: {0140449139} AND title: {cats}", total: 1, expected: "medium"},
+		{query: `title: {"war and peace"}`, total: 25, expected: "high"},
+		{query: "title: {war and peace}", total: 25, expected: "medium"},
+		{query: "keyword: {cats}", total: 50000, expected: "medium"},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s %d", tc.query, tc.total), func(t *testing.T) {
+			if got := computeConfidence(tc.query, tc.total); got != tc.expected {
+				t.Errorf("expected confidence %s, got %s", tc.expected, got)
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruResponse(1, "1001"))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "identifier: {12345}"}))
+	if result.Confidence != "exact" {
+		t.Errorf("expected exact confidence for a single identifier match, got %s", result.Confidence)
+	}
+}
+
+func TestSearchMinConfidence(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		minConfidence string
+		rows          int
+		groups        int
+		total         int
+		warning       string
+	}{
+		{name: "no cutoff", query: "keyword: {cats}", groups: 3, total: 3},
+		{name: "at cutoff", query: "keyword: {cats}", minConfidence: "medium", groups: 3, total: 3},
+		{name: "above cutoff", query: `title: {"war and peace"}`, minConfidence: "high", groups: 3, total: 3},
+		{name: "suppressed", query: "keyword: {cats}", minConfidence: "high", groups: 0, total: 0,
+			warning: "No results are returned because the match confidence is below high"},
+		{name: "capped", query: "keyword: {cats}", minConfidence: "high", rows: 1, groups: 1, total: 1,
+			warning: "Only 1 results are returned because the match confidence is below high"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.MinConfidence = tc.minConfidence
+			cfg.LowConfidenceRows = tc.rows
+			resp, _ := searchUpstream(t, mock, cfg, map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			result := parseSearchResult(t, resp)
+			if len(result.Groups) != tc.groups || result.Pagination.Total != tc.total {
+				t.Errorf("expected %d groups of %d total, got %d of %d", tc.groups, tc.total, len(result.Groups), result.Pagination.Total)
+			}
+			hasWarning := false
+			for _, warning := range result.Warnings {
+				hasWarning = hasWarning || warning == tc.warning
+			}
+			if tc.warning != "" && hasWarning == false {
+				t.Errorf("expected warning %s, got %v", tc.warning, result.Warnings)
+			}
+			if tc.warning == "" && len(result.Warnings) > 0 {
+				t.Errorf("expected no warnings, got %v", result.Warnings)
+			}
+		})
+	}
+}
+
+func TestSearchRequestValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected []fieldError
+	}{
+		{name: "missing query", body: `{"query":" "}`,
+			expected: []fieldError{{Field: "query", Message: "a query is required"}}},
+		{name: "negative pagination", body: `{"query":"title: {cats}","pagination":{"start":-5,"rows":-1}}`,
+			expected: []fieldError{{Field: "pagination.start", Message: "-5 is negative; start must be 0 or more"},
+				{Field: "pagination.rows", Message: "-1 is negative; rows must be 0 or more"}}},
+		{name: "bad sort order", body: `{"query":"title: {cats}","sort":{"sort_id":"SortTitle","order":"up"}}`,
+			expected: []fieldError{{Field: "sort.order", Message: "up is not a sort order; order must be asc or desc"}}},
+		{name: "missing facet", body: `{"query":"","filters":[{"pool_id":"worldcat","facets":[{"facet_id":"FilterFormat","value":"Book"},{"facet_id":"","value":"Book"}]}]}`,
+			expected: []fieldError{{Field: "query", Message: "a query is required"},
+				{Field: "filters[0].facets[1].facet_id", Message: "a facet is required"}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+			resp := doRequest(newTestRouter(svc), http.MethodPost, "/api/search", json.RawMessage(tc.body), nil)
+			if resp.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", resp.Code, resp.Body.String())
+			}
+			var result struct {
+				Message string       `json:"message"`
+				Errors  []fieldError `json:"errors"`
+			}
+			json.Unmarshal(resp.Body.Bytes(), &result)
+			if result.Message != "Invalid search request" || reflect.DeepEqual(result.Errors, tc.expected) == false {
+				t.Errorf("expected field errors %+v, got %s", tc.expected, resp.Body.String())
+			}
+			if mock.searches.Load() != 0 {
+				t.Errorf("expected no WorldCat search, got %d", mock.searches.Load())
+			}
+		})
+	}
+}
+
+func TestSearchPresenceClause(t *testing.T) {
+	for _, query := range []string{"title: {*}", "keyword: {cats} AND author: { * }", `subject: {"*"}`} {
+		t.Run(query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": query})
+			if resp.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.Contains(resp.Body.String(), "is not supported") == false {
+				t.Errorf("unexpected error response %s", resp.Body.String())
+			}
+			if mock.searches.Load() != 0 {
+				t.Errorf("expected no WorldCat search, got %d", mock.searches.Load())
+			}
+		})
+	}
+}
+
+func TestSearchHTMLEntities(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(1, "<oclcdcs><recordIdentifier>9001</recordIdentifier>"+
+			"<title>Cats &amp;amp; Dogs</title><creator>O&amp;#x2019;Brien, Pat</creator>"+
+			"<description>A &amp;quot;pets&amp;quot; guide</description><subject>Pets &amp;amp; animals</subject>"+
+			"<publisher>Smith &amp;amp; Sons</publisher><relation>Tom &amp;amp;amp; Jerry</relation></oclcdcs>"))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	expected := map[string]string{"title": "Cats & Dogs", "author": "O’Brien, Pat", "description": `A "pets" guide`,
+		"subject": "Pets & animals", "publisher": "Smith & Sons", "series": "Tom &amp; Jerry"}
+	for name, val := range expected {
+		if got := result.fieldValues(0, name); reflect.DeepEqual(got, []string{val}) == false {
+			t.Errorf("expected %s %q, got %q", name, val, got)
+		}
+	}
+}
+
+func TestSearchSeries(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "series: {penguin classics}", expected: "srw.se all penguin classics"},
+		{query: "title: {odyssey} AND series: {penguin classics}", expected: "srw.ti all odyssey AND srw.se all penguin classics"},
+		{query: "series: {loeb} OR series: {penguin}", expected: "srw.se all loeb OR srw.se all penguin"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), "("+tc.expected+")") == false {
+				t.Errorf("expected query to start with (%s), got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(1, "<oclcdcs><recordIdentifier>9101</recordIdentifier><title>The Odyssey</title>"+
+			"<relation>Penguin classics</relation></oclcdcs>"))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "series: {penguin classics}"}))
+	if series := result.fieldValues(0, "series"); reflect.DeepEqual(series, []string{"Penguin classics"}) == false {
+		t.Errorf("expected the series field, got %v", series)
+	}
+}
+
+func TestSearchStartRecord(t *testing.T) {
+	// the V4 start is 0-based and the SRU startRecord is 1-based, so the first record of
+	// each page would be skipped without the offset
+	for start, expected := range map[int]string{0: "1", 10: "11", 990: "991"} {
+		t.Run(expected, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock),
+				map[string]interface{}{"query": "keyword: {cats}", "pagination": map[string]int{"start": start, "rows": 10}})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if params.Get("startRecord") != expected || params.Get("maximumRecords") != "10" {
+				t.Errorf("expected startRecord %s and maximumRecords 10, got %s and %s", expected,
+					params.Get("startRecord"), params.Get("maximumRecords"))
+			}
+		})
+	}
+}
+
+func TestSearchUnexpectedContent(t *testing.T) {
+	bodies := map[string]string{
+		"html": "<!DOCTYPE html><html><body><h1>Service Unavailable</h1></body></html>",
+		"json": `{"error": "invalid wskey"}`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"})
+			if resp.Code != http.StatusBadGateway {
+				t.Fatalf("expected status 502, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if result := parseSearchResult(t, resp); result.StatusMessage != unexpectedContentMsg {
+				t.Errorf("expected status message %q, got %q", unexpectedContentMsg, result.StatusMessage)
+			}
+		})
+	}
+}
+
+func TestSearchBroadKeyword(t *testing.T) {
+	tests := []struct {
+		name     string
+		broad    bool
+		query    string
+		expected string
+	}{
+		{name: "narrow", query: "keyword: {calico cats}", expected: "(srw.kw all calico cats)"},
+		{name: "broad", broad: true, query: "keyword: {calico cats}",
+			expected: "((srw.kw all calico cats OR srw.ti all calico cats OR srw.au all calico cats))"},
+		{name: "broad with booleans", broad: true, query: "keyword: {cats OR dogs}", expected: "(srw.kw all cats OR dogs)"},
+		{name: "broad with title", broad: true, query: "keyword: {cats} AND title: {calico}",
+			expected: "((srw.kw all cats OR srw.ti all cats OR srw.au all cats) AND srw.ti all calico)"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.BroadKeyword = tc.broad
+			resp, params := searchUpstream(t, mock, cfg, map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchUserNot(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "keyword: {cats} NOT title: {dogs}", expected: "(srw.kw all cats NOT srw.ti all dogs) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "keyword: {cats NOT dogs}", expected: "(srw.kw all cats NOT dogs) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "keyword: {cats} OR author: {smith} NOT subject: {dogs}",
+			expected: "(srw.kw all cats OR srw.au all smith NOT srw.su all dogs) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if params.Get("query") != tc.expected {
+				t.Errorf("expected query %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchApproximateDates(t *testing.T) {
+	tests := []struct {
+		date     string
+		expected string
+		warning  string
+		err      string
+	}{
+		{date: "c1987", expected: "srw.yr = 1987", warning: "Date c1987 was adjusted to 1987"},
+		{date: "[1990]", expected: "srw.yr = 1990", warning: "Date [1990] was adjusted to 1990"},
+		{date: "AFTER ca. 1850", expected: "srw.yr > 1850", warning: "Date ca. 1850 was adjusted to 1850"},
+		{date: "1987", expected: "srw.yr = 1987"},
+		{date: "19uu", err: `\"19uu\" is not a year of 1 to 4 digits in date: {19uu}`},
+		{date: "abcd", err: `\"abcd\" is not a year of 1 to 4 digits in date: {abcd}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.date, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock),
+				map[string]interface{}{"query": fmt.Sprintf("keyword: {cats} AND date: {%s}", tc.date)})
+			if tc.err != "" {
+				if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.err) == false {
+					t.Errorf("expected status 400 with %s, got %d: %s", tc.err, resp.Code, resp.Body.String())
+				}
+				return
+			}
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), "(srw.kw all cats AND "+tc.expected+")") == false {
+				t.Errorf("expected query with %s, got %s", tc.expected, params.Get("query"))
+			}
+			warnings := parseSearchResult(t, resp).Warnings
+			if tc.warning != "" && reflect.DeepEqual(warnings, []string{tc.warning}) == false {
+				t.Errorf("expected warning %s, got %v", tc.warning, warnings)
+			}
+			if tc.warning == "" && len(warnings) > 0 {
+				t.Errorf("expected no warnings, got %v", warnings)
+			}
+		})
+	}
+}
+
+func TestSearchDateErrors(t *testing.T) {
+	tests := []struct {
+		date string
+		err  string
+	}{
+		{date: "AFTER 19xx", err: `\"19xx\" is not a year of 1 to 4 digits in date: {AFTER 19xx}`},
+		{date: "BEFORE 123456", err: `\"123456\" is not a year; it has more than 4 digits in date: {BEFORE 123456}`},
+		{date: "1987 TO soon", err: `Ending year is invalid: \"soon\" is not a year of 1 to 4 digits in date: {1987 TO soon}`},
+		{date: "someday TO 1990", err: `Starting year is invalid: \"someday\" is not a year of 1 to 4 digits in date: {someday TO 1990}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.date, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock),
+				map[string]interface{}{"query": fmt.Sprintf("title: {cats} AND date: {%s}", tc.date)})
+			if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.err) == false {
+				t.Errorf("expected status 400 with %s, got %d: %s", tc.err, resp.Code, resp.Body.String())
+			}
+			if params != nil {
+				t.Errorf("expected no upstream search, got %s", params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestResourceDublinCoreJSON(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Cats</title>"+
+			"<creator>Smith, Jane</creator><creator>Jones, Ann</creator><subject>Cats</subject><subject>Pets</subject></oclcdcs>")
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	requests := map[string]map[string]string{
+		"/api/resource/1001":           {"Accept": "application/vnd.dc+json"},
+		"/api/resource/1001?format=dc": nil,
+	}
+	for path, headers := range requests {
+		t.Run(path, func(t *testing.T) {
+			resp := doRequest(router, http.MethodGet, path, nil, headers)
+			if resp.Code != http.StatusOK || strings.HasPrefix(resp.Header().Get("Content-Type"), dcJSONContentType) == false {
+				t.Fatalf("expected status 200 with Dublin Core JSON, got %d %s: %s", resp.Code, resp.Header().Get("Content-Type"), resp.Body.String())
+			}
+			var rec map[string]interface{}
+			if err := json.Unmarshal(resp.Body.Bytes(), &rec); err != nil {
+				t.Fatalf("unable to parse %s: %s", resp.Body.String(), err.Error())
+			}
+			expected := map[string]interface{}{"recordIdentifier": "1001", "title": []interface{}{"Cats"},
+				"creator": []interface{}{"Smith, Jane", "Jones, Ann"}, "subject": []interface{}{"Cats", "Pets"}}
+			if reflect.DeepEqual(rec, expected) == false {
+				t.Errorf("expected %v, got %v", expected, rec)
+			}
+		})
+	}
+
+	resp := doRequest(router, http.MethodGet, "/api/resource/1001", nil, nil)
+	if strings.Contains(resp.Body.String(), `"fields"`) == false {
+		t.Errorf("expected V4 fields without a Dublin Core request, got %s", resp.Body.String())
+	}
+}
+
+func TestSearchDefaultRows(t *testing.T) {
+	requests := map[string]map[string]interface{}{
+		"no pagination": {"query": "keyword: {cats}"},
+		"zero rows":     {"query": "keyword: {cats}", "pagination": map[string]int{"start": 0, "rows": 0}},
+	}
+	for name, body := range requests {
+		t.Run(name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.DefaultRows = 15
+			resp, params := searchUpstream(t, mock, cfg, body)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if params.Get("maximumRecords") != "15" || params.Get("startRecord") != "1" {
+				t.Errorf("expected startRecord 1 and maximumRecords 15, got %s and %s",
+					params.Get("startRecord"), params.Get("maximumRecords"))
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	cfg := testConfig(mock)
+	cfg.DefaultRows = 15
+	svc := newTestService(t, cfg, 5*time.Second)
+	found := false
+	for _, attr := range svc.buildIdentity(i18n.NewLocalizer(svc.I18NBundle, "en-US")).Attributes {
+		found = found || (attr.Name == "default_rows" && attr.Value == "15")
+	}
+	if found == false {
+		t.Errorf("expected the identity to include default_rows 15")
+	}
+}
+
+func TestSearchDebugTiming(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	resp := doRequest(router, http.MethodPost, "/api/search?debug=1", map[string]interface{}{"query": "keyword: {cats}"},
+		bearer(mintToken(t, svc, v4jwt.Admin, time.Hour)))
+	result := parseSearchResult(t, resp)
+	timing, ok := result.Debug["timing_ms"].(map[string]interface{})
+	if ok == false {
+		t.Fatalf("expected debug timing_ms, got %v", result.Debug)
+	}
+	for _, key := range []string{"worldcat", "parse", "enrich", "total"} {
+		if val, found := timing[key].(float64); found == false || val < 0 {
+			t.Errorf("expected a %s time, got %v", key, timing[key])
+		}
+	}
+	if timing["total"].(float64) < timing["worldcat"].(float64) {
+		t.Errorf("expected the total time to include the WorldCat time, got %v", timing)
+	}
+
+	resp = doRequest(router, http.MethodPost, "/api/search", map[string]interface{}{"query": "keyword: {cats}"},
+		bearer(mintToken(t, svc, v4jwt.Admin, time.Hour)))
+	if result := parseSearchResult(t, resp); result.Debug["timing_ms"] != nil {
+		t.Errorf("expected no timing without debug, got %v", result.Debug)
+	}
+}
+
+func TestSearchMaterialTypeFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		facets   []map[string]string
+		expected string
+	}{
+		{name: "book", facets: []map[string]string{{"facet_id": "format", "value": "book"}},
+			expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM AND (srw.mt = bks)"},
+		{name: "video and audio", facets: []map[string]string{{"facet_id": "FacetFormat", "value": "Video"}, {"facet_id": "material_type", "value": "audio"}},
+			expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM AND (srw.mt = vis OR srw.mt = rec)"},
+		{name: "no filters", expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			body := map[string]interface{}{"query": "keyword: {cats}"}
+			if len(tc.facets) > 0 {
+				body["filters"] = []map[string]interface{}{{"pool_id": "worldcat", "facets": tc.facets}}
+			}
+			resp, params := searchUpstream(t, mock, testConfig(mock), body)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if params.Get("query") != tc.expected {
+				t.Errorf("expected query %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchUnsupportedFilter(t *testing.T) {
+	mock := newMockWorldCat(t)
+	resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": "keyword: {cats}",
+		"filters": []map[string]interface{}{{"pool_id": "worldcat", "facets": []map[string]string{
+			{"facet_id": "FacetLibrary", "value": "Alderman"}, {"facet_id": "format", "value": "book"}}}}})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	result := parseSearchResult(t, resp)
+	if len(result.Groups) != 3 {
+		t.Errorf("expected 3 groups, got %d", len(result.Groups))
+	}
+	expected := []string{"Filter FacetLibrary Alderman is not supported by WorldCat and was ignored"}
+	if reflect.DeepEqual(result.Warnings, expected) == false {
+		t.Errorf("expected warnings %v, got %v", expected, result.Warnings)
+	}
+	if strings.HasSuffix(params.Get("query"), "AND (srw.mt = bks)") == false || strings.Contains(params.Get("query"), "Alderman") {
+		t.Errorf("expected only the material type filter in the query, got %s", params.Get("query"))
+	}
+}
+
+func TestResourceMARCXML(t *testing.T) {
+	mock := newMockWorldCat(t)
+	var schemas []string
+	mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+		schemas = append(schemas, r.URL.Query().Get("recordSchema"))
+		fmt.Fprint(w, `<record xmlns="http://www.loc.gov/MARC21/slim"><controlfield tag="001">1001</controlfield></record>`)
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newTestRouter(svc)
+
+	resp := doRequest(router, http.MethodGet, "/api/resource/1001", nil, map[string]string{"Accept": marcXMLContentType})
+	if resp.Code != http.StatusOK || strings.HasPrefix(resp.Header().Get("Content-Type"), marcXMLContentType) == false {
+		t.Fatalf("expected status 200 with MARCXML, got %d %s: %s", resp.Code, resp.Header().Get("Content-Type"), resp.Body.String())
+	}
+	if strings.Contains(resp.Body.String(), `<controlfield tag="001">1001</controlfield>`) == false {
+		t.Errorf("expected the MARCXML record to be passed through, got %s", resp.Body.String())
+	}
+
+	resp = doRequest(router, http.MethodGet, "/api/resource/1001", nil, nil)
+	if strings.HasPrefix(resp.Header().Get("Content-Type"), "application/json") == false {
+		t.Errorf("expected V4 JSON by default, got %s", resp.Header().Get("Content-Type"))
+	}
+	if reflect.DeepEqual(schemas, []string{"marcxml", "dc"}) == false {
+		t.Errorf("expected the marcxml schema and then the default dc schema, got %v", schemas)
+	}
+}
+
+func TestResourceIDValidation(t *testing.T) {
+	tests := []struct {
+		id       string
+		status   int
+		upstream string
+	}{
+		{id: "1001", status: http.StatusOK, upstream: "1001"},
+		{id: "ocm1001", status: http.StatusOK, upstream: "1001"},
+		{id: "(OCoLC)1001", status: http.StatusOK, upstream: "1001"},
+		{id: "1001abc", status: http.StatusBadRequest},
+		{id: "1001%3FrecordSchema%3Dmarcxml", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.id, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			upstream := ""
+			mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+				upstream = path.Base(r.URL.Path)
+				fmt.Fprint(w, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Cats</title></oclcdcs>")
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := doRequest(newTestRouter(svc), http.MethodGet, "/api/resource/"+tc.id, nil, nil)
+			if resp.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Code, resp.Body.String())
+			}
+			if upstream != tc.upstream {
+				t.Errorf("expected upstream content request for %q, got %q", tc.upstream, upstream)
+			}
+		})
+	}
+}
+
+func TestSearchAuthorVariants(t *testing.T) {
+	tests := []struct {
+		name     string
+		variants bool
+		query    string
+		expected string
+	}{
+		{name: "natural", variants: true, query: "author: {Mark Twain}",
+			expected: `((srw.au all "Mark Twain" OR srw.au all "Twain, Mark"))`},
+		{name: "inverted", variants: true, query: "author: {Twain, Mark}",
+			expected: `((srw.au all "Mark Twain" OR srw.au all "Twain, Mark"))`},
+		{name: "disabled", query: "author: {Twain, Mark}", expected: "(srw.au all Twain, Mark)"},
+		{name: "booleans", variants: true, query: "author: {Twain OR Clemens}", expected: "(srw.au all Twain OR Clemens)"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.AuthorVariants = tc.variants
+			resp, params := searchUpstream(t, mock, cfg, map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchScores(t *testing.T) {
+	pages := []struct {
+		start    int
+		ids      []string
+		expected []string
+	}{
+		{start: 0, ids: []string{"1001", "1002", "1003"}, expected: []string{"1.000000", "0.750000", "0.500000"}},
+		{start: 3, ids: []string{"1004"}, expected: []string{"0.250000"}},
+	}
+	for _, page := range pages {
+		mock := newMockWorldCat(t)
+		mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, sruResponse(4, page.ids...))
+		}
+		svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+		result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search",
+			map[string]interface{}{"query": "keyword: {cats}", "pagination": map[string]int{"start": page.start, "rows": 3}}))
+		scores := make([]string, 0)
+		for group := range result.Groups {
+			scores = append(scores, result.fieldValues(group, "score")...)
+		}
+		if reflect.DeepEqual(scores, page.expected) == false {
+			t.Errorf("expected scores %v at start %d, got %v", page.expected, page.start, scores)
+		}
+	}
+}
+
+func TestSearchOnlineOnly(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "keyword: {cats} AND online: {true}", expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "fulltext: {true} AND title: {cats}", expected: "(srw.ti all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.sruRecords = []string{accessURLRecord("1001", "https://example.com/1001"), accessURLRecord("1002"),
+				accessURLRecord("1003", "https://example.com/1003"), accessURLRecord("1004")}
+			var params url.Values
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				params = r.URL.Query()
+				fmt.Fprint(w, sruRecordsResponse(40, mock.sruRecords...))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": tc.query}))
+			if params.Get("query") != tc.expected {
+				t.Errorf("expected query %s, got %s", tc.expected, params.Get("query"))
+			}
+			titles := make([]string, 0)
+			for group := range result.Groups {
+				titles = append(titles, result.fieldValues(group, "title")...)
+			}
+			if reflect.DeepEqual(titles, []string{"Title 1001", "Title 1003"}) == false {
+				t.Errorf("expected only the online records, got %v", titles)
+			}
+			if result.Pagination.Rows != 2 || result.Pagination.Total != 20 {
+				t.Errorf("expected 2 rows of an approximate 20 total, got %d of %d", result.Pagination.Rows, result.Pagination.Total)
+			}
+			expectedWarning := "Only online items are shown; the total number of results is approximate"
+			if reflect.DeepEqual(result.Warnings, []string{expectedWarning}) == false {
+				t.Errorf("expected warning %s, got %v", expectedWarning, result.Warnings)
+			}
+		})
+	}
+}
+
+func TestRecordSchema(t *testing.T) {
+	marcRec := `<record xmlns="http://www.loc.gov/MARC21/slim"><controlfield tag="001">1001</controlfield>` +
+		`<datafield tag="245"><subfield code="a">Calico cats /</subfield></datafield>` +
+		`<datafield tag="100"><subfield code="a">Smith, Jane.</subfield></datafield></record>`
+	for _, schema := range []string{"dc", "marcxml"} {
+		t.Run(schema, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			var searchSchema, contentSchema string
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				searchSchema = r.URL.Query().Get("recordSchema")
+				if schema == "marcxml" {
+					fmt.Fprint(w, sruRecordsResponse(1, marcRec))
+					return
+				}
+				fmt.Fprint(w, sruRecordsResponse(1, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Calico cats</title>"+
+					"<creator>Smith, Jane</creator></oclcdcs>"))
+			}
+			mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+				contentSchema = r.URL.Query().Get("recordSchema")
+				if schema == "marcxml" {
+					fmt.Fprint(w, marcRec)
+					return
+				}
+				fmt.Fprint(w, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Calico cats</title>"+
+					"<creator>Smith, Jane</creator></oclcdcs>")
+			}
+			cfg := testConfig(mock)
+			cfg.RecordSchema = schema
+			svc := newTestService(t, cfg, 5*time.Second)
+			router := newTestRouter(svc)
+
+			result := parseSearchResult(t, postJSON(router, "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+			if searchSchema != schema {
+				t.Errorf("expected search schema %s, got %s", schema, searchSchema)
+			}
+			if titles := result.fieldValues(0, "title"); reflect.DeepEqual(titles, []string{"Calico cats"}) == false {
+				t.Errorf("expected search title Calico cats, got %v", titles)
+			}
+
+			resp := doRequest(router, http.MethodGet, "/api/resource/1001", nil, nil)
+			if contentSchema != schema {
+				t.Errorf("expected content schema %s, got %s", schema, contentSchema)
+			}
+			if strings.Contains(resp.Body.String(), `"Smith, Jane"`) == false {
+				t.Errorf("expected the mapped author Smith, Jane, got %s", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchSuggestions(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<searchRetrieveResponse><numberOfRecords>0</numberOfRecords><records></records>"+
+			"<extraResponseData><suggestions><suggestion>calico cats</suggestion><suggestion> </suggestion></suggestions>"+
+			"</extraResponseData></searchRetrieveResponse>")
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {calcio cats}"}))
+	if result.Confidence != "low" || len(result.Groups) != 0 {
+		t.Errorf("expected low confidence without results, got %s with %d groups", result.Confidence, len(result.Groups))
+	}
+	if len(result.Warnings) == 0 || result.Warnings[0] != "Did you mean: calico cats" {
+		t.Errorf("expected only the non-blank suggestion first, got %v", result.Warnings)
+	}
+	for _, warning := range result.Warnings[1:] {
+		if strings.HasPrefix(warning, "Did you mean") {
+			t.Errorf("expected one suggestion, got %v", result.Warnings)
+		}
+	}
+}
+
+func TestSearchLowercaseBooleans(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "title: {cats} and author: {smith}", expected: "(srw.ti all cats AND srw.au all smith)"},
+		{query: "keyword: {cats} or title: {dogs} not subject: {birds}", expected: "(srw.kw all cats OR srw.ti all dogs NOT srw.su all birds)"},
+		{query: `title: {"war and peace"}`, expected: `(srw.ti all "war and peace")`},
+		{query: `title: {"war and peace"} or author: {tolstoy}`, expected: `(srw.ti all "war and peace" OR srw.au all tolstoy)`},
+		{query: "title: {cats and dogs}", expected: "(srw.ti all cats and dogs)"},
+		{query: "identifier: {ocm12345}", expected: "(srw.no = 12345)"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchPreview(t *testing.T) {
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	body := map[string]interface{}{"query": "title: {calico*t} and date: {AFTER 2010} AND identifier: {978-0-306-40615-7}",
+		"sort":       map[string]string{"sort_id": v4api.SortDate.String(), "order": "asc"},
+		"pagination": map[string]int{"start": 20, "rows": 10},
+		"filters":    []map[string]interface{}{{"pool_id": "worldcat", "facets": []map[string]string{{"facet_id": "format", "value": "book"}}}}}
+	resp := doRequest(router, http.MethodPost, "/api/search/preview", body, map[string]string{"X-Api-Key": "apikey"})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	var preview sruSearch
+	if err := json.Unmarshal(resp.Body.Bytes(), &preview); err != nil {
+		t.Fatalf("unable to parse preview %s: %s", resp.Body.String(), err.Error())
+	}
+	expected := sruSearch{Query: "(srw.ti all calico* AND srw.yr > 2010 AND srw.bn = 9780306406157) " +
+		"NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM AND (srw.mt = bks)",
+		SortKey: "Date,,1", Start: 20, Rows: 10, Filtered: true,
+		Warnings: []string{"Wildcards are only supported at the end of a term; calico*t was changed to calico*"}}
+	if reflect.DeepEqual(preview, expected) == false {
+		t.Errorf("expected preview %+v, got %+v", expected, preview)
+	}
+	if searches := mock.searches.Load(); searches != 0 {
+		t.Errorf("expected no WorldCat searches, got %d", searches)
+	}
+
+	resp = doRequest(router, http.MethodPost, "/api/search/preview", body, nil)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without auth, got %d", resp.Code)
+	}
+}
+
+func TestSearchIdentifierKeywords(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "isbn-10", query: "keyword: {0306406152}", expected: "((srw.kw all 0306406152 OR srw.bn = 0306406152))"},
+		{name: "isbn-13", query: "keyword: {978-0-306-40615-7}",
+			expected: "((srw.kw all 978-0-306-40615-7 OR srw.bn = 9780306406157))"},
+		{name: "number", query: "keyword: {12345}", expected: "((srw.kw all 12345 OR srw.bn = 12345))"},
+		{name: "issn", query: "keyword: {0040-781X}", expected: "(srw.kw all 0040-781X)"},
+		{name: "mixed fields", query: "keyword: {12345} AND author: {smith}",
+			expected: "((srw.kw all 12345 OR srw.bn = 12345) AND srw.au all smith)"},
+		{name: "mixed isbn", query: "title: {cats} OR keyword: {0306406152}",
+			expected: "(srw.ti all cats OR (srw.kw all 0306406152 OR srw.bn = 0306406152))"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchIdentifierRelation(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		relation string
+		expected string
+	}{
+		{name: "isbn-13", query: "identifier: {978-0-306-40615-7}", relation: "all", expected: "(srw.bn = 9780306406157)"},
+		{name: "isbn-10", query: "identifier: {0-306-40615-2}", relation: "all", expected: "(srw.bn = 0306406152)"},
+		{name: "standard number exact", query: "identifier: {0040-781X}", relation: "=", expected: `(srw.sn = "0040-781X")`},
+		{name: "standard number contains", query: "identifier: {0040-781X}", relation: "all", expected: `(srw.sn all "0040-781X")`},
+		{name: "number", query: "identifier: {12345}", relation: "all", expected: "(srw.bn = 12345)"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.IdentifierRelation = tc.relation
+			resp, params := searchUpstream(t, mock, cfg, map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchDOI(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+		err      string
+	}{
+		{name: "bare doi", query: "doi: {10.1000/XYZ123}", expected: `(srw.sn = "10.1000/xyz123")`},
+		{name: "url doi", query: "doi: {https://doi.org/10.1000/XYZ123}", expected: `(srw.sn = "10.1000/xyz123")`},
+		{name: "prefixed doi", query: "title: {cats} AND doi: {doi:10.1000/xyz123}", expected: `(srw.ti all cats AND srw.sn = "10.1000/xyz123")`},
+		{name: "malformed doi", query: "doi: {https://doi.org/xyz123}", err: "https://doi.org/xyz123 is not a valid DOI"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if tc.err != "" {
+				if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.err) == false || params != nil {
+					t.Errorf("expected status 400 with %s and no search, got %d: %s", tc.err, resp.Code, resp.Body.String())
+				}
+				return
+			}
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+			expected := []string{"WorldCat has no DOI index; DOIs are searched as standard numbers and may not match"}
+			if warnings := parseSearchResult(t, resp).Warnings; reflect.DeepEqual(warnings, expected) == false {
+				t.Errorf("expected warnings %v, got %v", expected, warnings)
+			}
+		})
+	}
+}
+
+func TestResourceNotFound(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		content string
+	}{
+		{name: "empty content", status: http.StatusOK, content: ""},
+		{name: "blank content", status: http.StatusOK, content: " \n "},
+		{name: "empty record", status: http.StatusOK, content: "<oclcdcs></oclcdcs>"},
+		{name: "upstream 404", status: http.StatusNotFound, content: "not found"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				fmt.Fprint(w, tc.content)
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/api/resource/1001", nil, map[string]string{"X-Api-Key": "apikey"})
+			if resp.Code != http.StatusNotFound {
+				t.Fatalf("expected status 404, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.Contains(resp.Body.String(), `"message":"1001 not found"`) == false {
+				t.Errorf("expected a not found message for 1001, got %s", resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestSearchLanguage(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{query: "language: {french}", expected: "(srw.la = fre)"},
+		{query: "keyword: {cats} AND language: {French}", expected: "(srw.kw all cats AND srw.la = fre)"},
+		{query: "keyword: {cats} AND language: {french OR de}", expected: "(srw.kw all cats AND (srw.la = fre OR srw.la = ger))"},
+		{query: "language: {spa} AND title: {gatos}", expected: "(srw.la = spa AND srw.ti all gatos)"},
+		{query: "language: {klingon}", err: "klingon is not a supported language"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if tc.err != "" {
+				if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.err) == false || params != nil {
+					t.Errorf("expected status 400 with %s and no search, got %d: %s", tc.err, resp.Code, resp.Body.String())
+				}
+				return
+			}
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchSortValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		sortID   string
+		strict   bool
+		status   int
+		expected string
+		warnings []string
+	}{
+		{name: "valid", sortID: v4api.SortTitle.String(), status: http.StatusOK, expected: "Title,,1", warnings: []string{}},
+		{name: "empty uses default", sortID: "", status: http.StatusOK, expected: "Date,,1", warnings: []string{}},
+		{name: "unknown", sortID: "SortTitel", status: http.StatusOK, expected: "Date,,1",
+			warnings: []string{"Sort SortTitel is not supported; results are sorted by SortDatePublished"}},
+		{name: "unknown strict", sortID: "SortTitel", strict: true, status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			cfg.DefaultSort, cfg.DefaultSortOrder, cfg.StrictSort = v4api.SortDate.String(), "asc", tc.strict
+			resp, params := searchUpstream(t, mock, cfg, map[string]interface{}{"query": "keyword: {cats}",
+				"sort": map[string]string{"sort_id": tc.sortID, "order": "asc"}})
+			if resp.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Code, resp.Body.String())
+			}
+			if tc.status != http.StatusOK {
+				if params != nil || strings.Contains(resp.Body.String(), "SortTitel is not a supported sort") == false {
+					t.Errorf("expected an unsupported sort error without a search, got %s", resp.Body.String())
+				}
+				return
+			}
+			if params.Get("sortKeys") != tc.expected {
+				t.Errorf("expected sortKeys %s, got %s", tc.expected, params.Get("sortKeys"))
+			}
+			var result searchResult
+			json.Unmarshal(resp.Body.Bytes(), &result)
+			if result.Warnings == nil {
+				result.Warnings = []string{}
+			}
+			if reflect.DeepEqual(result.Warnings, tc.warnings) == false {
+				t.Errorf("expected warnings %v, got %v", tc.warnings, result.Warnings)
+			}
+		})
+	}
+}
+
+func TestSearchCallNumber(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		err      string
+	}{
+		{query: "callnumber: {QA76.73 .P98 2019}", expected: `(srw.lc = "QA76.73 .P98 2019")`},
+		{query: "callnumber: {qa76.73}", expected: `(srw.lc = "QA76.73")`},
+		{query: "callnumber: {005.133}", expected: `(srw.dd = "005.133")`},
+		{query: "keyword: {python} AND callnumber: {QA76.73 OR 005.133}",
+			expected: `(srw.kw all python AND (srw.lc = "QA76.73" OR srw.dd = "005.133"))`},
+		{query: "callnumber: {!!!}", err: "!!! is not a valid call number"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if tc.err != "" {
+				if resp.Code != http.StatusBadRequest || strings.Contains(resp.Body.String(), tc.err) == false || params != nil {
+					t.Errorf("expected status 400 with %s and no search, got %d: %s", tc.err, resp.Code, resp.Body.String())
+				}
+				return
+			}
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestSearchPageOffsets(t *testing.T) {
+	tests := []struct {
+		name  string
+		start int
+		ids   []string
+		next  string
+		prev  string
+	}{
+		{name: "first page", start: 0, ids: []string{"1001", "1002", "1003"}, next: "10", prev: "null"},
+		{name: "middle page", start: 10, ids: []string{"1011", "1012", "1013"}, next: "20", prev: "0"},
+		{name: "last page", start: 20, ids: []string{"1021", "1022"}, next: "null", prev: "10"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruResponse(25, tc.ids...))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := postJSON(newTestRouter(svc), "/api/search",
+				map[string]interface{}{"query": "keyword: {cats}", "pagination": map[string]int{"start": tc.start, "rows": 10}})
+			var offsets map[string]json.RawMessage
+			if err := json.Unmarshal(resp.Body.Bytes(), &offsets); err != nil {
+				t.Fatalf("unable to parse response %s: %s", resp.Body.String(), err.Error())
+			}
+			if string(offsets["next_start"]) != tc.next || string(offsets["prev_start"]) != tc.prev {
+				t.Errorf("expected next %s and prev %s, got %s and %s", tc.next, tc.prev, offsets["next_start"], offsets["prev_start"])
+			}
+		})
+	}
+}
+
+func TestResourceWithoutOCLC(t *testing.T) {
+	tests := []struct {
+		name    string
+		oclc    bool
+		formats []string
+	}{
+		{name: "unconfigured", formats: []string{}},
+		{name: "configured", oclc: true, formats: []string{"Book"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			cfg := testConfig(mock)
+			if tc.oclc {
+				cfg = oclcTestConfig(mock)
+			} else {
+				cfg.OCLCAuthURL, cfg.OCLCMetadataAPI = "", ""
+			}
+			svc := newTestService(t, cfg, 5*time.Second)
+
+			resp := doRequest(newTestRouter(svc), http.MethodGet, "/api/resource/1001", nil, nil)
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			var record struct {
+				Fields []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"fields"`
+			}
+			json.Unmarshal(resp.Body.Bytes(), &record)
+			titles, formats := make([]string, 0), make([]string, 0)
+			for _, f := range record.Fields {
+				if f.Name == "title" {
+					titles = append(titles, f.Value)
+				} else if f.Name == "general_format" {
+					formats = append(formats, f.Value)
+				}
+			}
+			if reflect.DeepEqual(titles, []string{"Title 1001"}) == false {
+				t.Errorf("expected the base title field, got %v", titles)
+			}
+			if reflect.DeepEqual(formats, tc.formats) == false {
+				t.Errorf("expected general formats %v, got %v", tc.formats, formats)
+			}
+			if tc.oclc == false && mock.tokens.Load() != 0 {
+				t.Errorf("expected no OCLC token requests, got %d", mock.tokens.Load())
+			}
+		})
+	}
+}
+
+func TestSearchMaxOffset(t *testing.T) {
+	tests := []struct {
+		start    int
+		rows     int
+		expected int
+	}{
+		{start: 990, rows: 10, expected: http.StatusOK},
+		{start: 991, rows: 10, expected: http.StatusBadRequest},
+		{start: 5000, rows: 20, expected: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tc.start, tc.rows), func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": "keyword: {cats}",
+				"pagination": map[string]int{"start": tc.start, "rows": tc.rows}})
+			if resp.Code != tc.expected {
+				t.Fatalf("expected status %d, got %d: %s", tc.expected, resp.Code, resp.Body.String())
+			}
+			if tc.expected == http.StatusBadRequest {
+				msg := "Only the first 1000 results are available; start plus rows cannot exceed 1000"
+				if strings.Contains(resp.Body.String(), msg) == false || params != nil {
+					t.Errorf("expected %s without a WorldCat search, got %s", msg, resp.Body.String())
+				}
+			}
+		})
+	}
+
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	resp := doRequest(newServiceRouter(svc, false), http.MethodGet, "/identify", nil, nil)
+	if strings.Contains(resp.Body.String(), `{"name":"max_offset","supported":true,"value":"1000"}`) == false {
+		t.Errorf("expected the max offset in the identify attributes, got %s", resp.Body.String())
+	}
+}
+
+func TestResourceServiceLevel(t *testing.T) {
+	tests := []struct {
+		query    string
+		status   int
+		expected string
+	}{
+		{query: "", status: http.StatusOK, expected: "full"},
+		{query: "?serviceLevel=default", status: http.StatusOK, expected: "default"},
+		{query: "?serviceLevel=full", status: http.StatusOK, expected: "full"},
+		{query: "?serviceLevel=everything", status: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			serviceLevel := ""
+			mock.onContent = func(w http.ResponseWriter, r *http.Request) {
+				serviceLevel = r.URL.Query().Get("serviceLevel")
+				fmt.Fprint(w, dcRecord("1001"))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			resp := doRequest(newTestRouter(svc), http.MethodGet, "/api/resource/1001"+tc.query, nil, nil)
+			if resp.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, resp.Code, resp.Body.String())
+			}
+			if serviceLevel != tc.expected {
+				t.Errorf("expected upstream service level %q, got %q", tc.expected, serviceLevel)
+			}
+		})
+	}
+}
+
+func TestSearchISBNDedup(t *testing.T) {
+	mock := newMockWorldCat(t)
+	mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, sruRecordsResponse(1, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Cats</title>"+
+			"<identifier>978-0-306-40615-7</identifier><identifier>9780306406157</identifier><identifier>0306406152</identifier>"+
+			"<identifier>0-306-40615-2</identifier><identifier>0306406152 (pbk.)</identifier></oclcdcs>"))
+	}
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+	result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+	expected := []string{"978-0-306-40615-7", "0306406152"}
+	if isbns := result.fieldValues(0, "isbn"); reflect.DeepEqual(isbns, expected) == false {
+		t.Errorf("expected the first of each distinct ISBN %v, got %v", expected, isbns)
+	}
+}
+
+func TestSearchBasicFields(t *testing.T) {
+	tests := []struct {
+		path     string
+		detailed bool
+	}{
+		{path: "/api/search", detailed: true},
+		{path: "/api/search?fields=basic", detailed: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), tc.path, map[string]interface{}{"query": "keyword: {cats}"}))
+			if titles := result.fieldValues(0, "title"); reflect.DeepEqual(titles, []string{"Title 1001"}) == false {
+				t.Errorf("expected the basic title field, got %v", titles)
+			}
+			for _, name := range []string{"worldcat_url", "language"} {
+				if found := len(result.fieldValues(0, name)) > 0; found != tc.detailed {
+					t.Errorf("expected detailed field %s present to be %t, got %t", name, tc.detailed, found)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchExactSubject(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "subject: {Cats -- Behavior}", expected: "(srw.su all Cats -- Behavior)"},
+		{query: "subject_exact: {Cats -- Behavior}", expected: `(srw.su = "Cats -- Behavior")`},
+		{query: `subject_exact: {"Cats  --  Behavior"}`, expected: `(srw.su = "Cats -- Behavior")`},
+		{query: "keyword: {pets} AND subject_exact: {Cats -- Behavior}", expected: `(srw.kw all pets AND srw.su = "Cats -- Behavior")`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestFieldsAreSearchable(t *testing.T) {
+	samples := map[string]string{"keyword": "cats", "title": "cats", "author": "smith", "subject": "cats", "series": "cats",
+		"publisher_location": "york", "identifier": "0306406152", "doi": "10.1000/xyz", "subject_exact": "Cats -- Behavior",
+		"language": "french", "callnumber": "QA76.73", "date": "1987", "online": "true", "fulltext": "true"}
+	mock := newMockWorldCat(t)
+	svc := newTestService(t, testConfig(mock), 5*time.Second)
+	router := newServiceRouter(svc, false)
+
+	resp := doRequest(router, http.MethodGet, "/api/fields", nil, nil)
+	var fields struct {
+		Fields []queryField `json:"fields"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("unable to parse fields %s: %s", resp.Body.String(), err.Error())
+	}
+	if len(fields.Fields) != len(samples) {
+		t.Errorf("expected %d fields, got %d: %s", len(samples), len(fields.Fields), resp.Body.String())
+	}
+	for _, field := range fields.Fields {
+		sample, found := samples[field.Name]
+		if found == false {
+			t.Errorf("advertised field %s has no sample search", field.Name)
+			continue
+		}
+		clause := fmt.Sprintf("%s: {%s}", field.Name, sample)
+		queries := []string{clause, "keyword: {cats} AND " + clause}
+		if field.Name == "online" || field.Name == "fulltext" {
+			// these only restrict the results of another search
+			queries = queries[1:]
+		}
+		for _, query := range queries {
+			resp := doRequest(router, http.MethodPost, "/api/search/preview", map[string]interface{}{"query": query},
+				map[string]string{"X-Api-Key": "apikey"})
+			if resp.Code != http.StatusOK {
+				t.Errorf("expected advertised field query %s to be accepted, got %d: %s", query, resp.Code, resp.Body.String())
+			}
+		}
+	}
+}
+
+func TestSearchNoResultsGuidance(t *testing.T) {
+	noResults := "No results were found. Try fewer or broader search terms, and check the spelling."
+	filtered := "Filters were applied to this search. Try removing them to see more results."
+	fields := "This search was limited to specific fields. Try a keyword search instead."
+	bookFilter := []map[string]interface{}{{"pool_id": "worldcat", "facets": []map[string]string{{"facet_id": "format", "value": "book"}}}}
+	tests := []struct {
+		name     string
+		query    string
+		filters  interface{}
+		ids      []string
+		expected []string
+	}{
+		{name: "results", query: "keyword: {cats}", ids: []string{"1001"}, expected: []string{}},
+		{name: "keyword", query: "keyword: {cats}", expected: []string{noResults}},
+		{name: "filtered", query: "keyword: {cats}", filters: bookFilter, expected: []string{noResults, filtered}},
+		{name: "fields", query: "title: {cats}", expected: []string{noResults, fields}},
+		{name: "online", query: "keyword: {cats} AND online: {true}", expected: []string{noResults, filtered}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruResponse(len(tc.ids), tc.ids...))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+			body := map[string]interface{}{"query": tc.query}
+			if tc.filters != nil {
+				body["filters"] = tc.filters
+			}
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", body))
+			if result.Warnings == nil {
+				result.Warnings = []string{}
+			}
+			if reflect.DeepEqual(result.Warnings, tc.expected) == false {
+				t.Errorf("expected warnings %v, got %v", tc.expected, result.Warnings)
+			}
+		})
+	}
+}
+
+func TestSearchPublisherLocation(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "publisher_location: {New York}", expected: "(srw.pl all New York)"},
+		{query: "title: {cats} AND publisher_location: {London}", expected: "(srw.ti all cats AND srw.pl all London)"},
+		{query: "publisher_location: {Paris} OR publisher_location: {Lyon}", expected: "(srw.pl all Paris OR srw.pl all Lyon)"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": tc.query})
+			if resp.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+			}
+			if strings.HasPrefix(params.Get("query"), tc.expected+" NOT srw.li") == false {
+				t.Errorf("expected query to start with %s, got %s", tc.expected, params.Get("query"))
+			}
+		})
+	}
+}
+
+func TestPublicationPlaceField(t *testing.T) {
+	tests := []struct {
+		name     string
+		record   string
+		expected []string
+	}{
+		{name: "publisher with place", record: "<publisher>New York : Random House</publisher><publisher>[London] : Penguin</publisher>",
+			expected: []string{"New York", "London"}},
+		{name: "publisher without place", record: "<publisher>Random House</publisher>", expected: []string{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, sruRecordsResponse(1, "<oclcdcs><recordIdentifier>1001</recordIdentifier><title>Cats</title>"+
+					tc.record+"</oclcdcs>"))
+			}
+			svc := newTestService(t, testConfig(mock), 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+			if places := result.fieldValues(0, "publication_place"); reflect.DeepEqual(places, tc.expected) == false {
+				t.Errorf("expected places %v, got %v", tc.expected, places)
+			}
+		})
+	}
+}
+
+func TestSearchNoSort(t *testing.T) {
+	requests := map[string]map[string]interface{}{
+		"no sort":    {"query": "keyword: {cats}"},
+		"empty sort": {"query": "keyword: {cats}", "sort": map[string]string{"sort_id": "", "order": ""}},
+	}
+	for name, body := range requests {
+		t.Run(name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			resp, params := searchUpstream(t, mock, testConfig(mock), body)
+			if params.Get("sortKeys") != "relevance,,0" {
+				t.Errorf("expected an explicit relevance sortKeys, got %q", params.Get("sortKeys"))
+			}
+			var result struct {
+				Sort v4api.SortOrder `json:"sort"`
+			}
+			json.Unmarshal(resp.Body.Bytes(), &result)
+			expected := v4api.SortOrder{SortID: v4api.SortRelevance.String(), Order: "desc"}
+			if result.Sort != expected {
+				t.Errorf("expected sort %+v to be echoed, got %+v", expected, result.Sort)
+			}
+		})
+	}
+}
+
+func TestSearchPartnerHoldings(t *testing.T) {
+	tests := []struct {
+		name     string
+		partners string
+		expected [][]string
+		searches int32
+	}{
+		{name: "partners", partners: "VPI, XYZ", expected: [][]string{{"VPI, XYZ"}, {}, {"XYZ"}}, searches: 3},
+		{name: "disabled", expected: [][]string{{}, {}, {}}, searches: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mock := newMockWorldCat(t)
+			mock.onSearch = func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query().Get("query")
+				switch {
+				case strings.HasSuffix(query, "srw.li = VPI"):
+					fmt.Fprint(w, sruResponse(1, "1001"))
+				case strings.HasSuffix(query, "srw.li = XYZ"):
+					fmt.Fprint(w, sruResponse(2, "1003", "1001"))
+				default:
+					fmt.Fprint(w, sruResponse(3, "1001", "1002", "1003"))
+				}
+			}
+			cfg := testConfig(mock)
+			cfg.PartnerSymbols = tc.partners
+			svc := newTestService(t, cfg, 5*time.Second)
+
+			result := parseSearchResult(t, postJSON(newTestRouter(svc), "/api/search", map[string]interface{}{"query": "keyword: {cats}"}))
+			for group, expected := range tc.expected {
+				if partners := result.fieldValues(group, "partner_holding"); reflect.DeepEqual(partners, expected) == false {
+					t.Errorf("expected partners %v for group %d, got %v", expected, group, partners)
+				}
+			}
+			if searches := mock.searches.Load(); searches != tc.searches {
+				t.Errorf("expected %d WorldCat searches, got %d", tc.searches, searches)
+			}
+		})
+	}
+}
+
+func TestExcludeLibraries(t *testing.T) {
+	symbols := []string{"VA@", "VAL", "VAM"}
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "srw.kw all cats", expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM",
+			expected: "(srw.kw all cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "(srw.kw all cats) NOT srw.li = VAL",
+			expected: "((srw.kw all cats)) NOT srw.li = VAL NOT srw.li = VA@ NOT srw.li = VAM"},
+		{query: `srw.kw all cats not srw.li = "vam"`,
+			expected: "(srw.kw all cats) NOT srw.li = vam NOT srw.li = VA@ NOT srw.li = VAL"},
+		{query: "srw.kw all dogs NOT srw.li = VAL OR cats",
+			expected: "(srw.kw all dogs NOT srw.li = VAL OR cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+		{query: "(srw.kw all dogs NOT srw.li = VAL)",
+			expected: "((srw.kw all dogs NOT srw.li = VAL)) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			if out := excludeLibraries(tc.query, symbols); out != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, out)
+			}
+		})
+	}
+}
+
+func TestSearchNestedExclusionText(t *testing.T) {
+	mock := newMockWorldCat(t)
+	resp, params := searchUpstream(t, mock, testConfig(mock), map[string]interface{}{"query": "keyword: {dogs NOT srw.li = VAL OR cats}"})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", resp.Code, resp.Body.String())
+	}
+	expected := "(srw.kw all dogs NOT srw.li = VAL OR cats) NOT srw.li = VA@ NOT srw.li = VAL NOT srw.li = VAM"
+	if params.Get("query") != expected {
+		t.Errorf("expected query %s, got %s", expected, params.Get("query"))
+	}
+}
@@ -10,11 +10,14 @@ require (
 	github.com/gin-contrib/gzip v1.1.0
 	github.com/gin-gonic/contrib v0.0.0-20250109035243-6b853de2d2fe
 	github.com/gin-gonic/gin v1.10.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/nicksnyder/go-i18n/v2 v2.4.1
 	github.com/uvalib/virgo4-api v0.0.0-20241126213111-b647424688f9
 	github.com/uvalib/virgo4-jwt v1.0.0
 	github.com/uvalib/virgo4-parser v0.0.0-20220606190657-5119d778d14a
+	golang.org/x/sync v0.10.0
 	golang.org/x/text v0.21.0
+	golang.org/x/time v0.9.0
 )
 
 require (
@@ -28,7 +31,6 @@ require (
 	github.com/go-playground/universal-translator v0.18.1 // indirect
 	github.com/go-playground/validator/v10 v10.23.0 // indirect
 	github.com/goccy/go-json v0.10.4 // indirect
-	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.9 // indirect